@@ -15,6 +15,9 @@ import (
 
 var jwtKey = []byte(os.Getenv("JWT_SECRET"))
 
+// forwardedResponseHeaders are copied from upstream responses to the client.
+var forwardedResponseHeaders = []string{"ETag", "Location", "Cache-Control", "Last-Modified", "Vary"}
+
 func verifyJWT() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		tokenStr := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
@@ -43,6 +46,9 @@ func proxyService(serviceURL string, stripPrefix string) gin.HandlerFunc {
 			path = strings.TrimPrefix(path, stripPrefix)
 		}
 		fullURL := fmt.Sprintf("%s%s", serviceURL, path)
+		if c.Request.URL.RawQuery != "" {
+			fullURL += "?" + c.Request.URL.RawQuery
+		}
 		log.Printf("Proxying request to: %s", fullURL)
 
 		req, err := http.NewRequest(c.Request.Method, fullURL, c.Request.Body)
@@ -65,6 +71,11 @@ func proxyService(serviceURL string, stripPrefix string) gin.HandlerFunc {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read response body"})
 			return
 		}
+		for _, h := range forwardedResponseHeaders {
+			if v := resp.Header.Get(h); v != "" {
+				c.Header(h, v)
+			}
+		}
 		c.Data(resp.StatusCode, resp.Header.Get("Content-Type"), body)
 	}
 }
@@ -75,8 +86,9 @@ func main() {
 	// Enable CORS for the frontend
 	r.Use(func(c *gin.Context) {
 		c.Header("Access-Control-Allow-Origin", "*")
-		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Origin, Content-Type, Authorization")
+		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		c.Header("Access-Control-Allow-Headers", "Origin, Content-Type, Authorization, If-Match, If-None-Match, If-Modified-Since, Accept-Currency")
+		c.Header("Access-Control-Expose-Headers", "ETag, Location, Last-Modified, Link, X-Next-Cursor, X-Total-Count")
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
@@ -109,6 +121,11 @@ func main() {
 	// Public route for authentication (no /api prefix)
 	r.POST("/login", proxyService(userServiceURL, ""))
 
+	// Book covers are public so that browsers can load them in <img> tags
+	r.GET("/books/:id/cover", proxyService(bookServiceURL, ""))
+	// Shared wishlists are public; the token in the link is the credential
+	r.GET("/shared/wishlists/:token", proxyService(bookServiceURL, ""))
+
 	// Protected group
 	auth := r.Group("/", verifyJWT())
 	{
@@ -121,8 +138,88 @@ func main() {
 		auth.GET("/books", proxyService(bookServiceURL, ""))
 		auth.POST("/books", proxyService(bookServiceURL, ""))
 		auth.GET("/books/:id", proxyService(bookServiceURL, ""))
+		auth.PUT("/books/:id", proxyService(bookServiceURL, ""))
+		auth.PATCH("/books/:id", proxyService(bookServiceURL, ""))
 		auth.DELETE("/books/:id", proxyService(bookServiceURL, ""))
 		auth.GET("/books/stats", proxyService(bookServiceURL, ""))
+		auth.GET("/books/analytics", proxyService(bookServiceURL, ""))
+		auth.POST("/books/analytics/refresh", proxyService(bookServiceURL, ""))
+		auth.GET("/books/search", proxyService(bookServiceURL, ""))
+		auth.POST("/books/import", proxyService(bookServiceURL, ""))
+		auth.GET("/books/export", proxyService(bookServiceURL, ""))
+		auth.GET("/books/trash", proxyService(bookServiceURL, ""))
+		auth.POST("/books/:id/restore", proxyService(bookServiceURL, ""))
+		auth.GET("/books/:id/reviews", proxyService(bookServiceURL, ""))
+		auth.POST("/books/:id/reviews", proxyService(bookServiceURL, ""))
+		auth.PATCH("/books/:id/reviews/:review_id", proxyService(bookServiceURL, ""))
+		auth.DELETE("/books/:id/reviews/:review_id", proxyService(bookServiceURL, ""))
+		auth.GET("/books/:id/prices", proxyService(bookServiceURL, ""))
+		auth.PUT("/books/:id/prices", proxyService(bookServiceURL, ""))
+		auth.GET("/books/:id/price", proxyService(bookServiceURL, ""))
+		auth.GET("/books/:id/recommendations", proxyService(bookServiceURL, ""))
+		auth.POST("/books/recommendations/rebuild", proxyService(bookServiceURL, ""))
+		auth.POST("/books/:id/cover", proxyService(bookServiceURL, ""))
+		auth.DELETE("/books/:id/cover", proxyService(bookServiceURL, ""))
+		auth.GET("/books/:id/authors", proxyService(bookServiceURL, ""))
+		auth.PUT("/books/:id/authors", proxyService(bookServiceURL, ""))
+		auth.GET("/books/:id/categories", proxyService(bookServiceURL, ""))
+		auth.PUT("/books/:id/categories", proxyService(bookServiceURL, ""))
+		auth.GET("/books/:id/stock", proxyService(bookServiceURL, ""))
+		auth.POST("/books/:id/stock/reservations", proxyService(bookServiceURL, ""))
+		auth.GET("/books/:id/stock/adjustments", proxyService(bookServiceURL, ""))
+		auth.POST("/books/:id/stock/adjustments", proxyService(bookServiceURL, ""))
+		auth.GET("/books/:id/variants", proxyService(bookServiceURL, ""))
+		auth.POST("/books/:id/variants", proxyService(bookServiceURL, ""))
+		auth.GET("/books/:id/variants/:variant_id", proxyService(bookServiceURL, ""))
+		auth.PATCH("/books/:id/variants/:variant_id", proxyService(bookServiceURL, ""))
+		auth.DELETE("/books/:id/variants/:variant_id", proxyService(bookServiceURL, ""))
+		auth.GET("/books/:id/variants/:variant_id/stock", proxyService(bookServiceURL, ""))
+		auth.POST("/books/:id/variants/:variant_id/stock/reservations", proxyService(bookServiceURL, ""))
+		auth.GET("/books/:id/variants/:variant_id/stock/adjustments", proxyService(bookServiceURL, ""))
+		auth.POST("/books/:id/variants/:variant_id/stock/adjustments", proxyService(bookServiceURL, ""))
+		auth.GET("/authors", proxyService(bookServiceURL, ""))
+		auth.POST("/authors", proxyService(bookServiceURL, ""))
+		auth.GET("/authors/:id", proxyService(bookServiceURL, ""))
+		auth.PUT("/authors/:id", proxyService(bookServiceURL, ""))
+		auth.PATCH("/authors/:id", proxyService(bookServiceURL, ""))
+		auth.DELETE("/authors/:id", proxyService(bookServiceURL, ""))
+		auth.GET("/authors/:id/books", proxyService(bookServiceURL, ""))
+		auth.GET("/categories", proxyService(bookServiceURL, ""))
+		auth.POST("/categories", proxyService(bookServiceURL, ""))
+		auth.GET("/categories/:id", proxyService(bookServiceURL, ""))
+		auth.PATCH("/categories/:id", proxyService(bookServiceURL, ""))
+		auth.DELETE("/categories/:id", proxyService(bookServiceURL, ""))
+		auth.GET("/categories/:id/books", proxyService(bookServiceURL, ""))
+		auth.POST("/categories/:id/move", proxyService(bookServiceURL, ""))
+		auth.POST("/categories/:id/merge", proxyService(bookServiceURL, ""))
+		auth.GET("/promotions", proxyService(bookServiceURL, ""))
+		auth.POST("/promotions", proxyService(bookServiceURL, ""))
+		auth.GET("/promotions/:id", proxyService(bookServiceURL, ""))
+		auth.PATCH("/promotions/:id", proxyService(bookServiceURL, ""))
+		auth.DELETE("/promotions/:id", proxyService(bookServiceURL, ""))
+		auth.GET("/exchange-rates", proxyService(bookServiceURL, ""))
+		auth.PUT("/exchange-rates", proxyService(bookServiceURL, ""))
+		auth.DELETE("/exchange-rates/:base/:quote/:effective_from", proxyService(bookServiceURL, ""))
+		auth.GET("/reservations/:id", proxyService(bookServiceURL, ""))
+		auth.POST("/reservations/:id/commit", proxyService(bookServiceURL, ""))
+		auth.POST("/reservations/:id/release", proxyService(bookServiceURL, ""))
+		auth.GET("/series", proxyService(bookServiceURL, ""))
+		auth.POST("/series", proxyService(bookServiceURL, ""))
+		auth.GET("/series/:id", proxyService(bookServiceURL, ""))
+		auth.PATCH("/series/:id", proxyService(bookServiceURL, ""))
+		auth.DELETE("/series/:id", proxyService(bookServiceURL, ""))
+		auth.GET("/series/:id/next", proxyService(bookServiceURL, ""))
+		auth.PUT("/series/:id/books/:book_id", proxyService(bookServiceURL, ""))
+		auth.DELETE("/series/:id/books/:book_id", proxyService(bookServiceURL, ""))
+		auth.GET("/wishlist", proxyService(bookServiceURL, ""))
+		auth.POST("/wishlist", proxyService(bookServiceURL, ""))
+		auth.GET("/wishlist/:list_id", proxyService(bookServiceURL, ""))
+		auth.PATCH("/wishlist/:list_id", proxyService(bookServiceURL, ""))
+		auth.DELETE("/wishlist/:list_id", proxyService(bookServiceURL, ""))
+		auth.POST("/wishlist/:list_id/items", proxyService(bookServiceURL, ""))
+		auth.DELETE("/wishlist/:list_id/items/:book_id", proxyService(bookServiceURL, ""))
+		auth.POST("/wishlist/:list_id/share", proxyService(bookServiceURL, ""))
+		auth.DELETE("/wishlist/:list_id/share", proxyService(bookServiceURL, ""))
 
 		// Order service routes
 		auth.POST("/order", proxyService(orderServiceURL, ""))
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultAnalyticsRefreshInterval = 10 * time.Minute
+	defaultNeverOrderedLimit        = 50
+
+	// maxGrowthPeriods bounds the growth series, roughly two years of days.
+	maxGrowthPeriods = 731
+)
+
+// priceBands are the buckets of book_analytics.price_band in display
+// order. Bounds are in major units of each book's own currency.
+var priceBands = []string{"unpriced", "under_10", "10_to_25", "25_to_50", "50_and_over"}
+
+// GrowthPoint counts the books added in the day or week starting at Period.
+type GrowthPoint struct {
+	Period Date `json:"period"`
+	Added  int  `json:"added"`
+}
+
+// GenreCount counts books under one top-level category. CategoryID is nil
+// for the books without a category.
+type GenreCount struct {
+	CategoryID *string `json:"category_id"`
+	Name       string  `json:"name"`
+	Count      int     `json:"count"`
+}
+
+type LanguageCount struct {
+	Language string `json:"language"`
+	Count    int    `json:"count"`
+}
+
+type PriceBandCount struct {
+	Band  string `json:"band"`
+	Count int    `json:"count"`
+}
+
+type NeverOrderedBook struct {
+	ID        string    `json:"id"`
+	Title     string    `json:"title"`
+	Author    string    `json:"author"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// NeverOrdered lists the oldest books without a committed stock
+// reservation; Count covers all of them.
+type NeverOrdered struct {
+	Count int                `json:"count"`
+	Books []NeverOrderedBook `json:"books"`
+}
+
+// CatalogAnalytics is returned by GET /books/analytics. Every figure is
+// limited to books added within [From, To] as of RefreshedAt.
+type CatalogAnalytics struct {
+	From         *Date            `json:"from,omitempty"`
+	To           Date             `json:"to"`
+	Interval     string           `json:"interval"`
+	TotalBooks   int              `json:"total_books"`
+	Growth       []GrowthPoint    `json:"growth"`
+	ByGenre      []GenreCount     `json:"by_genre"`
+	ByLanguage   []LanguageCount  `json:"by_language"`
+	ByPriceBand  []PriceBandCount `json:"by_price_band"`
+	NeverOrdered NeverOrdered     `json:"never_ordered"`
+	RefreshedAt  *time.Time       `json:"refreshed_at"`
+}
+
+// truncatePeriod returns the start of the day or ISO week containing t.
+func truncatePeriod(t time.Time, interval string) time.Time {
+	t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	if interval == "week" {
+		t = t.AddDate(0, 0, -((int(t.Weekday()) + 6) % 7))
+	}
+	return t
+}
+
+func nextPeriod(t time.Time, interval string) time.Time {
+	if interval == "week" {
+		return t.AddDate(0, 0, 7)
+	}
+	return t.AddDate(0, 0, 1)
+}
+
+// getCatalogAnalytics reports catalog growth and distributions from the
+// book_analytics materialized view. Query parameters: from and to
+// (YYYY-MM-DD, inclusive; to defaults to today and from to the first
+// book), interval (day or week, default day) and never_ordered_limit.
+func getCatalogAnalytics(c *gin.Context) {
+	resp := CatalogAnalytics{
+		To:           Date{truncatePeriod(time.Now().UTC(), "day")},
+		Interval:     c.DefaultQuery("interval", "day"),
+		Growth:       []GrowthPoint{},
+		ByGenre:      []GenreCount{},
+		ByLanguage:   []LanguageCount{},
+		ByPriceBand:  []PriceBandCount{},
+		NeverOrdered: NeverOrdered{Books: []NeverOrderedBook{}},
+	}
+	if resp.Interval != "day" && resp.Interval != "week" {
+		c.JSON(400, gin.H{"error": "interval must be day or week"})
+		return
+	}
+	if raw := c.Query("from"); raw != "" {
+		t, err := time.Parse(dateLayout, raw)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "from must be a date in YYYY-MM-DD format"})
+			return
+		}
+		resp.From = &Date{t}
+	}
+	if raw := c.Query("to"); raw != "" {
+		t, err := time.Parse(dateLayout, raw)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "to must be a date in YYYY-MM-DD format"})
+			return
+		}
+		resp.To = Date{t}
+	}
+	if resp.From != nil && resp.From.After(resp.To.Time) {
+		c.JSON(400, gin.H{"error": "from must not be after to"})
+		return
+	}
+	limit := defaultNeverOrderedLimit
+	if raw := c.Query("never_ordered_limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 || n > maxPageSize {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("never_ordered_limit must be between 0 and %d", maxPageSize)})
+			return
+		}
+		limit = n
+	}
+
+	// Read every section from one snapshot so that a concurrent refresh
+	// cannot make the figures disagree.
+	tx, err := db.BeginTx(c.Request.Context(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to fetch analytics"})
+		return
+	}
+	defer tx.Rollback()
+
+	if status, msg := loadCatalogAnalytics(tx, &resp, limit); status != 0 {
+		c.JSON(status, gin.H{"error": msg})
+		return
+	}
+	c.JSON(200, resp)
+}
+
+// loadCatalogAnalytics fills resp, returning a status and message when
+// the request cannot be served.
+func loadCatalogAnalytics(tx *sql.Tx, resp *CatalogAnalytics, neverOrderedLimit int) (int, string) {
+	var from *time.Time
+	if resp.From != nil {
+		from = &resp.From.Time
+	}
+	until := resp.To.AddDate(0, 0, 1)
+	const inRange = "($1::timestamptz IS NULL OR created_at >= $1) AND created_at < $2"
+
+	fail := func(err error) (int, string) {
+		log.Printf("Database error: %v", err)
+		return 500, "Failed to fetch analytics"
+	}
+
+	var first sql.NullTime
+	err := tx.QueryRow("SELECT COUNT(*), MIN(created_at), MAX(refreshed_at) FROM book_analytics WHERE "+inRange, from, until).
+		Scan(&resp.TotalBooks, &first, &resp.RefreshedAt)
+	if err != nil {
+		return fail(err)
+	}
+
+	// Growth, zero-filled from the start of the range (or the first book)
+	// to its end.
+	if resp.TotalBooks > 0 || from != nil {
+		start := first.Time
+		if from != nil {
+			start = *from
+		}
+		var periods []time.Time
+		for p := truncatePeriod(start, resp.Interval); !p.After(resp.To.Time); p = nextPeriod(p, resp.Interval) {
+			if len(periods) == maxGrowthPeriods {
+				return 400, fmt.Sprintf("the range covers more than %d periods; narrow it or use interval=week", maxGrowthPeriods)
+			}
+			periods = append(periods, p)
+		}
+
+		rows, err := tx.Query(`SELECT date_trunc($3, created_at AT TIME ZONE 'UTC')::date, COUNT(*)
+			FROM book_analytics WHERE `+inRange+` GROUP BY 1`, from, until, resp.Interval)
+		if err != nil {
+			return fail(err)
+		}
+		added := map[string]int{}
+		for rows.Next() {
+			var period Date
+			var n int
+			if err := rows.Scan(&period, &n); err != nil {
+				rows.Close()
+				return fail(err)
+			}
+			added[period.String()] = n
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fail(err)
+		}
+		for _, p := range periods {
+			period := Date{p}
+			resp.Growth = append(resp.Growth, GrowthPoint{Period: period, Added: added[period.String()]})
+		}
+	}
+
+	// Books count once under each distinct top-level category they sit in.
+	rows, err := tx.Query(`SELECT g.genre_id, COALESCE(c.name, 'Uncategorized'), COUNT(*)
+		FROM book_analytics a
+		LEFT JOIN LATERAL unnest(a.genre_ids) AS g(genre_id) ON TRUE
+		LEFT JOIN categories c ON c.id = g.genre_id
+		WHERE ($1::timestamptz IS NULL OR a.created_at >= $1) AND a.created_at < $2
+			AND (g.genre_id IS NULL OR c.id IS NOT NULL)
+		GROUP BY g.genre_id, c.name
+		ORDER BY 3 DESC, 2`, from, until)
+	if err != nil {
+		return fail(err)
+	}
+	for rows.Next() {
+		var g GenreCount
+		if err := rows.Scan(&g.CategoryID, &g.Name, &g.Count); err != nil {
+			rows.Close()
+			return fail(err)
+		}
+		resp.ByGenre = append(resp.ByGenre, g)
+	}
+	rows.Close()
+
+	rows, err = tx.Query(`SELECT COALESCE(NULLIF(language, ''), 'unknown'), COUNT(*)
+		FROM book_analytics WHERE `+inRange+`
+		GROUP BY 1 ORDER BY 2 DESC, 1`, from, until)
+	if err != nil {
+		return fail(err)
+	}
+	for rows.Next() {
+		var l LanguageCount
+		if err := rows.Scan(&l.Language, &l.Count); err != nil {
+			rows.Close()
+			return fail(err)
+		}
+		resp.ByLanguage = append(resp.ByLanguage, l)
+	}
+	rows.Close()
+
+	bands := map[string]int{}
+	rows, err = tx.Query("SELECT price_band, COUNT(*) FROM book_analytics WHERE "+inRange+" GROUP BY 1", from, until)
+	if err != nil {
+		return fail(err)
+	}
+	for rows.Next() {
+		var band string
+		var n int
+		if err := rows.Scan(&band, &n); err != nil {
+			rows.Close()
+			return fail(err)
+		}
+		bands[band] = n
+	}
+	rows.Close()
+	for _, band := range priceBands {
+		resp.ByPriceBand = append(resp.ByPriceBand, PriceBandCount{Band: band, Count: bands[band]})
+	}
+
+	err = tx.QueryRow("SELECT COUNT(*) FROM book_analytics WHERE copies_ordered = 0 AND "+inRange, from, until).
+		Scan(&resp.NeverOrdered.Count)
+	if err != nil {
+		return fail(err)
+	}
+	rows, err = tx.Query(`SELECT book_id, title, author, created_at FROM book_analytics
+		WHERE copies_ordered = 0 AND `+inRange+`
+		ORDER BY created_at, book_id LIMIT $3`, from, until, neverOrderedLimit)
+	if err != nil {
+		return fail(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var b NeverOrderedBook
+		if err := rows.Scan(&b.ID, &b.Title, &b.Author, &b.CreatedAt); err != nil {
+			return fail(err)
+		}
+		resp.NeverOrdered.Books = append(resp.NeverOrdered.Books, b)
+	}
+	if err := rows.Err(); err != nil {
+		return fail(err)
+	}
+	return 0, ""
+}
+
+// refreshAnalytics rebuilds book_analytics without blocking readers. It
+// reports false without refreshing when another replica holds the refresh
+// lock.
+func refreshAnalytics() (bool, error) {
+	refreshed := false
+	err := inTx(func(tx *sql.Tx) error {
+		var locked bool
+		if err := tx.QueryRow("SELECT pg_try_advisory_xact_lock(hashtext('book_analytics'))").Scan(&locked); err != nil || !locked {
+			return err
+		}
+		if _, err := tx.Exec("REFRESH MATERIALIZED VIEW CONCURRENTLY book_analytics"); err != nil {
+			return err
+		}
+		refreshed = true
+		return nil
+	})
+	return refreshed, err
+}
+
+// refreshCatalogAnalytics lets admins refresh the view on demand.
+func refreshCatalogAnalytics(c *gin.Context) {
+	refreshed, err := refreshAnalytics()
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to refresh analytics"})
+		return
+	}
+	if !refreshed {
+		c.JSON(409, gin.H{"error": "An analytics refresh is already in progress"})
+		return
+	}
+	c.JSON(200, gin.H{"message": "Analytics refreshed"})
+}
+
+// analyticsRefreshInterval is configured with ANALYTICS_REFRESH_INTERVAL
+// as a Go duration such as "10m".
+func analyticsRefreshInterval() time.Duration {
+	raw := os.Getenv("ANALYTICS_REFRESH_INTERVAL")
+	if raw == "" {
+		return defaultAnalyticsRefreshInterval
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		log.Printf("Invalid ANALYTICS_REFRESH_INTERVAL %q, using %s", raw, defaultAnalyticsRefreshInterval)
+		return defaultAnalyticsRefreshInterval
+	}
+	return d
+}
+
+// startAnalyticsRefresher periodically refreshes book_analytics.
+func startAnalyticsRefresher() {
+	interval := analyticsRefreshInterval()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if _, err := refreshAnalytics(); err != nil {
+				log.Printf("Failed to refresh analytics: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+var errAuthorExists = errors.New("an author with this name or alias already exists")
+
+const (
+	maxBiographyLength = 10000
+	maxAliases         = 50
+)
+
+// contributorRoles are the accepted roles of a book–author link.
+var contributorRoles = map[string]bool{
+	"author":      true,
+	"editor":      true,
+	"translator":  true,
+	"illustrator": true,
+	"narrator":    true,
+}
+
+// Author is a person credited on one or more books. Aliases are alternate
+// spellings or pen names that resolve to the same author.
+type Author struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Biography string    `json:"biography,omitempty"`
+	Aliases   []string  `json:"aliases"`
+	BookCount *int      `json:"book_count,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// AuthorUpdate carries the editable fields of an author; nil fields are
+// left untouched by PATCH.
+type AuthorUpdate struct {
+	Name      *string   `json:"name"`
+	Biography *string   `json:"biography"`
+	Aliases   *[]string `json:"aliases"`
+}
+
+func (u AuthorUpdate) apply(a *Author) {
+	if u.Name != nil {
+		a.Name = *u.Name
+	}
+	if u.Biography != nil {
+		a.Biography = *u.Biography
+	}
+	if u.Aliases != nil {
+		a.Aliases = *u.Aliases
+	}
+}
+
+// BookContributor links a book to an author in a given role.
+type BookContributor struct {
+	AuthorID string `json:"author_id"`
+	Name     string `json:"name,omitempty"`
+	Role     string `json:"role"`
+	Position int    `json:"position"`
+}
+
+const authorColumns = "id, name, biography, aliases, created_at, updated_at"
+
+func scanAuthor(row rowScanner, a *Author, extra ...interface{}) error {
+	dest := []interface{}{&a.ID, &a.Name, &a.Biography, pq.Array(&a.Aliases), &a.CreatedAt, &a.UpdatedAt}
+	return row.Scan(append(dest, extra...)...)
+}
+
+// authorMatchKey normalises a name for identity matching: lower case with
+// everything but letters and digits removed, so "J.K. Rowling" and
+// "J. K. Rowling" share the key "jkrowling".
+func authorMatchKey(name string) string {
+	var sb strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// authorMatchKeys returns the distinct match keys of a's name and aliases.
+func authorMatchKeys(a Author) []string {
+	seen := map[string]bool{}
+	keys := []string{}
+	for _, name := range append([]string{a.Name}, a.Aliases...) {
+		if key := authorMatchKey(name); key != "" && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// validateAuthor trims a's fields and reports rule violations.
+func validateAuthor(a *Author) ValidationErrors {
+	var errs ValidationErrors
+
+	a.Name = strings.TrimSpace(a.Name)
+	a.Biography = strings.TrimSpace(a.Biography)
+	aliases := make([]string, 0, len(a.Aliases))
+	for _, alias := range a.Aliases {
+		if alias = strings.TrimSpace(alias); alias != "" {
+			aliases = append(aliases, alias)
+		}
+	}
+	a.Aliases = aliases
+
+	if a.Name == "" {
+		errs.add("name", "required", "name is required")
+	} else if utf8.RuneCountInString(a.Name) > maxAuthorLength {
+		errs.add("name", "too_long", "name must be at most %d characters", maxAuthorLength)
+	}
+	if utf8.RuneCountInString(a.Biography) > maxBiographyLength {
+		errs.add("biography", "too_long", "biography must be at most %d characters", maxBiographyLength)
+	}
+	if len(a.Aliases) > maxAliases {
+		errs.add("aliases", "too_many", "at most %d aliases are allowed", maxAliases)
+	}
+	for i, alias := range a.Aliases {
+		if utf8.RuneCountInString(alias) > maxAuthorLength {
+			errs.add(fmt.Sprintf("aliases[%d]", i), "too_long", "aliases must be at most %d characters", maxAuthorLength)
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// resolveAuthor returns the ID of the author whose name or alias matches
+// name, creating the author if none does. A transaction-scoped advisory
+// lock on the match key stops concurrent writers from creating duplicates.
+func resolveAuthor(tx *sql.Tx, name string) (string, error) {
+	key := authorMatchKey(name)
+	if key == "" {
+		return "", errors.New("author name has no letters or digits")
+	}
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('author:' || $1))", key); err != nil {
+		return "", err
+	}
+
+	var id string
+	err := tx.QueryRow("SELECT id FROM authors WHERE match_keys @> ARRAY[$1] ORDER BY created_at, id LIMIT 1", key).Scan(&id)
+	if err == nil || err != sql.ErrNoRows {
+		return id, err
+	}
+
+	id = newID()
+	_, err = tx.Exec("INSERT INTO authors (id, name, match_keys) VALUES ($1, $2, $3)",
+		id, strings.TrimSpace(name), pq.Array([]string{key}))
+	return id, err
+}
+
+// claimAuthorKeys takes the advisory locks resolveAuthor uses on each of
+// keys, in sorted order so that writers never deadlock, and returns
+// errAuthorExists when an author other than id already has one of them.
+func claimAuthorKeys(tx *sql.Tx, id string, keys []string) error {
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+	for _, key := range sorted {
+		if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('author:' || $1))", key); err != nil {
+			return err
+		}
+	}
+
+	var exists bool
+	err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM authors WHERE match_keys && $1 AND id <> $2)",
+		pq.Array(keys), id).Scan(&exists)
+	if err == nil && exists {
+		err = errAuthorExists
+	}
+	return err
+}
+
+// syncPrimaryAuthor links bookID to the author named by the free-text
+// author column, replacing any previous "author" role links.
+func syncPrimaryAuthor(tx *sql.Tx, bookID, name string) error {
+	authorID, err := resolveAuthor(tx, name)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM book_authors WHERE book_id = $1 AND role = 'author' AND author_id <> $2", bookID, authorID); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO book_authors (book_id, author_id, role, position) VALUES ($1, $2, 'author', 0)
+		ON CONFLICT (book_id, author_id, role) DO NOTHING`, bookID, authorID)
+	return err
+}
+
+// bookContributors returns the authors credited on a book in display order.
+func bookContributors(conn *sql.DB, bookID string) ([]BookContributor, error) {
+	rows, err := conn.Query(`SELECT ba.author_id, a.name, ba.role, ba.position
+		FROM book_authors ba JOIN authors a ON a.id = ba.author_id
+		WHERE ba.book_id = $1
+		ORDER BY ba.position, ba.role, a.name`, bookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	contributors := []BookContributor{}
+	for rows.Next() {
+		var bc BookContributor
+		if err := rows.Scan(&bc.AuthorID, &bc.Name, &bc.Role, &bc.Position); err != nil {
+			return nil, err
+		}
+		contributors = append(contributors, bc)
+	}
+	return contributors, rows.Err()
+}
+
+func listAuthors(c *gin.Context) {
+	limit, offset := defaultPageSize, 0
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxPageSize {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxPageSize)})
+			return
+		}
+		limit = n
+	}
+	if raw := c.Query("offset"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			c.JSON(400, gin.H{"error": "offset must be a non-negative integer"})
+			return
+		}
+		offset = n
+	}
+
+	args := []interface{}{limit, offset}
+	where := "TRUE"
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		args = append(args, escapeLike(strings.ToLower(q))+"%", authorMatchKey(q))
+		where = "lower(a.name) LIKE $3 OR a.match_keys @> ARRAY[$4]"
+	}
+
+	rows, err := db.Query(`SELECT a.id, a.name, a.biography, a.aliases, a.created_at, a.updated_at,
+			(SELECT COUNT(DISTINCT ba.book_id) FROM book_authors ba JOIN books b ON b.id = ba.book_id
+				WHERE ba.author_id = a.id AND b.deleted_at IS NULL)
+		FROM authors a
+		WHERE `+where+`
+		ORDER BY lower(a.name), a.id
+		LIMIT $1 OFFSET $2`, args...)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to fetch authors"})
+		return
+	}
+	defer rows.Close()
+
+	authors := []Author{}
+	for rows.Next() {
+		var a Author
+		var count int
+		if err := scanAuthor(rows, &a, &count); err != nil {
+			log.Printf("Row scan error: %v", err)
+			continue
+		}
+		a.BookCount = &count
+		authors = append(authors, a)
+	}
+	c.JSON(200, authors)
+}
+
+func getAuthor(c *gin.Context) {
+	var a Author
+	var count int
+	err := scanAuthor(db.QueryRow(`SELECT `+authorColumns+`,
+			(SELECT COUNT(DISTINCT ba.book_id) FROM book_authors ba JOIN books b ON b.id = ba.book_id
+				WHERE ba.author_id = authors.id AND b.deleted_at IS NULL)
+		FROM authors WHERE id = $1`, c.Param("id")), &a, &count)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(404, gin.H{"error": "Author not found"})
+		} else {
+			log.Printf("Database error: %v", err)
+			c.JSON(500, gin.H{"error": "Failed to fetch author"})
+		}
+		return
+	}
+	a.BookCount = &count
+	c.JSON(200, a)
+}
+
+func createAuthor(c *gin.Context) {
+	var a Author
+	if err := c.ShouldBindJSON(&a); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if errs := validateAuthor(&a); errs != nil {
+		respondValidationErrors(c, errs)
+		return
+	}
+
+	a.ID = newID()
+	err := inTx(func(tx *sql.Tx) error {
+		keys := authorMatchKeys(a)
+		if err := claimAuthorKeys(tx, a.ID, keys); err != nil {
+			return err
+		}
+		return tx.QueryRow(`INSERT INTO authors (id, name, biography, aliases, match_keys)
+			VALUES ($1, $2, $3, $4, $5) RETURNING created_at, updated_at`,
+			a.ID, a.Name, a.Biography, pq.Array(a.Aliases), pq.Array(keys)).
+			Scan(&a.CreatedAt, &a.UpdatedAt)
+	})
+	if err == errAuthorExists {
+		c.JSON(409, gin.H{"error": "An author with this name or alias already exists"})
+		return
+	}
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to create author"})
+		return
+	}
+
+	c.Header("Location", "/authors/"+a.ID)
+	c.JSON(201, a)
+}
+
+func replaceAuthor(c *gin.Context) {
+	var u AuthorUpdate
+	if err := c.ShouldBindJSON(&u); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if u.Name == nil {
+		c.JSON(400, gin.H{"error": "PUT requires name; use PATCH for partial updates"})
+		return
+	}
+	updateAuthor(c, func(a *Author) {
+		*a = Author{ID: a.ID, Aliases: []string{}, CreatedAt: a.CreatedAt}
+		u.apply(a)
+	})
+}
+
+func patchAuthor(c *gin.Context) {
+	var u AuthorUpdate
+	if err := c.ShouldBindJSON(&u); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	updateAuthor(c, u.apply)
+}
+
+func updateAuthor(c *gin.Context, mutate func(*Author)) {
+	var a Author
+	err := inTx(func(tx *sql.Tx) error {
+		if err := scanAuthor(tx.QueryRow("SELECT "+authorColumns+" FROM authors WHERE id = $1 FOR UPDATE", c.Param("id")), &a); err != nil {
+			return err
+		}
+		oldName := a.Name
+		mutate(&a)
+		if errs := validateAuthor(&a); errs != nil {
+			return errs
+		}
+		keys := authorMatchKeys(a)
+		if err := claimAuthorKeys(tx, a.ID, keys); err != nil {
+			return err
+		}
+		err := tx.QueryRow(`UPDATE authors SET name = $2, biography = $3, aliases = $4, match_keys = $5, updated_at = now()
+			WHERE id = $1 RETURNING updated_at`,
+			a.ID, a.Name, a.Biography, pq.Array(a.Aliases), pq.Array(keys)).Scan(&a.UpdatedAt)
+		if err != nil || a.Name == oldName {
+			return err
+		}
+		// Rewrite the bylines of the books the author is credited on as
+		// author, as setBookAuthors does, and tell subscribers about every
+		// book that shows the name.
+		_, err = tx.Exec(`UPDATE books b SET author = (
+				SELECT string_agg(au.name, ', ' ORDER BY ba.position)
+				FROM book_authors ba JOIN authors au ON au.id = ba.author_id
+				WHERE ba.book_id = b.id AND ba.role = 'author'
+			), version = version + 1, updated_at = now()
+			WHERE b.id IN (SELECT book_id FROM book_authors WHERE author_id = $1 AND role = 'author')`, a.ID)
+		if err != nil {
+			return err
+		}
+		return enqueueBookEvents(tx, `SELECT DISTINCT ba.book_id FROM book_authors ba JOIN books b ON b.id = ba.book_id
+			WHERE ba.author_id = $1 AND b.deleted_at IS NULL`, a.ID)
+	})
+	if err != nil {
+		var errs ValidationErrors
+		switch {
+		case err == sql.ErrNoRows:
+			c.JSON(404, gin.H{"error": "Author not found"})
+		case err == errAuthorExists:
+			c.JSON(409, gin.H{"error": "An author with this name or alias already exists"})
+		case errors.As(err, &errs):
+			respondValidationErrors(c, errs)
+		default:
+			log.Printf("Database error: %v", err)
+			c.JSON(500, gin.H{"error": "Failed to update author"})
+		}
+		return
+	}
+	c.JSON(200, a)
+}
+
+// deleteAuthor removes an author that is no longer credited on any book.
+func deleteAuthor(c *gin.Context) {
+	res, err := db.Exec("DELETE FROM authors WHERE id = $1", c.Param("id"))
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+			c.JSON(409, gin.H{"error": "Author is still credited on books; unlink them first"})
+			return
+		}
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to delete author"})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(404, gin.H{"error": "Author not found"})
+		return
+	}
+	c.JSON(200, gin.H{"message": "Author deleted successfully"})
+}
+
+func listAuthorBooks(c *gin.Context) {
+	rows, err := db.Query(`SELECT `+prefixColumns("b", bookColumns)+`, ba.role
+		FROM book_authors ba JOIN books b ON b.id = ba.book_id
+		WHERE ba.author_id = $1 AND b.deleted_at IS NULL
+		ORDER BY b.title, b.id`, c.Param("id"))
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to fetch author books"})
+		return
+	}
+	defer rows.Close()
+
+	type authoredBook struct {
+		Book
+		Role string `json:"role"`
+	}
+	books := []authoredBook{}
+	for rows.Next() {
+		var ab authoredBook
+		if err := scanBookWith(rows, &ab.Book, &ab.Role); err != nil {
+			log.Printf("Row scan error: %v", err)
+			continue
+		}
+		books = append(books, ab)
+	}
+	c.JSON(200, books)
+}
+
+func getBookAuthors(c *gin.Context) {
+	id := c.Param("id")
+	exists, err := bookExists(id)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to fetch book authors"})
+		return
+	}
+	if !exists {
+		c.JSON(404, gin.H{"error": "Book not found"})
+		return
+	}
+
+	contributors, err := bookContributors(db, id)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to fetch book authors"})
+		return
+	}
+	c.JSON(200, contributors)
+}
+
+// setBookAuthors replaces every contributor link of a book. The free-text
+// author column is rewritten from the "author" role links so existing
+// clients keep seeing a readable byline.
+func setBookAuthors(c *gin.Context) {
+	id := c.Param("id")
+
+	var links []BookContributor
+	if err := c.ShouldBindJSON(&links); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	var errs ValidationErrors
+	hasAuthor := false
+	for i := range links {
+		if links[i].Role == "" {
+			links[i].Role = "author"
+		}
+		if !contributorRoles[links[i].Role] {
+			errs.add(fmt.Sprintf("[%d].role", i), "invalid", "role must be one of author, editor, translator, illustrator, narrator")
+		}
+		if links[i].AuthorID == "" {
+			errs.add(fmt.Sprintf("[%d].author_id", i), "required", "author_id is required")
+		}
+		hasAuthor = hasAuthor || links[i].Role == "author"
+	}
+	if !hasAuthor {
+		errs.add("role", "required", "at least one contributor must have the author role")
+	}
+	if errs != nil {
+		respondValidationErrors(c, errs)
+		return
+	}
+
+	err := inTx(func(tx *sql.Tx) error {
+		var locked string
+		if err := tx.QueryRow("SELECT id FROM books WHERE id = $1 AND deleted_at IS NULL FOR UPDATE", id).Scan(&locked); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM book_authors WHERE book_id = $1", id); err != nil {
+			return err
+		}
+		for i, link := range links {
+			_, err := tx.Exec(`INSERT INTO book_authors (book_id, author_id, role, position) VALUES ($1, $2, $3, $4)
+				ON CONFLICT (book_id, author_id, role) DO NOTHING`, id, link.AuthorID, link.Role, i)
+			if err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(`UPDATE books SET author = (
+				SELECT string_agg(a.name, ', ' ORDER BY ba.position)
+				FROM book_authors ba JOIN authors a ON a.id = ba.author_id
+				WHERE ba.book_id = $1 AND ba.role = 'author'
+			), version = version + 1, updated_at = now()
+			WHERE id = $1`, id)
+		if err != nil {
+			return err
+		}
+		return enqueueBookEvent(tx, bookUpdatedEvent, id)
+	})
+	if err != nil {
+		var pqErr *pq.Error
+		switch {
+		case err == sql.ErrNoRows:
+			c.JSON(404, gin.H{"error": "Book not found"})
+		case errors.As(err, &pqErr) && pqErr.Code == "23503":
+			respondValidationErrors(c, ValidationErrors{{Field: "author_id", Code: "not_found", Message: "every author_id must refer to an existing author"}})
+		default:
+			log.Printf("Database error: %v", err)
+			c.JSON(500, gin.H{"error": "Failed to update book authors"})
+		}
+		return
+	}
+
+	contributors, err := bookContributors(db, id)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to fetch book authors"})
+		return
+	}
+	c.JSON(200, contributors)
+}
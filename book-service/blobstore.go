@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var errBlobNotFound = errors.New("blob not found")
+
+// BlobStore stores opaque binary objects under slash-separated keys such
+// as "covers/<book id>/small.jpg".
+type BlobStore interface {
+	// Put stores the contents of r under key, replacing any existing blob.
+	Put(key string, r io.Reader) error
+	// Get opens the blob stored under key, or returns errBlobNotFound.
+	Get(key string) (io.ReadCloser, error)
+	// Delete removes the blob stored under key. Deleting a missing blob is
+	// not an error.
+	Delete(key string) error
+}
+
+// newBlobStore returns the store selected by BLOB_STORAGE. Only "local",
+// rooted at BLOB_STORAGE_DIR, is supported today.
+func newBlobStore() (BlobStore, error) {
+	switch kind := os.Getenv("BLOB_STORAGE"); kind {
+	case "", "local":
+		dir := os.Getenv("BLOB_STORAGE_DIR")
+		if dir == "" {
+			dir = "data/blobs"
+		}
+		return newLocalBlobStore(dir)
+	default:
+		return nil, fmt.Errorf("unsupported BLOB_STORAGE %q", kind)
+	}
+}
+
+// localBlobStore keeps blobs as files below a root directory.
+type localBlobStore struct {
+	root string
+}
+
+func newLocalBlobStore(root string) (*localBlobStore, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+	return &localBlobStore{root: root}, nil
+}
+
+func (s *localBlobStore) path(key string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(key))
+	if key == "" || filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(s.root, clean), nil
+}
+
+// Put writes to a temporary file and renames it into place, so readers
+// never see a partially written blob.
+func (s *localBlobStore) Put(key string, r io.Reader) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *localBlobStore) Get(key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errBlobNotFound
+	}
+	return f, err
+}
+
+func (s *localBlobStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
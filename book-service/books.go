@@ -1,9 +1,15 @@
 package main
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/json"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -12,18 +18,129 @@ import (
 	_ "github.com/lib/pq"
 )
 
+// Book is a catalog entry. The metadata fields after Author are optional
+// and omitted from JSON when unset, so clients that only know about
+// id/title/author keep working.
 type Book struct {
-	ID     string `json:"id"`
-	Title  string `json:"title"`
-	Author string `json:"author"`
+	ID              string    `json:"id"`
+	Title           string    `json:"title"`
+	Author          string    `json:"author"`
+	ISBN            string    `json:"isbn,omitempty"`
+	PriceMinor      *int64    `json:"price_minor,omitempty"`
+	Currency        string    `json:"currency,omitempty"`
+	Description     string    `json:"description,omitempty"`
+	Publisher       string    `json:"publisher,omitempty"`
+	PublicationDate *Date     `json:"publication_date,omitempty"`
+	Language        string    `json:"language,omitempty"`
+	PageCount       *int      `json:"page_count,omitempty"`
+	Format          string    `json:"format,omitempty"`
+	Version         int       `json:"version"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+
+	// RatingAverage and RatingCount summarise the book's reviews. They are
+	// maintained by the reviews endpoints and do not change Version.
+	RatingAverage *float64 `json:"rating_average,omitempty"`
+	RatingCount   int      `json:"rating_count"`
+
+	// DeletedAt and DeletedBy are set on books in the trash.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	DeletedBy string     `json:"deleted_by,omitempty"`
+
+	// Contributors, Categories, Prices, Variants and Series are only
+	// populated on single-book reads. Prices are list prices in currencies
+	// other than Currency; Variants are the editions the book is sold as,
+	// if any; Series places the book in the series it belongs to.
+	Contributors []BookContributor `json:"contributors,omitempty"`
+	Categories   []CategoryRef     `json:"categories,omitempty"`
+	Prices       []BookPrice       `json:"prices,omitempty"`
+	Variants     []Variant         `json:"variants,omitempty"`
+	Series       []SeriesRef       `json:"series,omitempty"`
+
+	// DisplayPrice is set when a request asks for prices in a currency.
+	DisplayPrice *DisplayPrice `json:"display_price,omitempty"`
+}
+
+// BookUpdate carries the editable fields of a book. Nil fields are left
+// untouched by PATCH; PUT requires title and author to be present and
+// clears any metadata field that is omitted.
+type BookUpdate struct {
+	Title           *string `json:"title"`
+	Author          *string `json:"author"`
+	ISBN            *string `json:"isbn"`
+	PriceMinor      *int64  `json:"price_minor"`
+	Currency        *string `json:"currency"`
+	Description     *string `json:"description"`
+	Publisher       *string `json:"publisher"`
+	PublicationDate *Date   `json:"publication_date"`
+	Language        *string `json:"language"`
+	PageCount       *int    `json:"page_count"`
+	Format          *string `json:"format"`
+}
+
+// apply copies the fields present in u onto b.
+func (u BookUpdate) apply(b *Book) {
+	setString := func(dst *string, src *string) {
+		if src != nil {
+			*dst = *src
+		}
+	}
+	setString(&b.Title, u.Title)
+	setString(&b.Author, u.Author)
+	setString(&b.ISBN, u.ISBN)
+	setString(&b.Currency, u.Currency)
+	setString(&b.Description, u.Description)
+	setString(&b.Publisher, u.Publisher)
+	setString(&b.Language, u.Language)
+	setString(&b.Format, u.Format)
+	if u.PriceMinor != nil {
+		b.PriceMinor = u.PriceMinor
+	}
+	if u.PublicationDate != nil {
+		b.PublicationDate = u.PublicationDate
+	}
+	if u.PageCount != nil {
+		b.PageCount = u.PageCount
+	}
+}
+
+// replace overwrites every editable field of b with u, clearing the ones
+// u omits.
+func (u BookUpdate) replace(b *Book) {
+	*b = Book{ID: b.ID, Version: b.Version, CreatedAt: b.CreatedAt,
+		RatingAverage: b.RatingAverage, RatingCount: b.RatingCount}
+	u.apply(b)
+}
+
+// bookColumns is the column list matched by scanBook.
+const bookColumns = "id, title, author, isbn, price_minor, currency, description, publisher, publication_date, language, page_count, format, version, created_at, updated_at, rating_average, rating_count, deleted_at, deleted_by"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanBook(row rowScanner, b *Book) error {
+	return scanBookWith(row, b)
+}
+
+// scanBookWith scans bookColumns into b followed by any extra columns
+// selected after them.
+func scanBookWith(row rowScanner, b *Book, extra ...interface{}) error {
+	dest := []interface{}{&b.ID, &b.Title, &b.Author, &b.ISBN, &b.PriceMinor, &b.Currency,
+		&b.Description, &b.Publisher, &b.PublicationDate, &b.Language, &b.PageCount,
+		&b.Format, &b.Version, &b.CreatedAt, &b.UpdatedAt, &b.RatingAverage, &b.RatingCount,
+		&b.DeletedAt, &b.DeletedBy}
+	return row.Scan(append(dest, extra...)...)
 }
 
 type Claims struct {
 	Username string `json:"username"`
+	Role     string `json:"role"`
 	jwt.RegisteredClaims
 }
 
 var db *sql.DB
+var blobs BlobStore
 var jwtKey = []byte(os.Getenv("JWT_SECRET"))
 
 func connectDB() {
@@ -51,6 +168,73 @@ func connectDB() {
 	log.Println("Connected to database")
 }
 
+// bookETag derives the entity tag of a book from its version.
+func bookETag(b Book) string {
+	return fmt.Sprintf("\"%d\"", b.Version)
+}
+
+// parseIfMatch extracts the expected version from an If-Match header,
+// which may hold either a bookETag or the tag of a GET response. It
+// returns ok=false when the header is absent or "*".
+func parseIfMatch(header string) (version int, ok bool, err error) {
+	header = strings.TrimSpace(header)
+	if header == "" || header == "*" {
+		return 0, false, nil
+	}
+	header = strings.TrimPrefix(header, "W/")
+	raw, _, _ := strings.Cut(strings.Trim(header, "\""), "-")
+	version, err = strconv.Atoi(raw)
+	if err != nil {
+		return 0, false, err
+	}
+	return version, true, nil
+}
+
+// respondCacheable writes body as JSON under a strong ETag, etagPrefix
+// followed by a hash of the body, or answers 304 when If-None-Match shows
+// the client's copy is current. headerValues are hashed along with the
+// body since they are part of the response too. No Last-Modified is sent:
+// categories, list prices, ratings, stock, series and deletions from a
+// list all change the body without moving any timestamp, so a date would
+// validate stale copies.
+func respondCacheable(c *gin.Context, body interface{}, etagPrefix string, headerValues ...string) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		log.Printf("Encoding error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to encode response"})
+		return
+	}
+	hash := sha256.New()
+	hash.Write(data)
+	for _, v := range headerValues {
+		hash.Write([]byte{0})
+		hash.Write([]byte(v))
+	}
+	etag := fmt.Sprintf("\"%s%x\"", etagPrefix, hash.Sum(nil)[:8])
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "private, no-cache")
+	if notModified(c, etag, time.Time{}) {
+		c.Status(304)
+		return
+	}
+	c.Data(200, "application/json; charset=utf-8", data)
+}
+
+// notModified evaluates If-None-Match against etag or, when the request
+// has none, If-Modified-Since against lastModified (if not zero).
+func notModified(c *gin.Context, etag string, lastModified time.Time) bool {
+	if inm := c.GetHeader("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			if tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/"); tag == etag || tag == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(c.GetHeader("If-Modified-Since"))
+	return err == nil && !lastModified.IsZero() && !lastModified.After(ims)
+}
+
 func verifyJWT() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		tokenString := c.GetHeader("Authorization")
@@ -80,78 +264,204 @@ func verifyJWT() gin.HandlerFunc {
 		}
 
 		c.Set("username", claims.Username)
+		c.Set("role", claims.Role)
 		c.Next()
 	}
 }
 
-func addBook(c *gin.Context) {
+// BookHandler serves the book endpoints from a BookRepository.
+type BookHandler struct {
+	repo BookRepository
+}
+
+func newBookHandler(repo BookRepository) *BookHandler {
+	return &BookHandler{repo: repo}
+}
+
+func (h *BookHandler) addBook(c *gin.Context) {
 	var b Book
 	if err := c.ShouldBindJSON(&b); err != nil {
 		c.JSON(400, gin.H{"error": "Invalid request body"})
 		return
 	}
+	if errs := validateBook(&b); errs != nil {
+		respondValidationErrors(c, errs)
+		return
+	}
+	if b.ID == "" {
+		b.ID = newID()
+	}
+	// Server-maintained fields are not writable.
+	b.RatingAverage, b.RatingCount = nil, 0
+	b.DeletedAt, b.DeletedBy = nil, ""
 
-	query := "INSERT INTO books (id, title, author) VALUES ($1, $2, $3)"
-	_, err := db.Exec(query, b.ID, b.Title, b.Author)
-	if err != nil {
+	if err := h.repo.Create(&b); err != nil {
+		if msg, ok := conflictMessage(err, b); ok {
+			c.JSON(409, gin.H{"error": msg})
+			return
+		}
 		log.Printf("Database error: %v", err)
 		c.JSON(500, gin.H{"error": "Failed to add book"})
 		return
 	}
 
-	c.JSON(200, b)
+	c.Header("ETag", bookETag(b))
+	c.Header("Location", "/books/"+b.ID)
+	c.JSON(201, b)
 }
 
-func listBooks(c *gin.Context) {
-	query := "SELECT id, title, author FROM books"
-	rows, err := db.Query(query)
+// listBooks returns one keyset-paginated page of the catalog. See
+// parseBookListQuery for the supported query parameters.
+func (h *BookHandler) listBooks(c *gin.Context) {
+	q, err := parseBookListQuery(c)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	h.writeBookPage(c, q)
+}
+
+// writeBookPage runs q and responds with the page's books as a plain JSON
+// array, as GET /books always has. The cursor of the next page and the
+// total travel in the X-Next-Cursor (also as a Link rel="next") and
+// X-Total-Count headers. With envelope=1 the body is the BookPage itself,
+// carrying next_cursor and total, for clients that cannot read headers.
+func (h *BookHandler) writeBookPage(c *gin.Context, q bookListQuery) {
+	page, err := h.repo.List(q)
 	if err != nil {
 		log.Printf("Database error: %v", err)
 		c.JSON(500, gin.H{"error": "Failed to fetch books"})
 		return
 	}
-	defer rows.Close()
+	if !h.localizeBooks(c, page.Items) {
+		return
+	}
+	if page.NextCursor != "" {
+		next := *c.Request.URL
+		params := next.Query()
+		params.Set("cursor", page.NextCursor)
+		next.RawQuery = params.Encode()
+		c.Header("X-Next-Cursor", page.NextCursor)
+		c.Header("Link", fmt.Sprintf("<%s>; rel=\"next\"", next.RequestURI()))
+	}
+	var total string
+	if page.Total != nil {
+		total = strconv.Itoa(*page.Total)
+		c.Header("X-Total-Count", total)
+	}
+	if c.Query("envelope") == "1" {
+		respondCacheable(c, page, "")
+		return
+	}
+	respondCacheable(c, page.Items, "", page.NextCursor, total)
+}
 
-	var books []Book
-	for rows.Next() {
-		var b Book
-		if err := rows.Scan(&b.ID, &b.Title, &b.Author); err != nil {
-			log.Printf("Row scan error: %v", err)
-			continue
+func (h *BookHandler) getBookByID(c *gin.Context) {
+	// Admins can look up books in the trash, e.g. from order history.
+	includeDeleted := c.Query("include_deleted") == "true" && hasPermission(c, permCatalogAdmin)
+	b, err := h.repo.Get(c.Param("id"), includeDeleted)
+	if err == nil {
+		err = h.repo.LoadRelations(&b)
+	}
+	if err != nil {
+		if err == errBookNotFound {
+			c.JSON(404, gin.H{"error": "Book not found"})
+		} else {
+			log.Printf("Database error: %v", err)
+			c.JSON(500, gin.H{"error": "Failed to fetch book"})
 		}
-		books = append(books, b)
+		return
+	}
+	books := []Book{b}
+	if !h.localizeBooks(c, books) {
+		return
+	}
+
+	// The version prefix keeps the ETag usable with If-Match.
+	respondCacheable(c, books[0], fmt.Sprintf("%d-", b.Version))
+}
+
+func (h *BookHandler) replaceBook(c *gin.Context) {
+	var u BookUpdate
+	if err := c.ShouldBindJSON(&u); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
 	}
+	if u.Title == nil || u.Author == nil {
+		c.JSON(400, gin.H{"error": "PUT requires title and author; use PATCH for partial updates"})
+		return
+	}
+	h.updateBook(c, u.replace)
+}
 
-	c.JSON(200, books)
+func (h *BookHandler) patchBook(c *gin.Context) {
+	var u BookUpdate
+	if err := c.ShouldBindJSON(&u); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	h.updateBook(c, u.apply)
 }
 
-func getBookByID(c *gin.Context) {
-	id := c.Param("id")
-	query := "SELECT id, title, author FROM books WHERE id = $1"
-	row := db.QueryRow(query, id)
+// updateBook applies mutate to the book named in the path. The write is
+// conditional on the version read, so a concurrent edit between the read
+// and the write is reported as 412 rather than silently overwritten.
+func (h *BookHandler) updateBook(c *gin.Context, mutate func(*Book)) {
+	expected, hasIfMatch, err := parseIfMatch(c.GetHeader("If-Match"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid If-Match header"})
+		return
+	}
 
-	var b Book
-	if err := row.Scan(&b.ID, &b.Title, &b.Author); err != nil {
-		if err == sql.ErrNoRows {
+	b, err := uncached(h.repo).Get(c.Param("id"), false)
+	if err != nil {
+		if err == errBookNotFound {
 			c.JSON(404, gin.H{"error": "Book not found"})
 		} else {
 			log.Printf("Database error: %v", err)
-			c.JSON(500, gin.H{"error": "Failed to fetch book"})
+			c.JSON(500, gin.H{"error": "Failed to update book"})
 		}
 		return
 	}
 
+	if hasIfMatch && expected != b.Version {
+		c.Header("ETag", bookETag(b))
+		c.JSON(412, gin.H{"error": "Book has been modified by another request", "current_version": b.Version})
+		return
+	}
+
+	mutate(&b)
+	if errs := validateBook(&b); errs != nil {
+		respondValidationErrors(c, errs)
+		return
+	}
+
+	if err := h.repo.Update(&b); err != nil {
+		if err == errBookVersionConflict {
+			c.JSON(412, gin.H{"error": "Book has been modified by another request"})
+		} else if err == errBookNotFound {
+			c.JSON(404, gin.H{"error": "Book not found"})
+		} else if msg, ok := conflictMessage(err, b); ok {
+			c.JSON(409, gin.H{"error": msg})
+		} else {
+			log.Printf("Database error: %v", err)
+			c.JSON(500, gin.H{"error": "Failed to update book"})
+		}
+		return
+	}
+
+	c.Header("ETag", bookETag(b))
 	c.JSON(200, b)
 }
 
-func deleteBook(c *gin.Context) {
-	id := c.Param("id")
-	row := db.QueryRow("DELETE FROM books WHERE id=$1 RETURNING id", id)
-	var deletedID string
-	if err := row.Scan(&deletedID); err != nil {
-		if err == sql.ErrNoRows {
+// deleteBook moves a book to the trash. It stays restorable by admins
+// until the trash purge removes it for good.
+func (h *BookHandler) deleteBook(c *gin.Context) {
+	if err := h.repo.Delete(c.Param("id"), c.GetString("username")); err != nil {
+		if err == errBookNotFound {
 			c.JSON(404, gin.H{"error": "Book not found"})
 		} else {
+			log.Printf("Database error: %v", err)
 			c.JSON(500, gin.H{"error": "Failed to delete book"})
 		}
 		return
@@ -159,66 +469,217 @@ func deleteBook(c *gin.Context) {
 	c.JSON(200, gin.H{"message": "Book deleted successfully"})
 }
 
-func getBookStats(c *gin.Context) {
-	var totalBooks int
-	err := db.QueryRow("SELECT COUNT(*) FROM books").Scan(&totalBooks)
+// AuthorStats counts the books credited to one author.
+type AuthorStats struct {
+	AuthorID string `json:"author_id"`
+	Author   string `json:"author"`
+	Count    int    `json:"count"`
+}
+
+// BookStats is returned by GET /books/stats.
+type BookStats struct {
+	TotalBooks  int           `json:"total_books"`
+	TopAuthors  []AuthorStats `json:"top_authors"`
+	LastUpdated time.Time     `json:"last_updated"`
+}
+
+func (h *BookHandler) getBookStats(c *gin.Context) {
+	stats, err := h.repo.Stats()
 	if err != nil {
+		log.Printf("Database error: %v", err)
 		c.JSON(500, gin.H{"error": "Failed to get book statistics"})
 		return
 	}
+	c.JSON(200, stats)
+}
 
-	// Get books by author count
-	rows, err := db.Query("SELECT author, COUNT(*) as count FROM books GROUP BY author ORDER BY count DESC LIMIT 10")
-	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to get author statistics"})
+func main() {
+	connectDB()
+	defer db.Close()
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrateCommand(os.Args[2:])
 		return
 	}
-	defer rows.Close()
+	runMigrations()
 
-	type AuthorStats struct {
-		Author string `json:"author"`
-		Count  int    `json:"count"`
+	if err := loadPermissions(); err != nil {
+		log.Fatalf("Invalid permissions: %v", err)
 	}
 
-	var authorStats []AuthorStats
-	for rows.Next() {
-		var stat AuthorStats
-		if err := rows.Scan(&stat.Author, &stat.Count); err != nil {
-			continue
-		}
-		authorStats = append(authorStats, stat)
+	var err error
+	if blobs, err = newBlobStore(); err != nil {
+		log.Fatalf("Failed to open blob storage: %v", err)
 	}
-
-	stats := map[string]interface{}{
-		"total_books":  totalBooks,
-		"top_authors":  authorStats,
-		"last_updated": time.Now(),
+	startReservationReaper()
+	startTrashPurge()
+	startAnalyticsRefresher()
+	startOrderEventConsumer()
+	startOutboxRelay()
+
+	var repo BookRepository = newPostgresBookRepository(db)
+	if size, ttl := bookCacheSettings(); size > 0 {
+		cached := newCachedBookRepository(repo, size, ttl)
+		startBookCacheInvalidator(cached)
+		repo = cached
 	}
 
-	c.JSON(200, stats)
+	r := setupRouter(newBookHandler(repo))
+	log.Println("Book Service on :8000")
+	r.Run(":8000")
 }
 
-func main() {
-	connectDB()
-	defer db.Close()
-
+// setupRouter registers every route of the service, serving the book
+// endpoints from h.
+func setupRouter(h *BookHandler) *gin.Engine {
 	r := gin.Default()
 
 	// Protected book routes
 	books := r.Group("/books")
 	books.Use(verifyJWT())
 	{
-		books.POST("/", addBook)
-		books.GET("/", listBooks)
-		books.GET("/:id", getBookByID)
-		books.DELETE("/:id", deleteBook)
-		books.GET("/stats", getBookStats)
+		books.POST("/", requirePermission(permCatalogWrite), h.addBook)
+		books.GET("/", h.listBooks)
+		books.GET("/:id", h.getBookByID)
+		books.PUT("/:id", requirePermission(permCatalogWrite), h.replaceBook)
+		books.PATCH("/:id", requirePermission(permCatalogWrite), h.patchBook)
+		books.DELETE("/:id", requirePermission(permCatalogWrite), h.deleteBook)
+		books.GET("/stats", h.getBookStats)
+		books.GET("/analytics", getCatalogAnalytics)
+		books.POST("/analytics/refresh", requirePermission(permCatalogAdmin), refreshCatalogAnalytics)
+		books.GET("/search", h.searchBooks)
+		books.POST("/import", requirePermission(permCatalogWrite), h.importBooks)
+		books.GET("/export", exportBooks)
+
+		books.GET("/trash", requirePermission(permCatalogAdmin), h.listTrash)
+		books.POST("/:id/restore", requirePermission(permCatalogAdmin), h.restoreBook)
+
+		books.GET("/:id/authors", getBookAuthors)
+		books.PUT("/:id/authors", requirePermission(permCatalogWrite), setBookAuthors)
+
+		books.GET("/:id/categories", getBookCategories)
+		books.PUT("/:id/categories", requirePermission(permCatalogWrite), setBookCategories)
+
+		books.GET("/:id/reviews", listReviews)
+		books.POST("/:id/reviews", createReview)
+		books.PATCH("/:id/reviews/:review_id", updateReview)
+		books.DELETE("/:id/reviews/:review_id", deleteReview)
+
+		books.GET("/:id/prices", getBookPrices)
+		books.PUT("/:id/prices", requirePermission(permCatalogWrite), setBookPrices)
+		books.GET("/:id/price", h.getBookPrice)
+		books.POST("/:id/price/redeem", requirePermission(permPricingRedeem), h.redeemBookPrice)
+		books.DELETE("/:id/price/redemptions/:order_id", requirePermission(permPricingRedeem), releaseRedemptions)
+
+		books.GET("/:id/recommendations", getRecommendations)
+		books.POST("/recommendations/rebuild", requirePermission(permCatalogAdmin), rebuildRecommendations)
+
+		books.POST("/:id/cover", requirePermission(permCatalogWrite), uploadCover)
+		books.DELETE("/:id/cover", requirePermission(permCatalogWrite), deleteCover)
+
+		books.GET("/:id/stock", getStock)
+		books.POST("/:id/stock/reservations", reserveStock)
+		books.GET("/:id/stock/adjustments", requirePermission(permInventoryManage), listStockAdjustments)
+		books.POST("/:id/stock/adjustments", requirePermission(permInventoryManage), adjustStock)
+
+		books.GET("/:id/variants", listVariants)
+		books.POST("/:id/variants", requirePermission(permCatalogWrite), createVariant)
+		books.GET("/:id/variants/:variant_id", getVariant)
+		books.PATCH("/:id/variants/:variant_id", requirePermission(permCatalogWrite), updateVariant)
+		books.DELETE("/:id/variants/:variant_id", requirePermission(permCatalogWrite), deleteVariant)
+		books.GET("/:id/variants/:variant_id/stock", getStock)
+		books.POST("/:id/variants/:variant_id/stock/reservations", reserveStock)
+		books.GET("/:id/variants/:variant_id/stock/adjustments", requirePermission(permInventoryManage), listStockAdjustments)
+		books.POST("/:id/variants/:variant_id/stock/adjustments", requirePermission(permInventoryManage), adjustStock)
+	}
+
+	authors := r.Group("/authors")
+	authors.Use(verifyJWT())
+	{
+		authors.GET("/", listAuthors)
+		authors.POST("/", requirePermission(permCatalogWrite), createAuthor)
+		authors.GET("/:id", getAuthor)
+		authors.PUT("/:id", requirePermission(permCatalogWrite), replaceAuthor)
+		authors.PATCH("/:id", requirePermission(permCatalogWrite), patchAuthor)
+		authors.DELETE("/:id", requirePermission(permCatalogWrite), deleteAuthor)
+		authors.GET("/:id/books", listAuthorBooks)
+	}
+
+	categories := r.Group("/categories")
+	categories.Use(verifyJWT())
+	{
+		categories.GET("/", getCategoryTree)
+		categories.GET("/:id", getCategory)
+		categories.GET("/:id/books", h.listCategoryBooks)
+		categories.POST("/", requirePermission(permCatalogAdmin), createCategory)
+		categories.PATCH("/:id", requirePermission(permCatalogAdmin), updateCategory)
+		categories.POST("/:id/move", requirePermission(permCatalogAdmin), moveCategory)
+		categories.POST("/:id/merge", requirePermission(permCatalogAdmin), mergeCategory)
+		categories.DELETE("/:id", requirePermission(permCatalogAdmin), deleteCategory)
 	}
 
+	promotions := r.Group("/promotions")
+	promotions.Use(verifyJWT(), requirePermission(permPricingManage))
+	{
+		promotions.GET("/", listPromotions)
+		promotions.POST("/", createPromotion)
+		promotions.GET("/:id", getPromotion)
+		promotions.PATCH("/:id", updatePromotion)
+		promotions.DELETE("/:id", deletePromotion)
+	}
+
+	rates := r.Group("/exchange-rates")
+	rates.Use(verifyJWT())
+	{
+		rates.GET("/", listExchangeRates)
+		rates.PUT("/", requirePermission(permPricingManage), putExchangeRate)
+		rates.DELETE("/:base/:quote/:effective_from", requirePermission(permPricingManage), deleteExchangeRate)
+	}
+
+	reservations := r.Group("/reservations")
+	reservations.Use(verifyJWT())
+	{
+		reservations.GET("/:id", getReservation)
+		reservations.POST("/:id/commit", commitReservation)
+		reservations.POST("/:id/release", releaseReservation)
+	}
+
+	series := r.Group("/series")
+	series.Use(verifyJWT())
+	{
+		series.GET("/", listSeries)
+		series.POST("/", requirePermission(permCatalogWrite), createSeries)
+		series.GET("/:id", getSeries)
+		series.PATCH("/:id", requirePermission(permCatalogWrite), updateSeries)
+		series.DELETE("/:id", requirePermission(permCatalogWrite), deleteSeries)
+		series.GET("/:id/next", getNextInSeries)
+		series.PUT("/:id/books/:book_id", requirePermission(permCatalogWrite), setSeriesBook)
+		series.DELETE("/:id/books/:book_id", requirePermission(permCatalogWrite), removeSeriesBook)
+	}
+
+	wishlist := r.Group("/wishlist")
+	wishlist.Use(verifyJWT())
+	{
+		wishlist.GET("/", listWishlists)
+		wishlist.POST("/", createWishlist)
+		wishlist.GET("/:list_id", getWishlist)
+		wishlist.PATCH("/:list_id", renameWishlist)
+		wishlist.DELETE("/:list_id", deleteWishlist)
+		wishlist.POST("/:list_id/items", addWishlistItem)
+		wishlist.DELETE("/:list_id/items/:book_id", removeWishlistItem)
+		wishlist.POST("/:list_id/share", shareWishlist)
+		wishlist.DELETE("/:list_id/share", unshareWishlist)
+	}
+
+	// Covers are public so that browsers can load them in <img> tags.
+	r.GET("/books/:id/cover", getCover)
+	// Shared wishlists are public; the token is the only credential.
+	r.GET("/shared/wishlists/:token", getSharedWishlist)
+
 	r.GET("/health", func(c *gin.Context) {
 		c.JSON(200, gin.H{"status": "ok"})
 	})
+	r.GET("/cache/stats", h.getCacheStats)
 
-	log.Println("Book Service on :8000")
-	r.Run(":8000")
+	return r
 }
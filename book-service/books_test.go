@@ -0,0 +1,935 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	jwtKey = []byte("test-secret")
+	os.Exit(m.Run())
+}
+
+// testServer is a router backed by an in-memory repository.
+type testServer struct {
+	t      *testing.T
+	repo   *memoryBookRepository
+	router *gin.Engine
+}
+
+func newTestServer(t *testing.T) *testServer {
+	repo := newMemoryBookRepository()
+	return &testServer{t: t, repo: repo, router: setupRouter(newBookHandler(repo))}
+}
+
+func testToken(t *testing.T, username, role string) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{Username: username, Role: role})
+	signed, err := token.SignedString(jwtKey)
+	if err != nil {
+		t.Fatalf("sign token: %v", err)
+	}
+	return signed
+}
+
+// request sends a request as a catalog editor unless headers set another
+// Authorization. A string body is sent as is, anything else as JSON.
+func (s *testServer) request(method, path string, body interface{}, headers ...string) *httptest.ResponseRecorder {
+	s.t.Helper()
+	var reader *bytes.Reader
+	if raw, ok := body.(string); ok {
+		reader = bytes.NewReader([]byte(raw))
+	} else if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			s.t.Fatalf("marshal body: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+testToken(s.t, "alice", "catalog-editor"))
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	return w
+}
+
+func (s *testServer) asAdmin() []string {
+	return []string{"Authorization", "Bearer " + testToken(s.t, "root", "admin")}
+}
+
+func (s *testServer) asCustomer() []string {
+	return []string{"Authorization", "Bearer " + testToken(s.t, "bob", "user")}
+}
+
+func (s *testServer) createBook(body map[string]interface{}) Book {
+	s.t.Helper()
+	w := s.request("POST", "/books/", body)
+	if w.Code != 201 {
+		s.t.Fatalf("create book: status %d, body %s", w.Code, w.Body)
+	}
+	return decode[Book](s.t, w)
+}
+
+func decode[T any](t *testing.T, w *httptest.ResponseRecorder) T {
+	t.Helper()
+	var v T
+	if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+		t.Fatalf("decode %s: %v", w.Body, err)
+	}
+	return v
+}
+
+// decodePage reads a GET /books response: the books in the body and the
+// cursor and total in headers.
+func decodePage(t *testing.T, w *httptest.ResponseRecorder) BookPage {
+	t.Helper()
+	page := BookPage{Items: decode[[]Book](t, w), NextCursor: w.Header().Get("X-Next-Cursor")}
+	if raw := w.Header().Get("X-Total-Count"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			t.Fatalf("X-Total-Count = %q", raw)
+		}
+		page.Total = &n
+	}
+	return page
+}
+
+func expectStatus(t *testing.T, w *httptest.ResponseRecorder, want int) {
+	t.Helper()
+	if w.Code != want {
+		t.Fatalf("status = %d, want %d; body %s", w.Code, want, w.Body)
+	}
+}
+
+func TestRequiresToken(t *testing.T) {
+	s := newTestServer(t)
+	req := httptest.NewRequest("GET", "/books/", nil)
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	expectStatus(t, w, http.StatusUnauthorized)
+}
+
+func TestAddBook(t *testing.T) {
+	s := newTestServer(t)
+	w := s.request("POST", "/books/", map[string]interface{}{
+		"title": " Dune ", "author": "Frank Herbert", "isbn": "0-441-17271-7",
+	})
+	expectStatus(t, w, http.StatusCreated)
+
+	b := decode[Book](t, w)
+	if !validBookID.MatchString(b.ID) || len(b.ID) != 26 {
+		t.Errorf("generated id = %q, want a ULID", b.ID)
+	}
+	if b.Title != "Dune" || b.ISBN != "9780441172719" || b.Version != 1 {
+		t.Errorf("book not normalised: %+v", b)
+	}
+	if got := w.Header().Get("Location"); got != "/books/"+b.ID {
+		t.Errorf("Location = %q", got)
+	}
+	if got := w.Header().Get("ETag"); got != `"1"` {
+		t.Errorf("ETag = %q", got)
+	}
+}
+
+func TestAddBookValidation(t *testing.T) {
+	s := newTestServer(t)
+	w := s.request("POST", "/books/", map[string]interface{}{"title": "", "price_minor": -1})
+	expectStatus(t, w, http.StatusUnprocessableEntity)
+
+	resp := decode[struct {
+		Fields []FieldError `json:"fields"`
+	}](t, w)
+	fields := map[string]bool{}
+	for _, fe := range resp.Fields {
+		fields[fe.Field] = true
+	}
+	for _, want := range []string{"title", "author", "price_minor", "currency"} {
+		if !fields[want] {
+			t.Errorf("missing field error for %s in %+v", want, resp.Fields)
+		}
+	}
+}
+
+func TestAddBookConflicts(t *testing.T) {
+	s := newTestServer(t)
+	s.createBook(map[string]interface{}{"id": "dune", "title": "Dune", "author": "Frank Herbert", "isbn": "9780441172719"})
+
+	w := s.request("POST", "/books/", map[string]interface{}{"id": "dune", "title": "Other", "author": "Someone"})
+	expectStatus(t, w, http.StatusConflict)
+
+	w = s.request("POST", "/books/", map[string]interface{}{"title": "Dune", "author": "Frank Herbert", "isbn": "0441172717"})
+	expectStatus(t, w, http.StatusConflict)
+}
+
+func TestGetBook(t *testing.T) {
+	s := newTestServer(t)
+	created := s.createBook(map[string]interface{}{"title": "Emma", "author": "Jane Austen"})
+
+	w := s.request("GET", "/books/"+created.ID, nil)
+	expectStatus(t, w, http.StatusOK)
+	if got := decode[Book](t, w); got.Title != "Emma" {
+		t.Errorf("title = %q", got.Title)
+	}
+	if got := w.Header().Get("ETag"); !strings.HasPrefix(got, `"1-`) {
+		t.Errorf("ETag = %q", got)
+	}
+
+	expectStatus(t, s.request("GET", "/books/missing", nil), http.StatusNotFound)
+}
+
+func TestListBooksPagination(t *testing.T) {
+	s := newTestServer(t)
+	titles := []string{"Echo", "Alpha", "Delta", "Bravo", "Charlie"}
+	for _, title := range titles {
+		s.createBook(map[string]interface{}{"title": title, "author": "Anon"})
+	}
+
+	var got []string
+	path := "/books/?limit=2&include_total=true"
+	for pages := 0; path != ""; pages++ {
+		if pages > len(titles) {
+			t.Fatal("pagination did not terminate")
+		}
+		w := s.request("GET", path, nil)
+		expectStatus(t, w, http.StatusOK)
+		page := decodePage(t, w)
+		if page.Total == nil || *page.Total != len(titles) {
+			t.Errorf("total = %v, want %d", page.Total, len(titles))
+		}
+		for _, b := range page.Items {
+			got = append(got, b.Title)
+		}
+		// The body stays a plain array; the next page is linked.
+		path = ""
+		if page.NextCursor != "" {
+			link := w.Header().Get("Link")
+			if !strings.HasSuffix(link, `>; rel="next"`) || !strings.Contains(link, "cursor="+page.NextCursor) {
+				t.Fatalf("Link = %q", link)
+			}
+			path = strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`)
+		}
+	}
+
+	want := []string{"Alpha", "Bravo", "Charlie", "Delta", "Echo"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("titles = %v, want %v", got, want)
+	}
+
+	// With envelope=1 the cursor and total are in the body as well.
+	got = nil
+	path = "/books/?limit=3&include_total=true&envelope=1"
+	for path != "" {
+		w := s.request("GET", path, nil)
+		expectStatus(t, w, http.StatusOK)
+		page := decode[BookPage](t, w)
+		if page.Total == nil || *page.Total != len(titles) || page.NextCursor != w.Header().Get("X-Next-Cursor") {
+			t.Fatalf("envelope = %s", w.Body)
+		}
+		for _, b := range page.Items {
+			got = append(got, b.Title)
+		}
+		path = ""
+		if page.NextCursor != "" {
+			path = "/books/?limit=3&include_total=true&envelope=1&cursor=" + page.NextCursor
+		}
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("titles with envelope = %v, want %v", got, want)
+	}
+}
+
+func TestListBooksFiltersAndSort(t *testing.T) {
+	s := newTestServer(t)
+	s.createBook(map[string]interface{}{"title": "Persuasion", "author": "Jane Austen", "price_minor": 900, "currency": "GBP"})
+	s.createBook(map[string]interface{}{"title": "Emma", "author": "jane austen", "price_minor": 500, "currency": "GBP"})
+	s.createBook(map[string]interface{}{"title": "Dracula", "author": "Bram Stoker"})
+
+	w := s.request("GET", "/books/?author=JANE%20AUSTEN&sort=-price", nil)
+	expectStatus(t, w, http.StatusOK)
+	page := decodePage(t, w)
+	if len(page.Items) != 2 || page.Items[0].Title != "Persuasion" || page.Items[1].Title != "Emma" {
+		t.Errorf("items = %+v", page.Items)
+	}
+
+	w = s.request("GET", "/books/?title_prefix=dra", nil)
+	page = decodePage(t, w)
+	if len(page.Items) != 1 || page.Items[0].Title != "Dracula" {
+		t.Errorf("items = %+v", page.Items)
+	}
+
+	expectStatus(t, s.request("GET", "/books/?sort=isbn", nil), http.StatusBadRequest)
+	expectStatus(t, s.request("GET", "/books/?sort=-price&cursor=garbage", nil), http.StatusBadRequest)
+}
+
+func TestPatchBook(t *testing.T) {
+	s := newTestServer(t)
+	b := s.createBook(map[string]interface{}{"title": "Emma", "author": "Jane Austen", "page_count": 474})
+
+	w := s.request("PATCH", "/books/"+b.ID, map[string]interface{}{"title": "Emma (Annotated)"}, "If-Match", `"1"`)
+	expectStatus(t, w, http.StatusOK)
+	updated := decode[Book](t, w)
+	if updated.Title != "Emma (Annotated)" || updated.Version != 2 || updated.PageCount == nil || *updated.PageCount != 474 {
+		t.Errorf("updated = %+v", updated)
+	}
+	if got := w.Header().Get("ETag"); got != `"2"` {
+		t.Errorf("ETag = %q", got)
+	}
+
+	w = s.request("PATCH", "/books/"+b.ID, map[string]interface{}{"title": "Stale"}, "If-Match", `"1"`)
+	expectStatus(t, w, http.StatusPreconditionFailed)
+
+	w = s.request("PATCH", "/books/"+b.ID, map[string]interface{}{"language": "klingon"})
+	expectStatus(t, w, http.StatusUnprocessableEntity)
+
+	expectStatus(t, s.request("PATCH", "/books/missing", map[string]interface{}{"title": "x"}), http.StatusNotFound)
+}
+
+func TestReplaceBook(t *testing.T) {
+	s := newTestServer(t)
+	b := s.createBook(map[string]interface{}{"title": "Emma", "author": "Jane Austen", "page_count": 474})
+
+	w := s.request("PUT", "/books/"+b.ID, map[string]interface{}{"title": "Emma"})
+	expectStatus(t, w, http.StatusBadRequest)
+
+	w = s.request("PUT", "/books/"+b.ID, map[string]interface{}{"title": "Emma", "author": "J. Austen"})
+	expectStatus(t, w, http.StatusOK)
+	if got := decode[Book](t, w); got.PageCount != nil || got.Author != "J. Austen" {
+		t.Errorf("PUT did not replace the book: %+v", got)
+	}
+}
+
+func TestDeleteAndRestore(t *testing.T) {
+	s := newTestServer(t)
+	b := s.createBook(map[string]interface{}{"title": "Dune", "author": "Frank Herbert", "isbn": "9780441172719"})
+
+	expectStatus(t, s.request("DELETE", "/books/"+b.ID, nil), http.StatusOK)
+	expectStatus(t, s.request("GET", "/books/"+b.ID, nil), http.StatusNotFound)
+	expectStatus(t, s.request("DELETE", "/books/"+b.ID, nil), http.StatusNotFound)
+	if page := decodePage(t, s.request("GET", "/books/", nil)); len(page.Items) != 0 {
+		t.Errorf("deleted book still listed: %+v", page.Items)
+	}
+
+	expectStatus(t, s.request("GET", "/books/trash", nil), http.StatusForbidden)
+	w := s.request("GET", "/books/trash", nil, s.asAdmin()...)
+	expectStatus(t, w, http.StatusOK)
+	trash := decode[[]Book](t, w)
+	if len(trash) != 1 || trash[0].DeletedBy != "alice" || trash[0].DeletedAt == nil {
+		t.Fatalf("trash = %+v", trash)
+	}
+
+	w = s.request("GET", "/books/"+b.ID+"?include_deleted=true", nil, s.asAdmin()...)
+	expectStatus(t, w, http.StatusOK)
+
+	// The ISBN is free while the book is in the trash, so restoring
+	// conflicts once another book has taken it.
+	other := s.createBook(map[string]interface{}{"title": "Dune (reprint)", "author": "Frank Herbert", "isbn": "9780441172719"})
+	expectStatus(t, s.request("POST", "/books/"+b.ID+"/restore", nil, s.asAdmin()...), http.StatusConflict)
+
+	expectStatus(t, s.request("DELETE", "/books/"+other.ID, nil), http.StatusOK)
+	w = s.request("POST", "/books/"+b.ID+"/restore", nil, s.asAdmin()...)
+	expectStatus(t, w, http.StatusOK)
+	if restored := decode[Book](t, w); restored.DeletedAt != nil || restored.Version != 3 {
+		t.Errorf("restored = %+v", restored)
+	}
+	expectStatus(t, s.request("GET", "/books/"+b.ID, nil), http.StatusOK)
+	expectStatus(t, s.request("POST", "/books/"+b.ID+"/restore", nil, s.asAdmin()...), http.StatusNotFound)
+}
+
+func TestBookStats(t *testing.T) {
+	s := newTestServer(t)
+	s.createBook(map[string]interface{}{"title": "Emma", "author": "Jane Austen"})
+	s.createBook(map[string]interface{}{"title": "Persuasion", "author": "Jane  Austen"})
+	s.createBook(map[string]interface{}{"title": "Dracula", "author": "Bram Stoker"})
+
+	w := s.request("GET", "/books/stats", nil)
+	expectStatus(t, w, http.StatusOK)
+	stats := decode[BookStats](t, w)
+	if stats.TotalBooks != 3 {
+		t.Errorf("total = %d", stats.TotalBooks)
+	}
+	if len(stats.TopAuthors) != 2 || stats.TopAuthors[0].Count != 2 {
+		t.Errorf("top authors = %+v", stats.TopAuthors)
+	}
+}
+
+func TestSearchBooks(t *testing.T) {
+	s := newTestServer(t)
+	s.createBook(map[string]interface{}{"title": "The Lord of the Rings", "author": "J. R. R. Tolkien"})
+	s.createBook(map[string]interface{}{"title": "The Hobbit", "author": "J. R. R. Tolkien"})
+
+	w := s.request("GET", "/books/search?q=lord%20ring", nil)
+	expectStatus(t, w, http.StatusOK)
+	resp := decode[SearchResponse](t, w)
+	if len(resp.Results) != 1 || resp.Results[0].Book.Title != "The Lord of the Rings" {
+		t.Errorf("results = %+v", resp.Results)
+	}
+
+	expectStatus(t, s.request("GET", "/books/search", nil), http.StatusBadRequest)
+	expectStatus(t, s.request("GET", "/books/search?q=x&limit=0", nil), http.StatusBadRequest)
+}
+
+func TestWriteRoutesRequirePermission(t *testing.T) {
+	s := newTestServer(t)
+	b := s.createBook(map[string]interface{}{"title": "Dune", "author": "Frank Herbert"})
+
+	for _, tc := range []struct{ method, path string }{
+		{"POST", "/books/"},
+		{"PUT", "/books/" + b.ID},
+		{"PATCH", "/books/" + b.ID},
+		{"DELETE", "/books/" + b.ID},
+		{"POST", "/authors/"},
+	} {
+		w := s.request(tc.method, tc.path, map[string]interface{}{"title": "Dune Messiah", "name": "Someone"}, s.asCustomer()...)
+		expectStatus(t, w, http.StatusForbidden)
+		if body := decode[map[string]interface{}](t, w); body["permission"] != permCatalogWrite {
+			t.Errorf("%s %s: body = %v", tc.method, tc.path, body)
+		}
+	}
+
+	// Reads stay open to every signed-in user.
+	expectStatus(t, s.request("GET", "/books/"+b.ID, nil, s.asCustomer()...), http.StatusOK)
+	expectStatus(t, s.request("GET", "/books/", nil, s.asCustomer()...), http.StatusOK)
+
+	// Editors may write the catalog but not manage the trash.
+	expectStatus(t, s.request("PATCH", "/books/"+b.ID, map[string]interface{}{"title": "Dune (2nd ed.)"}), http.StatusOK)
+	expectStatus(t, s.request("GET", "/books/trash", nil), http.StatusForbidden)
+	expectStatus(t, s.request("POST", "/books/import?format=jsonl&restore=true", nil), http.StatusForbidden)
+	expectStatus(t, s.request("PATCH", "/books/"+b.ID, map[string]interface{}{"title": "Dune"}, s.asAdmin()...), http.StatusOK)
+
+	// Only the order service records and releases promotion redemptions.
+	for _, headers := range [][]string{s.asCustomer(), nil} {
+		w := s.request("POST", "/books/"+b.ID+"/price/redeem", map[string]interface{}{"order_id": "o1"}, headers...)
+		expectStatus(t, w, http.StatusForbidden)
+		w = s.request("DELETE", "/books/"+b.ID+"/price/redemptions/o1", nil, headers...)
+		if expectStatus(t, w, http.StatusForbidden); decode[map[string]interface{}](t, w)["permission"] != permPricingRedeem {
+			t.Errorf("releasing redemptions: body = %s", w.Body)
+		}
+	}
+	if !permissions.allows("order-service", permPricingRedeem) {
+		t.Error("the order service role cannot redeem promotions")
+	}
+}
+
+func TestConfiguredPermissions(t *testing.T) {
+	defer func(p rolePermissions) { permissions = p }(permissions)
+	os.Setenv("BOOK_ROLE_PERMISSIONS", "admin=*; user=catalog:write")
+	defer os.Unsetenv("BOOK_ROLE_PERMISSIONS")
+	if err := loadPermissions(); err != nil {
+		t.Fatalf("loadPermissions: %v", err)
+	}
+
+	s := newTestServer(t)
+	w := s.request("POST", "/books/", map[string]interface{}{"title": "Dune", "author": "Frank Herbert"}, s.asCustomer()...)
+	expectStatus(t, w, http.StatusCreated)
+	expectStatus(t, s.request("POST", "/books/", map[string]interface{}{"title": "Emma", "author": "Jane Austen"}), http.StatusForbidden)
+
+	for _, spec := range []string{"admin", "admin=catalog:everything", "=catalog:write"} {
+		if _, err := parseRolePermissions(spec); err == nil {
+			t.Errorf("parseRolePermissions(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestBooksInRequestedCurrency(t *testing.T) {
+	s := newTestServer(t)
+	b := s.createBook(map[string]interface{}{"title": "Dune", "author": "Frank Herbert", "price_minor": 1299, "currency": "GBP"})
+	s.createBook(map[string]interface{}{"title": "Emma", "author": "Jane Austen"})
+
+	w := s.request("GET", "/books/"+b.ID+"?currency=gbp", nil)
+	expectStatus(t, w, http.StatusOK)
+	got := decode[Book](t, w)
+	if got.DisplayPrice == nil || got.DisplayPrice.PriceMinor != 1299 || got.DisplayPrice.Source != "list" {
+		t.Errorf("display_price = %+v", got.DisplayPrice)
+	}
+	if got.PriceMinor == nil || *got.PriceMinor != 1299 || got.Currency != "GBP" {
+		t.Errorf("base price changed: %+v", got)
+	}
+
+	// Without exchange rates there is nothing to convert with.
+	w = s.request("GET", "/books/", nil, "Accept-Currency", "EUR, GBP;q=0.5")
+	expectStatus(t, w, http.StatusOK)
+	for _, item := range decodePage(t, w).Items {
+		if item.DisplayPrice != nil {
+			t.Errorf("%s: display_price = %+v", item.Title, item.DisplayPrice)
+		}
+	}
+	if vary := w.Header().Get("Vary"); vary != "Accept-Currency" {
+		t.Errorf("Vary = %q", vary)
+	}
+
+	expectStatus(t, s.request("GET", "/books/?currency=euro", nil), http.StatusBadRequest)
+}
+
+func TestConditionalGet(t *testing.T) {
+	s := newTestServer(t)
+	b := s.createBook(map[string]interface{}{"title": "Emma", "author": "Jane Austen"})
+
+	w := s.request("GET", "/books/"+b.ID, nil)
+	expectStatus(t, w, http.StatusOK)
+	etag := w.Header().Get("ETag")
+	if w.Header().Get("Last-Modified") != "" {
+		t.Error("Last-Modified sent, though it misses changes to a book's relations")
+	}
+
+	w = s.request("GET", "/books/"+b.ID, nil, "If-None-Match", etag)
+	expectStatus(t, w, http.StatusNotModified)
+	if w.Body.Len() != 0 {
+		t.Errorf("304 body = %s", w.Body)
+	}
+	// Only the ETag revalidates.
+	expectStatus(t, s.request("GET", "/books/"+b.ID, nil, "If-Modified-Since", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)),
+		http.StatusOK)
+
+	// The ETag of a read doubles as an If-Match precondition.
+	w = s.request("PATCH", "/books/"+b.ID, map[string]interface{}{"title": "Emma (Annotated)"}, "If-Match", etag)
+	expectStatus(t, w, http.StatusOK)
+	w = s.request("GET", "/books/"+b.ID, nil, "If-None-Match", etag)
+	expectStatus(t, w, http.StatusOK)
+	if w.Header().Get("ETag") == etag {
+		t.Error("ETag did not change after an update")
+	}
+
+	w = s.request("GET", "/books/", nil)
+	expectStatus(t, w, http.StatusOK)
+	listETag := w.Header().Get("ETag")
+	expectStatus(t, s.request("GET", "/books/", nil, "If-None-Match", listETag), http.StatusNotModified)
+	expectStatus(t, s.request("DELETE", "/books/"+b.ID, nil), http.StatusOK)
+	expectStatus(t, s.request("GET", "/books/", nil, "If-None-Match", listETag), http.StatusOK)
+}
+
+func TestBookCache(t *testing.T) {
+	repo := newMemoryBookRepository()
+	cached := newCachedBookRepository(repo, 10, time.Minute)
+	s := &testServer{t: t, repo: repo, router: setupRouter(newBookHandler(cached))}
+	b := s.createBook(map[string]interface{}{"title": "Emma", "author": "Jane Austen"})
+
+	for i := 0; i < 3; i++ {
+		expectStatus(t, s.request("GET", "/books/"+b.ID, nil), http.StatusOK)
+		expectStatus(t, s.request("GET", "/books/", nil), http.StatusOK)
+	}
+	// The first read of the book and of the list misses; each of those
+	// loads the book and its relations.
+	if got := cached.cache.stats(); got.Hits != 6 || got.Misses != 3 || got.Entries != 3 {
+		t.Errorf("stats after reads = %+v", got)
+	}
+
+	// Changes made behind the cache's back are not seen...
+	stale := b
+	stale.Title = "Changed directly"
+	repo.books[b.ID] = stale
+	if got := decode[Book](t, s.request("GET", "/books/"+b.ID, nil)); got.Title != "Emma" {
+		t.Errorf("cached title = %q", got.Title)
+	}
+	// ...but writes through the handlers invalidate the book and lists.
+	expectStatus(t, s.request("PATCH", "/books/"+b.ID, map[string]interface{}{"title": "Emma (Annotated)"}), http.StatusOK)
+	if got := decode[Book](t, s.request("GET", "/books/"+b.ID, nil)); got.Title != "Emma (Annotated)" {
+		t.Errorf("title after update = %q", got.Title)
+	}
+	page := decodePage(t, s.request("GET", "/books/", nil))
+	if len(page.Items) != 1 || page.Items[0].Title != "Emma (Annotated)" {
+		t.Errorf("list after update = %+v", page.Items)
+	}
+	expectStatus(t, s.request("DELETE", "/books/"+b.ID, nil), http.StatusOK)
+	expectStatus(t, s.request("GET", "/books/"+b.ID, nil), http.StatusNotFound)
+	if page := decodePage(t, s.request("GET", "/books/", nil)); len(page.Items) != 0 {
+		t.Errorf("list after delete = %+v", page.Items)
+	}
+
+	w := s.request("GET", "/cache/stats", nil)
+	expectStatus(t, w, http.StatusOK)
+	if got := decode[CacheStats](t, w); !got.Enabled || got.Capacity != 10 || got.Hits == 0 {
+		t.Errorf("GET /cache/stats = %+v", got)
+	}
+}
+
+func TestLRUCacheEvictionAndExpiry(t *testing.T) {
+	now := time.Now()
+	c := newLRUCache(2, time.Minute)
+	c.now = func() time.Time { return now }
+
+	c.setIfCurrent("a", 1, c.currentGeneration())
+	c.setIfCurrent("b", 2, c.currentGeneration())
+	c.get("a")
+	c.setIfCurrent("c", 3, c.currentGeneration())
+	if _, ok := c.get("b"); ok {
+		t.Error("least recently used entry was not evicted")
+	}
+	if _, ok := c.get("a"); !ok {
+		t.Error("recently used entry was evicted")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, ok := c.get("a"); ok {
+		t.Error("expired entry was served")
+	}
+
+	// A value loaded before an invalidation is not stored.
+	generation := c.currentGeneration()
+	c.removeIf(func(key string) bool { return key == "c" })
+	c.setIfCurrent("d", 4, generation)
+	if _, ok := c.get("d"); ok {
+		t.Error("value loaded before an invalidation was cached")
+	}
+}
+
+// TestImportPartialCSV imports CSV files holding some of the columns: rows
+// only overwrite the columns they supply and are validated as merged with
+// the stored book.
+func TestImportPartialCSV(t *testing.T) {
+	s := newTestServer(t)
+	dune := s.createBook(map[string]interface{}{"title": "Dune", "author": "Frank Herbert", "isbn": "9780441013593",
+		"price_minor": 1299, "currency": "USD", "language": "en", "page_count": 412})
+	trashed := s.createBook(map[string]interface{}{"title": "Emma", "author": "Jane Austen"})
+	expectStatus(t, s.request("DELETE", "/books/"+trashed.ID, nil), 200)
+
+	importCSV := func(csv string, headers ...string) ImportReport {
+		t.Helper()
+		w := s.request("POST", "/books/import?format=csv", csv, append([]string{"Content-Type", "text/csv"}, headers...)...)
+		expectStatus(t, w, 200)
+		return decode[ImportReport](t, w)
+	}
+	status := func(r ImportReport) string {
+		var statuses []string
+		for _, row := range r.Rows {
+			statuses = append(statuses, row.Status)
+		}
+		return strings.Join(statuses, ",")
+	}
+
+	r := importCSV("id,price_minor\n" + dune.ID + ",1499\nnew-book,999\n" + trashed.ID + ",500\n")
+	if got := status(r); got != "updated,invalid,error" {
+		t.Fatalf("statuses = %s, want updated,invalid,error; report %+v", got, r)
+	}
+	if errs := strings.Join(r.Rows[1].Errors, "; "); !strings.Contains(errs, "title is required") ||
+		!strings.Contains(errs, "currency is required") {
+		t.Errorf("new book without title or currency: errors %q", errs)
+	}
+	got := decode[Book](t, s.request("GET", "/books/"+dune.ID, nil))
+	if got.PriceMinor == nil || *got.PriceMinor != 1499 || got.Title != "Dune" || got.ISBN != dune.ISBN ||
+		got.Currency != "USD" || got.PageCount == nil || *got.PageCount != 412 || got.Version != dune.Version+1 {
+		t.Errorf("after partial import = %+v", got)
+	}
+
+	// Clearing a column the stored book needs is caught against the merge.
+	r = importCSV("id,currency\n" + dune.ID + ",\n")
+	if status(r) != "invalid" || !strings.Contains(strings.Join(r.Rows[0].Errors, ";"), "currency is required") {
+		t.Errorf("clearing the currency of a priced book: %+v", r)
+	}
+
+	// A dry run reports without writing.
+	importCSV("id,title\n" + dune.ID + ",Dune Messiah\n")
+	if w := s.request("POST", "/books/import?format=csv&dry_run=true", "id,title\n"+dune.ID+",Children of Dune\n",
+		"Content-Type", "text/csv"); w.Code != 200 || decode[ImportReport](t, w).Updated != 1 {
+		t.Fatalf("dry run: status %d, body %s", w.Code, w.Body)
+	}
+	if got := decode[Book](t, s.request("GET", "/books/"+dune.ID, nil)); got.Title != "Dune Messiah" {
+		t.Errorf("title after dry run = %q, want Dune Messiah", got.Title)
+	}
+
+	// Books in the trash are only touched, and restored, with restore=true.
+	w := s.request("POST", "/books/import?format=csv&restore=true", "id,title\n"+trashed.ID+",Emma (Annotated)\n",
+		append([]string{"Content-Type", "text/csv"}, s.asAdmin()...)...)
+	expectStatus(t, w, 200)
+	if got := decode[Book](t, s.request("GET", "/books/"+trashed.ID, nil)); got.Title != "Emma (Annotated)" || got.Author != "Jane Austen" {
+		t.Errorf("restored by import = %+v", got)
+	}
+}
+
+// TestImportKeepsCoAuthors re-imports an exported co-authored book: its
+// "A, B" byline must not replace the links to both authors.
+func TestImportKeepsCoAuthors(t *testing.T) {
+	s := newTestServer(t)
+	b := s.createBook(map[string]interface{}{"title": "Good Omens", "author": "Neil Gaiman, Terry Pratchett"})
+	s.repo.contributors[b.ID] = []BookContributor{
+		{AuthorID: "neilgaiman", Name: "Neil Gaiman", Role: "author"},
+		{AuthorID: "terrypratchett", Name: "Terry Pratchett", Role: "author", Position: 1},
+	}
+	authors := func() string {
+		var names []string
+		for _, bc := range decode[Book](t, s.request("GET", "/books/"+b.ID, nil)).Contributors {
+			names = append(names, bc.Name)
+		}
+		return strings.Join(names, ", ")
+	}
+
+	var export strings.Builder
+	cw := csv.NewWriter(&export)
+	cw.Write(bookCSVColumns)
+	cw.Write(bookToCSV(b))
+	cw.Flush()
+	w := s.request("POST", "/books/import?format=csv", export.String(), "Content-Type", "text/csv")
+	if expectStatus(t, w, 200); decode[ImportReport](t, w).Updated != 1 {
+		t.Fatalf("re-import: %s", w.Body)
+	}
+	if got := authors(); got != "Neil Gaiman, Terry Pratchett" {
+		t.Errorf("authors after re-import = %q, want both", got)
+	}
+
+	// A new author does replace the links.
+	w = s.request("POST", "/books/import?format=csv", "id,author\n"+b.ID+",Terry Pratchett\n", "Content-Type", "text/csv")
+	expectStatus(t, w, 200)
+	if got := authors(); got != "Terry Pratchett" {
+		t.Errorf("authors after changing the author = %q, want Terry Pratchett", got)
+	}
+}
+
+func TestBestPrice(t *testing.T) {
+	pct := func(id string, value int64, stacking string) Promotion {
+		return Promotion{ID: id, Kind: "percentage", Value: value, Stacking: stacking}
+	}
+	fixed := func(id string, value int64, currency, stacking string) Promotion {
+		return Promotion{ID: id, Kind: "fixed", Value: value, Currency: currency, Stacking: stacking}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		price   int64
+		promos  []Promotion
+		want    int64
+		applied []string
+	}{
+		{"no promotions", 1000, nil, 1000, nil},
+		{"percentage", 1000, []Promotion{pct("p", 10, "exclusive")}, 900, []string{"p"}},
+		{"percentage rounds half up", 1010, []Promotion{pct("p", 15, "exclusive")}, 858, []string{"p"}},
+		{"percentage rounds down below half", 1001, []Promotion{pct("p", 10, "exclusive")}, 901, []string{"p"}},
+		{"fixed", 1000, []Promotion{fixed("f", 300, "GBP", "exclusive")}, 700, []string{"f"}},
+		{"fixed in another currency", 1000, []Promotion{fixed("f", 300, "USD", "exclusive")}, 1000, nil},
+		{"fixed never goes below zero", 300, []Promotion{fixed("f", 500, "GBP", "exclusive")}, 0, []string{"f"}},
+		{"stacked percentage before fixed", 1000,
+			[]Promotion{fixed("f", 100, "GBP", "stackable"), pct("p", 10, "stackable")}, 800, []string{"p", "f"}},
+		{"stack skips a fixed amount in another currency", 1000,
+			[]Promotion{fixed("f", 100, "USD", "stackable"), pct("p", 10, "stackable")}, 900, []string{"p"}},
+		{"exclusive beats a weaker stack", 1000,
+			[]Promotion{pct("p", 10, "stackable"), fixed("f", 100, "GBP", "stackable"), pct("x", 25, "exclusive")},
+			750, []string{"x"}},
+		{"stack beats a weaker exclusive", 1000,
+			[]Promotion{pct("x", 5, "exclusive"), pct("p", 10, "stackable"), fixed("f", 100, "GBP", "stackable")},
+			800, []string{"p", "f"}},
+		{"exclusives never combine", 1000,
+			[]Promotion{pct("x", 10, "exclusive"), fixed("y", 200, "GBP", "exclusive")}, 800, []string{"y"}},
+		{"ties go to the first combination", 1000,
+			[]Promotion{pct("x", 10, "exclusive"), fixed("y", 100, "GBP", "exclusive")}, 900, []string{"x"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, applied := bestPrice(tc.price, "GBP", tc.promos)
+			var ids []string
+			var discount int64
+			for _, a := range applied {
+				ids = append(ids, a.PromotionID)
+				discount += a.DiscountMinor
+			}
+			if got != tc.want || fmt.Sprint(ids) != fmt.Sprint(tc.applied) {
+				t.Errorf("bestPrice = %d %v, want %d %v", got, ids, tc.want, tc.applied)
+			}
+			if discount != tc.price-got {
+				t.Errorf("applied discounts add up to %d, want %d", discount, tc.price-got)
+			}
+		})
+	}
+}
+
+func TestPromoCodeStatus(t *testing.T) {
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	limit := func(n int) *int { return &n }
+	code := func(mutate func(*promotionCandidate)) *promotionCandidate {
+		p := &promotionCandidate{Promotion: Promotion{ID: "code", Kind: "percentage", Value: 10, Code: "SAVE10",
+			Stacking: "exclusive", StartsAt: past, Active: true}}
+		if mutate != nil {
+			mutate(p)
+		}
+		return p
+	}
+	quote := PriceQuote{Currency: "GBP", ListPriceMinor: 1000}
+	applied := quote
+	applied.AppliedPromotions = []AppliedPromotion{{PromotionID: "code"}}
+
+	for _, tc := range []struct {
+		name   string
+		quote  PriceQuote
+		promo  *promotionCandidate
+		exists bool
+		want   string
+	}{
+		{"unknown code", quote, nil, false, "invalid"},
+		{"code for other books", quote, nil, true, "not_applicable"},
+		{"deactivated", quote, code(func(p *promotionCandidate) { p.Active = false }), false, "inactive"},
+		{"not started", quote, code(func(p *promotionCandidate) { p.StartsAt = future }), false, "inactive"},
+		{"ended", quote, code(func(p *promotionCandidate) { p.EndsAt = &past }), false, "inactive"},
+		{"global limit reached", quote, code(func(p *promotionCandidate) {
+			p.MaxRedemptions, p.Redemptions = limit(5), 5
+		}), false, "exhausted"},
+		{"per-user limit reached", quote, code(func(p *promotionCandidate) {
+			p.PerUserLimit, p.userRedemptions = limit(1), 1
+		}), false, "exhausted"},
+		{"fixed amount in another currency", quote, code(func(p *promotionCandidate) {
+			p.Kind, p.Value, p.Currency = "fixed", 200, "USD"
+		}), false, "not_applicable"},
+		{"applied", applied, code(nil), false, "applied"},
+		{"beaten by a better deal", quote, code(nil), false, "not_combinable"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := promoCodeStatus(tc.quote, tc.promo, tc.exists, now); got != tc.want {
+				t.Errorf("promoCodeStatus = %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	// Under their limits, promotions still apply.
+	p := code(func(p *promotionCandidate) {
+		p.MaxRedemptions, p.Redemptions, p.PerUserLimit, p.userRedemptions = limit(5), 4, limit(2), 1
+	})
+	if p.exhausted() {
+		t.Error("promotion under its limits reported exhausted")
+	}
+}
+
+func TestConvertMinor(t *testing.T) {
+	rat := func(s string) *big.Rat {
+		r, _ := new(big.Rat).SetString(s)
+		return r
+	}
+
+	for _, tc := range []struct {
+		name     string
+		amount   int64
+		from, to string
+		rate     string
+		want     int64
+	}{
+		{"same exponent", 1000, "GBP", "EUR", "1.17", 1170},
+		{"GBP to JPY", 1234, "GBP", "JPY", "187.5", 2314},
+		{"JPY to GBP", 2314, "JPY", "GBP", "0.005333", 1234},
+		{"GBP to BHD", 1000, "GBP", "BHD", "0.4765", 4765},
+		{"BHD to JPY", 4765, "BHD", "JPY", "393.5", 1875},
+		{"half rounds up", 5, "GBP", "EUR", "0.5", 3},
+		{"half rounds away from zero", -5, "GBP", "EUR", "0.5", -3},
+		{"below half rounds down", 1000, "GBP", "JPY", "0.049", 0},
+		{"half of a yen rounds up", 1000, "GBP", "JPY", "0.05", 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := convertMinor(tc.amount, tc.from, tc.to, rat(tc.rate))
+			if err != nil || got != tc.want {
+				t.Errorf("convertMinor(%d %s->%s @ %s) = %d, %v, want %d", tc.amount, tc.from, tc.to, tc.rate, got, err, tc.want)
+			}
+		})
+	}
+
+	// Results beyond int64 are errors rather than wrapping around.
+	for _, tc := range []struct {
+		amount   int64
+		from, to string
+		rate     string
+	}{
+		{math.MaxInt64, "GBP", "EUR", "2"},
+		{math.MinInt64, "GBP", "EUR", "2"},
+		{math.MaxInt64 / 100, "JPY", "BHD", "1"},
+		{1000, "GBP", "EUR", "100000000000000000000"},
+	} {
+		if got, err := convertMinor(tc.amount, tc.from, tc.to, rat(tc.rate)); err != errConversionOverflow {
+			t.Errorf("convertMinor(%d %s->%s @ %s) = %d, %v, want overflow", tc.amount, tc.from, tc.to, tc.rate, got, err)
+		}
+	}
+	price := int64(math.MaxInt64)
+	rates := map[string]currencyRate{"GBP": {rate: rat("3")}}
+	if _, err := displayPrice(Book{ID: "b1", PriceMinor: &price, Currency: "GBP"}, "EUR", nil, rates); !errors.Is(err, errConversionOverflow) {
+		t.Errorf("displayPrice of an out-of-range conversion: err = %v", err)
+	}
+}
+
+func TestAddExchangeRate(t *testing.T) {
+	day := func(d int) Date { return Date{time.Date(2026, 6, d, 0, 0, 0, 0, time.UTC)} }
+	rates := map[string]currencyRate{}
+
+	// Rows for converting into GBP: a direct USD/GBP rate, then a newer
+	// GBP/USD rate that is inverted, then an older GBP/EUR rate.
+	addExchangeRate(rates, "GBP", "USD", "GBP", big.NewRat(4, 5), day(1))
+	addExchangeRate(rates, "GBP", "GBP", "USD", big.NewRat(5, 4), day(2))
+	addExchangeRate(rates, "GBP", "EUR", "GBP", big.NewRat(17, 20), day(3))
+	addExchangeRate(rates, "GBP", "GBP", "EUR", big.NewRat(6, 5), day(1))
+
+	if r := rates["USD"]; formatRate(r.rate) != "0.8" || !r.effectiveFrom.Equal(day(2).Time) {
+		t.Errorf("USD rate = %s from %s, want the inverted 0.8 from %s", formatRate(r.rate), r.effectiveFrom, day(2))
+	}
+	if r := rates["EUR"]; formatRate(r.rate) != "0.85" || !r.effectiveFrom.Equal(day(3).Time) {
+		t.Errorf("EUR rate = %s from %s, want the direct 0.85 from %s", formatRate(r.rate), r.effectiveFrom, day(3))
+	}
+	if len(rates) != 2 {
+		t.Errorf("rates = %v, want USD and EUR only", rates)
+	}
+}
+
+func TestPromotionUpdateClearsFields(t *testing.T) {
+	limit := func(n int) *int { return &n }
+	ends := time.Date(2026, 7, 1, 0, 0, 0, 0, time.UTC)
+	p := Promotion{Name: "Summer", Code: "SUMMER", MaxRedemptions: limit(100), PerUserLimit: limit(1), EndsAt: &ends}
+
+	var u PromotionUpdate
+	if err := json.Unmarshal([]byte(`{"code": null, "max_redemptions": null, "ends_at": null}`), &u); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	u.apply(&p)
+	if p.Code != "" || p.MaxRedemptions != nil || p.EndsAt != nil {
+		t.Errorf("null fields not cleared: %+v", p)
+	}
+	if p.Name != "Summer" || p.PerUserLimit == nil || *p.PerUserLimit != 1 {
+		t.Errorf("missing fields changed: %+v", p)
+	}
+
+	u = PromotionUpdate{}
+	if err := json.Unmarshal([]byte(`{"per_user_limit": 3, "ends_at": "2026-08-01T00:00:00Z"}`), &u); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	u.apply(&p)
+	if p.PerUserLimit == nil || *p.PerUserLimit != 3 || p.EndsAt == nil || p.EndsAt.Month() != time.August {
+		t.Errorf("set fields not applied: %+v", p)
+	}
+}
+
+func TestReservationLimits(t *testing.T) {
+	for _, tc := range []struct {
+		active, held, quantity int
+		ok                     bool
+	}{
+		{0, 0, 1, true},
+		{0, 0, maxCustomerReservedCopies, true},
+		{0, 0, maxCustomerReservedCopies + 1, false},
+		{maxCustomerReservations - 1, 4, 1, true},
+		{maxCustomerReservations, 5, 1, false},
+		{2, maxCustomerReservedCopies - 1, 2, false},
+	} {
+		if err := checkReservationLimit(tc.active, tc.held, tc.quantity); (err == nil) != tc.ok {
+			t.Errorf("checkReservationLimit(%d, %d, %d) = %v, want ok %v", tc.active, tc.held, tc.quantity, err, tc.ok)
+		}
+	}
+
+	// Customers cannot hold copies for longer than the default TTL.
+	s := newTestServer(t)
+	w := s.request("POST", "/books/b1/stock/reservations", map[string]interface{}{"quantity": 1, "ttl_seconds": 3600},
+		s.asCustomer()...)
+	if expectStatus(t, w, http.StatusBadRequest); !strings.Contains(w.Body.String(), "between 60 and 900") {
+		t.Errorf("customer TTL error = %s", w.Body)
+	}
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	importBatchSize = 500
+	maxImportBytes  = 100 << 20
+	maxJSONLineSize = 1 << 20
+
+	exportFlushEvery = 500
+)
+
+// bookCSVColumns is the header used by CSV export and accepted by CSV
+// import. Import only requires the columns it is given, in any order, and
+// leaves the other columns of existing books untouched; rows are
+// validated as they would be stored. The JSON Lines format uses the same
+// names as keys.
+var bookCSVColumns = []string{
+	"id", "title", "author", "isbn", "price_minor", "currency", "description",
+	"publisher", "publication_date", "language", "page_count", "format",
+}
+
+// ImportRowResult reports what happened to one input row. Row numbers are
+// 1-based and count data rows, not the CSV header.
+type ImportRowResult struct {
+	Row    int      `json:"row"`
+	ID     string   `json:"id,omitempty"`
+	Status string   `json:"status"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+// ImportReport summarises a bulk import.
+type ImportReport struct {
+	DryRun  bool              `json:"dry_run"`
+	Restore bool              `json:"restore"`
+	Total   int               `json:"total"`
+	Created int               `json:"created"`
+	Updated int               `json:"updated"`
+	Invalid int               `json:"invalid"`
+	Failed  int               `json:"failed"`
+	Rows    []ImportRowResult `json:"rows"`
+}
+
+func (r *ImportReport) add(res ImportRowResult) {
+	r.Total++
+	switch res.Status {
+	case "created":
+		r.Created++
+	case "updated":
+		r.Updated++
+	case "invalid":
+		r.Invalid++
+	default:
+		r.Failed++
+	}
+	r.Rows = append(r.Rows, res)
+}
+
+// importRow is a parsed input row awaiting the database. columns lists
+// the bookCSVColumns the input supplied for it.
+type importRow struct {
+	num     int
+	book    Book
+	columns []string
+}
+
+var errImportTrashed = errors.New("book is in the trash; restore it first or import with restore=true")
+
+// merge returns the book the row describes: stored, if the book exists,
+// with the columns the row supplies copied over it.
+func (row importRow) merge(stored *Book) Book {
+	if stored == nil {
+		return row.book
+	}
+	b, in := *stored, row.book
+	for _, col := range row.columns {
+		switch col {
+		case "title":
+			b.Title = in.Title
+		case "author":
+			b.Author = in.Author
+		case "isbn":
+			b.ISBN = in.ISBN
+		case "price_minor":
+			b.PriceMinor = in.PriceMinor
+		case "currency":
+			b.Currency = in.Currency
+		case "description":
+			b.Description = in.Description
+		case "publisher":
+			b.Publisher = in.Publisher
+		case "publication_date":
+			b.PublicationDate = in.PublicationDate
+		case "language":
+			b.Language = in.Language
+		case "page_count":
+			b.PageCount = in.PageCount
+		case "format":
+			b.Format = in.Format
+		}
+	}
+	return b
+}
+
+// importBook resolves row against the stored book, if any, into the book
+// to write. It returns errImportTrashed for a book in the trash unless
+// restore is set, and the validation errors of the merged book.
+func importBook(row importRow, stored *Book, restore bool) (Book, ValidationErrors, error) {
+	if stored != nil && stored.DeletedAt != nil && !restore {
+		return Book{}, nil, errImportTrashed
+	}
+	b := row.merge(stored)
+	return b, validateBook(&b), nil
+}
+
+// importResult reports the outcome of writing one import row: err is the
+// write error, if any, and errs the validation errors of the row.
+func importResult(row importRow, inserted bool, errs ValidationErrors, err error) ImportRowResult {
+	res := ImportRowResult{Row: row.num, ID: row.book.ID}
+	switch {
+	case err != nil:
+		res.Status = "error"
+		if msg, ok := conflictMessage(err, row.book); ok {
+			res.Errors = []string{msg}
+		} else {
+			res.Errors = []string{err.Error()}
+		}
+	case errs != nil:
+		res.Status, res.Errors = "invalid", errs.messages()
+	case inserted:
+		res.Status = "created"
+	default:
+		res.Status = "updated"
+	}
+	return res
+}
+
+// catalogFormat picks csv or jsonl from the format query parameter, falling
+// back to the request Content-Type.
+func catalogFormat(c *gin.Context) (string, error) {
+	switch f := c.Query("format"); f {
+	case "csv", "jsonl":
+		return f, nil
+	case "":
+	default:
+		return "", fmt.Errorf("unsupported format %q, expected csv or jsonl", f)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	switch mediaType {
+	case "text/csv":
+		return "csv", nil
+	case "application/x-ndjson", "application/jsonl", "application/x-jsonlines":
+		return "jsonl", nil
+	}
+	if c.Request.Method == http.MethodGet {
+		return "jsonl", nil
+	}
+	return "", fmt.Errorf("cannot determine import format; pass ?format=csv or ?format=jsonl")
+}
+
+// importBooks upserts books streamed as CSV or JSON Lines through the
+// repository; rows without an id are created with a generated one. Rows naming a book in the trash are
+// reported as errors unless restore=true, which like POST
+// /books/:id/restore needs catalog:admin. Rows are written in batches of
+// importBatchSize; see BookRepository.Import. With dry_run=true nothing
+// is written.
+func (h *BookHandler) importBooks(c *gin.Context) {
+	format, err := catalogFormat(c)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	report := &ImportReport{DryRun: c.Query("dry_run") == "true", Restore: c.Query("restore") == "true",
+		Rows: []ImportRowResult{}}
+	if report.Restore && !hasPermission(c, permCatalogAdmin) {
+		c.JSON(403, gin.H{
+			"error":      fmt.Sprintf("Your role does not have the %s permission required to restore books", permCatalogAdmin),
+			"permission": permCatalogAdmin,
+		})
+		return
+	}
+
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, maxImportBytes)
+	batch := make([]importRow, 0, importBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		results, err := h.repo.Import(batch, report.Restore, report.DryRun)
+		if err != nil {
+			return err
+		}
+		for _, res := range results {
+			report.add(res)
+		}
+		batch = batch[:0]
+		return nil
+	}
+	emit := func(num int, b Book, columns, parseErrs []string) error {
+		if len(parseErrs) > 0 {
+			report.add(ImportRowResult{Row: num, ID: b.ID, Status: "invalid", Errors: parseErrs})
+			return nil
+		}
+		if b.ID == "" {
+			b.ID = newID()
+		}
+		batch = append(batch, importRow{num: num, book: b, columns: columns})
+		if len(batch) == importBatchSize {
+			return flush()
+		}
+		return nil
+	}
+
+	if format == "csv" {
+		err = readCSVBooks(body, emit)
+	} else {
+		err = readJSONLBooks(body, emit)
+	}
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		if _, ok := err.(importInputError); ok {
+			c.JSON(400, gin.H{"error": err.Error(), "report": report})
+			return
+		}
+		log.Printf("Import error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to import books", "report": report})
+		return
+	}
+
+	c.JSON(200, report)
+}
+
+// importInputError marks errors in the uploaded stream itself, as opposed
+// to per-row problems, which end up in the report.
+type importInputError struct{ error }
+
+func readCSVBooks(r io.Reader, emit func(int, Book, []string, []string) error) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return importInputError{fmt.Errorf("reading CSV header: %w", err)}
+	}
+	index := map[string]int{}
+	known := map[string]bool{}
+	for _, col := range bookCSVColumns {
+		known[col] = true
+	}
+	var columns []string
+	for i, col := range header {
+		col = strings.TrimSpace(strings.ToLower(col))
+		if !known[col] {
+			return importInputError{fmt.Errorf("unknown CSV column %q", col)}
+		}
+		if _, dup := index[col]; !dup {
+			columns = append(columns, col)
+		}
+		index[col] = i
+	}
+
+	for num := 1; ; num++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if _, ok := err.(*csv.ParseError); !ok {
+				return importInputError{err}
+			}
+			if err := emit(num, Book{}, columns, []string{err.Error()}); err != nil {
+				return err
+			}
+			continue
+		}
+		field := func(col string) string {
+			if i, ok := index[col]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		b, errs := bookFromCSV(field)
+		if err := emit(num, b, columns, errs); err != nil {
+			return err
+		}
+	}
+}
+
+func bookFromCSV(field func(string) string) (Book, []string) {
+	var errs []string
+	b := Book{
+		ID:          field("id"),
+		Title:       field("title"),
+		Author:      field("author"),
+		ISBN:        field("isbn"),
+		Currency:    field("currency"),
+		Description: field("description"),
+		Publisher:   field("publisher"),
+		Language:    field("language"),
+		Format:      field("format"),
+	}
+	if v := field("price_minor"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			errs = append(errs, "price_minor must be an integer")
+		} else {
+			b.PriceMinor = &n
+		}
+	}
+	if v := field("page_count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			errs = append(errs, "page_count must be an integer")
+		} else {
+			b.PageCount = &n
+		}
+	}
+	if v := field("publication_date"); v != "" {
+		var d Date
+		if err := d.UnmarshalJSON([]byte(strconv.Quote(v))); err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			b.PublicationDate = &d
+		}
+	}
+	return b, errs
+}
+
+func readJSONLBooks(r io.Reader, emit func(int, Book, []string, []string) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), maxJSONLineSize)
+
+	num := 0
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		num++
+		var b Book
+		var fields map[string]json.RawMessage
+		var columns, errs []string
+		if err := json.Unmarshal([]byte(line), &b); err != nil {
+			errs = append(errs, "invalid JSON: "+err.Error())
+		} else if err := json.Unmarshal([]byte(line), &fields); err == nil {
+			for _, col := range bookCSVColumns {
+				if _, ok := fields[col]; ok {
+					columns = append(columns, col)
+				}
+			}
+		}
+		if err := emit(num, b, columns, errs); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return importInputError{err}
+	}
+	return nil
+}
+
+// exportBooks streams the whole catalog ordered by id as CSV or JSON Lines.
+func exportBooks(c *gin.Context) {
+	format, err := catalogFormat(c)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	rows, err := db.Query("SELECT " + bookColumns + " FROM books WHERE deleted_at IS NULL ORDER BY id")
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to export books"})
+		return
+	}
+	defer rows.Close()
+
+	var write func(Book) error
+	var flush func()
+	if format == "csv" {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Header("Content-Disposition", `attachment; filename="books.csv"`)
+		cw := csv.NewWriter(c.Writer)
+		cw.Write(bookCSVColumns)
+		write = func(b Book) error { return cw.Write(bookToCSV(b)) }
+		flush = func() { cw.Flush(); c.Writer.Flush() }
+	} else {
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Header("Content-Disposition", `attachment; filename="books.jsonl"`)
+		enc := json.NewEncoder(c.Writer)
+		write = func(b Book) error { return enc.Encode(b) }
+		flush = c.Writer.Flush
+	}
+	c.Status(200)
+
+	n := 0
+	for rows.Next() {
+		var b Book
+		if err := scanBook(rows, &b); err != nil {
+			log.Printf("Row scan error: %v", err)
+			continue
+		}
+		if err := write(b); err != nil {
+			log.Printf("Export aborted: %v", err)
+			return
+		}
+		if n++; n%exportFlushEvery == 0 {
+			flush()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Export aborted: %v", err)
+	}
+	flush()
+}
+
+func bookToCSV(b Book) []string {
+	var price, pages, published string
+	if b.PriceMinor != nil {
+		price = strconv.FormatInt(*b.PriceMinor, 10)
+	}
+	if b.PageCount != nil {
+		pages = strconv.Itoa(*b.PageCount)
+	}
+	if b.PublicationDate != nil {
+		published = b.PublicationDate.String()
+	}
+	return []string{b.ID, b.Title, b.Author, b.ISBN, price, b.Currency, b.Description,
+		b.Publisher, published, b.Language, pages, b.Format}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/streadway/amqp"
+)
+
+const (
+	defaultBookCacheSize = 1000
+	defaultBookCacheTTL  = 30 * time.Second
+)
+
+// bookCacheSettings reads BOOK_CACHE_SIZE, the number of entries kept (0
+// disables the cache), and BOOK_CACHE_TTL, a Go duration such as "30s".
+func bookCacheSettings() (size int, ttl time.Duration) {
+	size, ttl = defaultBookCacheSize, defaultBookCacheTTL
+	if raw := os.Getenv("BOOK_CACHE_SIZE"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			log.Printf("Invalid BOOK_CACHE_SIZE %q, using %d", raw, defaultBookCacheSize)
+		} else {
+			size = n
+		}
+	}
+	if raw := os.Getenv("BOOK_CACHE_TTL"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			log.Printf("Invalid BOOK_CACHE_TTL %q, using %s", raw, defaultBookCacheTTL)
+		} else {
+			ttl = d
+		}
+	}
+	return size, ttl
+}
+
+// CacheStats is returned by GET /cache/stats.
+type CacheStats struct {
+	Enabled    bool    `json:"enabled"`
+	Hits       int64   `json:"hits"`
+	Misses     int64   `json:"misses"`
+	HitRatio   float64 `json:"hit_ratio"`
+	Entries    int     `json:"entries"`
+	Capacity   int     `json:"capacity"`
+	TTLSeconds float64 `json:"ttl_seconds"`
+}
+
+// lruCache is a size-bounded map that evicts the least recently used
+// entry when full and treats entries older than ttl as missing.
+//
+// Every removal bumps a generation number. A reader that takes the
+// generation before loading a value and stores it with setIfCurrent
+// cannot put back data that was invalidated while it was loading.
+type lruCache struct {
+	mu         sync.Mutex
+	capacity   int
+	ttl        time.Duration
+	now        func() time.Time
+	entries    map[string]*list.Element
+	order      *list.List // most recently used at the front
+	generation uint64
+	hits       int64
+	misses     int64
+}
+
+type lruEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+func newLRUCache(capacity int, ttl time.Duration) *lruCache {
+	return &lruCache{capacity: capacity, ttl: ttl, now: time.Now,
+		entries: map[string]*list.Element{}, order: list.New()}
+}
+
+// get returns the live entry for key, counting a hit or a miss.
+func (c *lruCache) get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*lruEntry)
+		if c.now().Before(e.expires) {
+			c.order.MoveToFront(el)
+			c.hits++
+			return e.value, true
+		}
+		c.order.Remove(el)
+		delete(c.entries, key)
+	}
+	c.misses++
+	return nil, false
+}
+
+// currentGeneration is taken before loading a value to cache.
+func (c *lruCache) currentGeneration() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// setIfCurrent stores value under key unless something was removed from
+// the cache since generation was taken.
+func (c *lruCache) setIfCurrent(key string, value interface{}, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	e := &lruEntry{key: key, value: value, expires: c.now().Add(c.ttl)}
+	if el, ok := c.entries[key]; ok {
+		el.Value = e
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(e)
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+// removeIf drops every entry whose key satisfies match.
+func (c *lruCache) removeIf(match func(key string) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for key, el := range c.entries {
+		if match(key) {
+			c.order.Remove(el)
+			delete(c.entries, key)
+		}
+	}
+}
+
+func (c *lruCache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := CacheStats{Enabled: true, Hits: c.hits, Misses: c.misses, Entries: c.order.Len(),
+		Capacity: c.capacity, TTLSeconds: c.ttl.Seconds()}
+	if total := c.hits + c.misses; total > 0 {
+		s.HitRatio = float64(c.hits) / float64(total)
+	}
+	return s
+}
+
+// bookRelations is what LoadRelations adds to a book.
+type bookRelations struct {
+	contributors []BookContributor
+	categories   []CategoryRef
+	prices       []BookPrice
+	variants     []Variant
+	series       []SeriesRef
+}
+
+// cachedBookRepository serves Get, LoadRelations and List of another
+// repository from an LRU cache. Writes made through it drop the affected
+// entries, and any change to a book drops every cached list. Changes made
+// elsewhere - bulk imports, author, category, price, variant and series
+// edits, other replicas - arrive as book events (see
+// startBookCacheInvalidator); ratings and stock levels are refreshed when
+// entries expire.
+type cachedBookRepository struct {
+	BookRepository
+	cache *lruCache
+}
+
+func newCachedBookRepository(repo BookRepository, size int, ttl time.Duration) *cachedBookRepository {
+	return &cachedBookRepository{BookRepository: repo, cache: newLRUCache(size, ttl)}
+}
+
+func bookCacheKey(id string, includeDeleted bool) string {
+	if includeDeleted {
+		return "book:" + id + ":deleted"
+	}
+	return "book:" + id
+}
+
+// invalidate drops the entries of book id and every cached list.
+func (r *cachedBookRepository) invalidate(id string) {
+	r.cache.removeIf(func(key string) bool {
+		return key == bookCacheKey(id, false) || key == bookCacheKey(id, true) ||
+			key == "relations:"+id || strings.HasPrefix(key, "page:")
+	})
+}
+
+// invalidateAll empties the cache.
+func (r *cachedBookRepository) invalidateAll() {
+	r.cache.removeIf(func(string) bool { return true })
+}
+
+func (r *cachedBookRepository) Create(b *Book) error {
+	if err := r.BookRepository.Create(b); err != nil {
+		return err
+	}
+	r.invalidate(b.ID)
+	return nil
+}
+
+func (r *cachedBookRepository) Get(id string, includeDeleted bool) (Book, error) {
+	key := bookCacheKey(id, includeDeleted)
+	if v, ok := r.cache.get(key); ok {
+		return cloneBook(v.(Book)), nil
+	}
+	generation := r.cache.currentGeneration()
+	b, err := r.BookRepository.Get(id, includeDeleted)
+	if err != nil {
+		return b, err
+	}
+	r.cache.setIfCurrent(key, cloneBook(b), generation)
+	return b, nil
+}
+
+// LoadRelations shares the cached slices with b; callers must not modify
+// them.
+func (r *cachedBookRepository) LoadRelations(b *Book) error {
+	key := "relations:" + b.ID
+	if v, ok := r.cache.get(key); ok {
+		rel := v.(bookRelations)
+		b.Contributors, b.Categories, b.Prices, b.Variants, b.Series = rel.contributors, rel.categories, rel.prices, rel.variants, rel.series
+		return nil
+	}
+	generation := r.cache.currentGeneration()
+	if err := r.BookRepository.LoadRelations(b); err != nil {
+		return err
+	}
+	r.cache.setIfCurrent(key, bookRelations{b.Contributors, b.Categories, b.Prices, b.Variants, b.Series}, generation)
+	return nil
+}
+
+func (r *cachedBookRepository) List(q bookListQuery) (BookPage, error) {
+	data, err := json.Marshal(q)
+	if err != nil {
+		return BookPage{}, err
+	}
+	key := "page:" + string(data)
+	if v, ok := r.cache.get(key); ok {
+		return cloneBookPage(v.(BookPage)), nil
+	}
+	generation := r.cache.currentGeneration()
+	page, err := r.BookRepository.List(q)
+	if err != nil {
+		return page, err
+	}
+	r.cache.setIfCurrent(key, cloneBookPage(page), generation)
+	return page, nil
+}
+
+// Update drops the book's entries even when it fails, since a version
+// conflict means the cached copy is out of date.
+func (r *cachedBookRepository) Update(b *Book) error {
+	err := r.BookRepository.Update(b)
+	r.invalidate(b.ID)
+	return err
+}
+
+func (r *cachedBookRepository) Delete(id, deletedBy string) error {
+	err := r.BookRepository.Delete(id, deletedBy)
+	r.invalidate(id)
+	return err
+}
+
+func (r *cachedBookRepository) Restore(id string) (Book, error) {
+	b, err := r.BookRepository.Restore(id)
+	r.invalidate(id)
+	return b, err
+}
+
+func (r *cachedBookRepository) Import(rows []importRow, restore, dryRun bool) ([]ImportRowResult, error) {
+	results, err := r.BookRepository.Import(rows, restore, dryRun)
+	if !dryRun {
+		for _, row := range rows {
+			r.invalidate(row.book.ID)
+		}
+	}
+	return results, err
+}
+
+// uncached returns the repository behind any cache, for reads that a
+// write depends on.
+func uncached(repo BookRepository) BookRepository {
+	if r, ok := repo.(*cachedBookRepository); ok {
+		return r.BookRepository
+	}
+	return repo
+}
+
+// cloneBookPage copies a page so that the cached one cannot be modified
+// through the returned items.
+func cloneBookPage(page BookPage) BookPage {
+	items := make([]Book, len(page.Items))
+	for i, b := range page.Items {
+		items[i] = cloneBook(b)
+	}
+	page.Items = items
+	if page.Total != nil {
+		total := *page.Total
+		page.Total = &total
+	}
+	return page
+}
+
+// consumeBookEventsForCache drops the cache entries of every book named in
+// a book event. Each replica reads from its own exclusive queue, and the
+// whole cache is dropped on (re)connecting since events may have been
+// missed while disconnected.
+func consumeBookEventsForCache(r *cachedBookRepository) error {
+	conn, err := amqp.Dial(rabbitMQURL())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	if err := ch.ExchangeDeclare(bookEventsExchange, "topic", true, false, false, false, nil); err != nil {
+		return err
+	}
+	q, err := ch.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		return err
+	}
+	if err := ch.QueueBind(q.Name, "book.*", bookEventsExchange, false, nil); err != nil {
+		return err
+	}
+	msgs, err := ch.Consume(q.Name, "", true, true, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	r.invalidateAll()
+	log.Printf("Invalidating the book cache from %s", bookEventsExchange)
+	for d := range msgs {
+		var e BookEvent
+		if err := json.Unmarshal(d.Body, &e); err != nil || e.BookID == "" {
+			log.Printf("Ignoring book event %s: %v", d.Body, err)
+			continue
+		}
+		r.invalidate(e.BookID)
+	}
+	return errors.New("book events channel closed")
+}
+
+// startBookCacheInvalidator keeps the cache's book events subscription
+// running, reconnecting whenever it drops.
+func startBookCacheInvalidator(r *cachedBookRepository) {
+	go func() {
+		for {
+			if err := consumeBookEventsForCache(r); err != nil {
+				log.Printf("Book cache invalidator stopped: %v", err)
+			}
+			time.Sleep(brokerRetryDelay)
+		}
+	}()
+}
+
+// getCacheStats reports the book cache's hit and miss counters for
+// monitoring.
+func (h *BookHandler) getCacheStats(c *gin.Context) {
+	if r, ok := h.repo.(*cachedBookRepository); ok {
+		c.JSON(200, r.cache.stats())
+		return
+	}
+	c.JSON(200, CacheStats{})
+}
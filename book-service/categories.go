@@ -0,0 +1,611 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+const maxCategoryNameLength = 100
+
+var (
+	validSlug    = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+	slugReplacer = regexp.MustCompile(`[^a-z0-9]+`)
+
+	errCategoryCycle    = errors.New("a category cannot be moved or merged into its own subtree")
+	errCategoryNotEmpty = errors.New("category still has subcategories or books")
+)
+
+// Category is a node of the genre taxonomy. BookCount counts the distinct
+// books assigned to the node or any of its descendants.
+type Category struct {
+	ID        string      `json:"id"`
+	ParentID  *string     `json:"parent_id"`
+	Name      string      `json:"name"`
+	Slug      string      `json:"slug"`
+	Position  int         `json:"position"`
+	BookCount int         `json:"book_count"`
+	Path      []string    `json:"path,omitempty"`
+	Children  []*Category `json:"children"`
+	CreatedAt time.Time   `json:"created_at"`
+	UpdatedAt time.Time   `json:"updated_at"`
+}
+
+// CategoryRef identifies a category a book is assigned to, with the names
+// from the root down, e.g. ["Fiction", "Fantasy", "Epic"].
+type CategoryRef struct {
+	ID   string   `json:"id"`
+	Name string   `json:"name"`
+	Path []string `json:"path"`
+}
+
+type CategoryInput struct {
+	Name     *string `json:"name"`
+	Slug     *string `json:"slug"`
+	ParentID *string `json:"parent_id"`
+	Position *int    `json:"position"`
+}
+
+// categorySubtree returns a subquery selecting the category bound to param
+// and all of its descendants.
+func categorySubtree(param string) string {
+	return fmt.Sprintf(`WITH RECURSIVE subtree AS (
+			SELECT id FROM categories WHERE id = %s
+			UNION ALL
+			SELECT c.id FROM categories c JOIN subtree s ON c.parent_id = s.id
+		) SELECT id FROM subtree`, param)
+}
+
+// categoryCountsQuery selects every category with its subtree book count.
+const categoryCountsQuery = `WITH RECURSIVE tree AS (
+		SELECT id AS root, id FROM categories
+		UNION ALL
+		SELECT t.root, c.id FROM categories c JOIN tree t ON c.parent_id = t.id
+	), counts AS (
+		SELECT t.root, COUNT(DISTINCT b.id) AS n
+		FROM tree t
+		LEFT JOIN book_categories bc ON bc.category_id = t.id
+		LEFT JOIN books b ON b.id = bc.book_id AND b.deleted_at IS NULL
+		GROUP BY t.root
+	)
+	SELECT c.id, c.parent_id, c.name, c.slug, c.position, c.created_at, c.updated_at, COALESCE(counts.n, 0)
+	FROM categories c LEFT JOIN counts ON counts.root = c.id`
+
+func scanCategory(row rowScanner, cat *Category) error {
+	return row.Scan(&cat.ID, &cat.ParentID, &cat.Name, &cat.Slug, &cat.Position,
+		&cat.CreatedAt, &cat.UpdatedAt, &cat.BookCount)
+}
+
+func slugify(name string) string {
+	return strings.Trim(slugReplacer.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+func sortCategories(cats []*Category) {
+	sort.Slice(cats, func(i, j int) bool {
+		if cats[i].Position != cats[j].Position {
+			return cats[i].Position < cats[j].Position
+		}
+		return cats[i].Name < cats[j].Name
+	})
+}
+
+// getCategoryTree returns the whole taxonomy as nested roots.
+func getCategoryTree(c *gin.Context) {
+	rows, err := db.Query(categoryCountsQuery)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to fetch categories"})
+		return
+	}
+	defer rows.Close()
+
+	byID := map[string]*Category{}
+	var all []*Category
+	for rows.Next() {
+		cat := &Category{Children: []*Category{}}
+		if err := scanCategory(rows, cat); err != nil {
+			log.Printf("Row scan error: %v", err)
+			continue
+		}
+		byID[cat.ID] = cat
+		all = append(all, cat)
+	}
+
+	roots := []*Category{}
+	for _, cat := range all {
+		if cat.ParentID == nil {
+			roots = append(roots, cat)
+		} else if parent, ok := byID[*cat.ParentID]; ok {
+			parent.Children = append(parent.Children, cat)
+		}
+	}
+	for _, cat := range all {
+		sortCategories(cat.Children)
+	}
+	sortCategories(roots)
+
+	c.JSON(200, roots)
+}
+
+// loadCategory returns a category with its path and direct children.
+func loadCategory(id string) (*Category, error) {
+	cat := &Category{Children: []*Category{}}
+	if err := scanCategory(db.QueryRow(categoryCountsQuery+" WHERE c.id = $1", id), cat); err != nil {
+		return nil, err
+	}
+
+	err := db.QueryRow(`WITH RECURSIVE ancestry AS (
+			SELECT id, parent_id, name, 0 AS depth FROM categories WHERE id = $1
+			UNION ALL
+			SELECT p.id, p.parent_id, p.name, a.depth + 1 FROM categories p JOIN ancestry a ON p.id = a.parent_id
+		) SELECT array_agg(name ORDER BY depth DESC) FROM ancestry`, id).Scan(pq.Array(&cat.Path))
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(categoryCountsQuery+" WHERE c.parent_id = $1", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		child := &Category{Children: []*Category{}}
+		if err := scanCategory(rows, child); err != nil {
+			return nil, err
+		}
+		cat.Children = append(cat.Children, child)
+	}
+	sortCategories(cat.Children)
+	return cat, rows.Err()
+}
+
+func getCategory(c *gin.Context) {
+	cat, err := loadCategory(c.Param("id"))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(404, gin.H{"error": "Category not found"})
+		} else {
+			log.Printf("Database error: %v", err)
+			c.JSON(500, gin.H{"error": "Failed to fetch category"})
+		}
+		return
+	}
+	c.JSON(200, cat)
+}
+
+// listCategoryBooks pages through the books assigned to a category or any
+// of its descendants, with the same parameters as GET /books.
+func (h *BookHandler) listCategoryBooks(c *gin.Context) {
+	id := c.Param("id")
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM categories WHERE id = $1)", id).Scan(&exists); err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to fetch books"})
+		return
+	}
+	if !exists {
+		c.JSON(404, gin.H{"error": "Category not found"})
+		return
+	}
+
+	q, err := parseBookListQuery(c)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	q.Category = id
+	h.writeBookPage(c, q)
+}
+
+// validateCategory checks and normalises the writable category fields.
+func validateCategory(name, slug *string) ValidationErrors {
+	var errs ValidationErrors
+	if name != nil {
+		*name = strings.TrimSpace(*name)
+		if *name == "" {
+			errs.add("name", "required", "name is required")
+		} else if utf8.RuneCountInString(*name) > maxCategoryNameLength {
+			errs.add("name", "too_long", "name must be at most %d characters", maxCategoryNameLength)
+		}
+	}
+	if slug != nil {
+		*slug = strings.TrimSpace(*slug)
+		if !validSlug.MatchString(*slug) {
+			errs.add("slug", "invalid", "slug must be lower-case letters and digits separated by single hyphens")
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// lockTaxonomy serialises structural changes to the category tree so that
+// concurrent moves cannot create a cycle between them.
+func lockTaxonomy(tx *sql.Tx) error {
+	_, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('categories'))")
+	return err
+}
+
+// inSubtree reports whether candidate is root or one of its descendants.
+func inSubtree(tx *sql.Tx, root, candidate string) (bool, error) {
+	var found bool
+	err := tx.QueryRow("SELECT $2 IN ("+categorySubtree("$1")+")", root, candidate).Scan(&found)
+	return found, err
+}
+
+// respondCategoryError maps the errors of the taxonomy write paths.
+func respondCategoryError(c *gin.Context, err error, action string) {
+	var errs ValidationErrors
+	var pqErr *pq.Error
+	switch {
+	case err == sql.ErrNoRows:
+		c.JSON(404, gin.H{"error": "Category not found"})
+	case errors.As(err, &errs):
+		respondValidationErrors(c, errs)
+	case err == errCategoryCycle:
+		c.JSON(409, gin.H{"error": err.Error()})
+	case err == errCategoryNotEmpty:
+		c.JSON(409, gin.H{"error": "Category still has subcategories or books; merge it instead"})
+	case errors.As(err, &pqErr) && pqErr.Code == "23505":
+		c.JSON(409, gin.H{"error": "A sibling category already uses that slug"})
+	case errors.As(err, &pqErr) && pqErr.Code == "23503":
+		respondValidationErrors(c, ValidationErrors{{Field: "parent_id", Code: "not_found", Message: "parent_id must refer to an existing category"}})
+	default:
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to " + action + " category"})
+	}
+}
+
+func createCategory(c *gin.Context) {
+	var in CategoryInput
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if in.Name == nil {
+		in.Name = new(string)
+	}
+	if in.Slug == nil {
+		slug := slugify(*in.Name)
+		in.Slug = &slug
+	}
+	if errs := validateCategory(in.Name, in.Slug); errs != nil {
+		respondValidationErrors(c, errs)
+		return
+	}
+	position := 0
+	if in.Position != nil {
+		position = *in.Position
+	}
+
+	id := newID()
+	err := inTx(func(tx *sql.Tx) error {
+		if err := lockTaxonomy(tx); err != nil {
+			return err
+		}
+		_, err := tx.Exec("INSERT INTO categories (id, parent_id, name, slug, position) VALUES ($1, $2, $3, $4, $5)",
+			id, in.ParentID, *in.Name, *in.Slug, position)
+		return err
+	})
+	if err != nil {
+		respondCategoryError(c, err, "create")
+		return
+	}
+
+	cat, err := loadCategory(id)
+	if err != nil {
+		respondCategoryError(c, err, "create")
+		return
+	}
+	c.Header("Location", "/categories/"+id)
+	c.JSON(201, cat)
+}
+
+// enqueueCategoryEvents records a book.updated event for every live book
+// filed under category id or its descendants, whose category paths
+// include its name.
+func enqueueCategoryEvents(tx *sql.Tx, id string) error {
+	return enqueueBookEvents(tx, `WITH RECURSIVE subtree AS (
+			SELECT id FROM categories WHERE id = $1
+			UNION ALL
+			SELECT c.id FROM categories c JOIN subtree s ON c.parent_id = s.id
+		)
+		SELECT DISTINCT bc.book_id FROM book_categories bc JOIN books b ON b.id = bc.book_id
+		WHERE bc.category_id IN (SELECT id FROM subtree) AND b.deleted_at IS NULL`, id)
+}
+
+// updateCategory renames or repositions a category among its siblings.
+// Changing the parent goes through moveCategory.
+func updateCategory(c *gin.Context) {
+	var in CategoryInput
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if in.ParentID != nil {
+		c.JSON(400, gin.H{"error": "Use POST /categories/:id/move to change the parent"})
+		return
+	}
+	if errs := validateCategory(in.Name, in.Slug); errs != nil {
+		respondValidationErrors(c, errs)
+		return
+	}
+
+	id := c.Param("id")
+	err := inTx(func(tx *sql.Tx) error {
+		res, err := tx.Exec(`UPDATE categories SET
+				name = COALESCE($2, name), slug = COALESCE($3, slug), position = COALESCE($4, position),
+				updated_at = now()
+			WHERE id = $1`, id, in.Name, in.Slug, in.Position)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return sql.ErrNoRows
+		}
+		if in.Name == nil {
+			return nil
+		}
+		return enqueueCategoryEvents(tx, id)
+	})
+	if err != nil {
+		respondCategoryError(c, err, "update")
+		return
+	}
+
+	cat, err := loadCategory(id)
+	if err != nil {
+		respondCategoryError(c, err, "update")
+		return
+	}
+	c.JSON(200, cat)
+}
+
+// moveCategory re-parents a category together with its subtree. Book
+// assignments travel with the nodes. A null parent_id makes it a root.
+func moveCategory(c *gin.Context) {
+	var in CategoryInput
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	id := c.Param("id")
+	err := inTx(func(tx *sql.Tx) error {
+		if err := lockTaxonomy(tx); err != nil {
+			return err
+		}
+		var locked string
+		if err := tx.QueryRow("SELECT id FROM categories WHERE id = $1 FOR UPDATE", id).Scan(&locked); err != nil {
+			return err
+		}
+		if in.ParentID != nil {
+			cycle, err := inSubtree(tx, id, *in.ParentID)
+			if err != nil {
+				return err
+			}
+			if cycle {
+				return errCategoryCycle
+			}
+		}
+		_, err := tx.Exec("UPDATE categories SET parent_id = $2, position = COALESCE($3, position), updated_at = now() WHERE id = $1",
+			id, in.ParentID, in.Position)
+		if err != nil {
+			return err
+		}
+		return enqueueCategoryEvents(tx, id)
+	})
+	if err != nil {
+		respondCategoryError(c, err, "move")
+		return
+	}
+
+	cat, err := loadCategory(id)
+	if err != nil {
+		respondCategoryError(c, err, "move")
+		return
+	}
+	c.JSON(200, cat)
+}
+
+// mergeCategory folds a category into target: its book assignments and
+// subcategories move to target and the source node is deleted.
+func mergeCategory(c *gin.Context) {
+	var in struct {
+		TargetID string `json:"target_id"`
+	}
+	if err := c.ShouldBindJSON(&in); err != nil || in.TargetID == "" {
+		c.JSON(400, gin.H{"error": "target_id is required"})
+		return
+	}
+
+	id := c.Param("id")
+	err := inTx(func(tx *sql.Tx) error {
+		if err := lockTaxonomy(tx); err != nil {
+			return err
+		}
+		var found int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM categories WHERE id IN ($1, $2)", id, in.TargetID).Scan(&found); err != nil {
+			return err
+		}
+		if found != 2 {
+			return sql.ErrNoRows
+		}
+		cycle, err := inSubtree(tx, id, in.TargetID)
+		if err != nil {
+			return err
+		}
+		if cycle {
+			return errCategoryCycle
+		}
+
+		statements := []string{
+			`INSERT INTO book_categories (book_id, category_id)
+				SELECT book_id, $2 FROM book_categories WHERE category_id = $1
+				ON CONFLICT DO NOTHING`,
+			"DELETE FROM book_categories WHERE category_id = $1",
+			"UPDATE categories SET parent_id = $2, updated_at = now() WHERE parent_id = $1",
+			"DELETE FROM categories WHERE id = $1",
+		}
+		for _, stmt := range statements {
+			if _, err := tx.Exec(stmt, id, in.TargetID); err != nil {
+				return err
+			}
+		}
+		// The source's books and subcategories now sit under the target.
+		return enqueueCategoryEvents(tx, in.TargetID)
+	})
+	if err != nil {
+		respondCategoryError(c, err, "merge")
+		return
+	}
+
+	cat, err := loadCategory(in.TargetID)
+	if err != nil {
+		respondCategoryError(c, err, "merge")
+		return
+	}
+	c.JSON(200, cat)
+}
+
+// deleteCategory removes an empty leaf category.
+func deleteCategory(c *gin.Context) {
+	id := c.Param("id")
+	err := inTx(func(tx *sql.Tx) error {
+		if err := lockTaxonomy(tx); err != nil {
+			return err
+		}
+		var inUse bool
+		err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM categories WHERE parent_id = $1)
+			OR EXISTS (SELECT 1 FROM book_categories WHERE category_id = $1)`, id).Scan(&inUse)
+		if err != nil {
+			return err
+		}
+		if inUse {
+			return errCategoryNotEmpty
+		}
+		res, err := tx.Exec("DELETE FROM categories WHERE id = $1", id)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return sql.ErrNoRows
+		}
+		return nil
+	})
+	if err != nil {
+		respondCategoryError(c, err, "delete")
+		return
+	}
+	c.JSON(200, gin.H{"message": "Category deleted successfully"})
+}
+
+// bookCategories returns the categories a book is assigned to, each with
+// its path from the root.
+func bookCategories(conn *sql.DB, bookID string) ([]CategoryRef, error) {
+	rows, err := conn.Query(`WITH RECURSIVE ancestry AS (
+			SELECT bc.category_id AS leaf, c.id, c.parent_id, c.name, 0 AS depth
+			FROM book_categories bc JOIN categories c ON c.id = bc.category_id
+			WHERE bc.book_id = $1
+			UNION ALL
+			SELECT a.leaf, p.id, p.parent_id, p.name, a.depth + 1
+			FROM ancestry a JOIN categories p ON p.id = a.parent_id
+		)
+		SELECT leaf, array_agg(name ORDER BY depth DESC) AS path
+		FROM ancestry GROUP BY leaf ORDER BY path`, bookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refs := []CategoryRef{}
+	for rows.Next() {
+		var ref CategoryRef
+		if err := rows.Scan(&ref.ID, pq.Array(&ref.Path)); err != nil {
+			return nil, err
+		}
+		ref.Name = ref.Path[len(ref.Path)-1]
+		refs = append(refs, ref)
+	}
+	return refs, rows.Err()
+}
+
+func getBookCategories(c *gin.Context) {
+	id := c.Param("id")
+	exists, err := bookExists(id)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to fetch book categories"})
+		return
+	}
+	if !exists {
+		c.JSON(404, gin.H{"error": "Book not found"})
+		return
+	}
+
+	refs, err := bookCategories(db, id)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to fetch book categories"})
+		return
+	}
+	c.JSON(200, refs)
+}
+
+// setBookCategories replaces the categories a book is assigned to.
+func setBookCategories(c *gin.Context) {
+	id := c.Param("id")
+
+	var categoryIDs []string
+	if err := c.ShouldBindJSON(&categoryIDs); err != nil {
+		c.JSON(400, gin.H{"error": "Request body must be a list of category ids"})
+		return
+	}
+
+	err := inTx(func(tx *sql.Tx) error {
+		var locked string
+		if err := tx.QueryRow("SELECT id FROM books WHERE id = $1 AND deleted_at IS NULL FOR UPDATE", id).Scan(&locked); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM book_categories WHERE book_id = $1", id); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`INSERT INTO book_categories (book_id, category_id)
+			SELECT $1, unnest($2::text[]) ON CONFLICT DO NOTHING`, id, pq.Array(categoryIDs))
+		if err != nil {
+			return err
+		}
+		return enqueueBookEvent(tx, bookUpdatedEvent, id)
+	})
+	if err != nil {
+		var pqErr *pq.Error
+		switch {
+		case err == sql.ErrNoRows:
+			c.JSON(404, gin.H{"error": "Book not found"})
+		case errors.As(err, &pqErr) && pqErr.Code == "23503":
+			respondValidationErrors(c, ValidationErrors{{Field: "category_id", Code: "not_found", Message: "every category id must refer to an existing category"}})
+		default:
+			log.Printf("Database error: %v", err)
+			c.JSON(500, gin.H{"error": "Failed to update book categories"})
+		}
+		return
+	}
+
+	refs, err := bookCategories(db, id)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to fetch book categories"})
+		return
+	}
+	c.JSON(200, refs)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	maxCoverBytes  = 10 << 20
+	maxCoverPixels = 40_000_000
+	coverMaxAge    = 24 * time.Hour
+)
+
+// coverTypes are the sniffed content types accepted for uploads.
+var coverTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// coverSizes are the thumbnail widths generated for every upload. The
+// uploaded image itself is served as size "original".
+var coverSizes = map[string]int{
+	"small":  160,
+	"medium": 320,
+	"large":  640,
+}
+
+// Cover describes the cover image of a book.
+type Cover struct {
+	BookID      string    `json:"book_id"`
+	ContentType string    `json:"content_type"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	SizeBytes   int64     `json:"size_bytes"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func coverKey(bookID, size string) string {
+	return "covers/" + bookID + "/" + size
+}
+
+// thumbnail scales img down to width, keeping its aspect ratio, and
+// encodes it as JPEG on a white background. Images narrower than width
+// are not enlarged.
+func thumbnail(img image.Image, width int) ([]byte, error) {
+	b := img.Bounds()
+	if b.Dx() < width {
+		width = b.Dx()
+	}
+	height := b.Dy() * width / b.Dx()
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Over, nil)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// uploadCover stores the multipart "cover" file of a book and generates
+// its thumbnails, replacing any previous cover.
+func uploadCover(c *gin.Context) {
+	id := c.Param("id")
+	exists, err := bookExists(id)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to upload cover"})
+		return
+	}
+	if !exists {
+		c.JSON(404, gin.H{"error": "Book not found"})
+		return
+	}
+
+	tooLarge := fmt.Sprintf("Cover must be at most %d MB", maxCoverBytes>>20)
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxCoverBytes+1<<20)
+	header, err := c.FormFile("cover")
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			c.JSON(413, gin.H{"error": tooLarge})
+		} else {
+			c.JSON(400, gin.H{"error": "A multipart \"cover\" file is required"})
+		}
+		return
+	}
+	if header.Size > maxCoverBytes {
+		c.JSON(413, gin.H{"error": tooLarge})
+		return
+	}
+	file, err := header.Open()
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Failed to read cover"})
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxCoverBytes+1))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Failed to read cover"})
+		return
+	}
+	if len(data) > maxCoverBytes {
+		c.JSON(413, gin.H{"error": tooLarge})
+		return
+	}
+
+	// The declared Content-Type of the part is ignored in favour of the
+	// bytes themselves.
+	contentType := http.DetectContentType(data)
+	if !coverTypes[contentType] {
+		c.JSON(415, gin.H{"error": "Cover must be a JPEG, PNG, GIF or WebP image"})
+		return
+	}
+
+	var errs ValidationErrors
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		errs.add("cover", "invalid", "cover image could not be decoded")
+		respondValidationErrors(c, errs)
+		return
+	}
+	if cfg.Width*cfg.Height > maxCoverPixels {
+		errs.add("cover", "too_large", "cover must have at most %d pixels", maxCoverPixels)
+		respondValidationErrors(c, errs)
+		return
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		errs.add("cover", "invalid", "cover image could not be decoded")
+		respondValidationErrors(c, errs)
+		return
+	}
+
+	blobsToPut := map[string][]byte{coverKey(id, "original"): data}
+	for size, width := range coverSizes {
+		thumb, err := thumbnail(img, width)
+		if err != nil {
+			log.Printf("Thumbnail error: %v", err)
+			c.JSON(500, gin.H{"error": "Failed to generate thumbnails"})
+			return
+		}
+		blobsToPut[coverKey(id, size)] = thumb
+	}
+	for key, blob := range blobsToPut {
+		if err := blobs.Put(key, bytes.NewReader(blob)); err != nil {
+			log.Printf("Blob store error: %v", err)
+			c.JSON(500, gin.H{"error": "Failed to store cover"})
+			return
+		}
+	}
+
+	sum := sha256.Sum256(data)
+	cover := Cover{BookID: id, ContentType: contentType, Width: cfg.Width, Height: cfg.Height, SizeBytes: int64(len(data))}
+	err = db.QueryRow(`INSERT INTO book_covers (book_id, content_type, width, height, size_bytes, checksum)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (book_id) DO UPDATE SET content_type = EXCLUDED.content_type, width = EXCLUDED.width,
+			height = EXCLUDED.height, size_bytes = EXCLUDED.size_bytes, checksum = EXCLUDED.checksum, updated_at = now()
+		RETURNING updated_at`,
+		id, contentType, cfg.Width, cfg.Height, cover.SizeBytes, hex.EncodeToString(sum[:])).Scan(&cover.UpdatedAt)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to store cover"})
+		return
+	}
+
+	c.Header("Location", "/books/"+id+"/cover")
+	c.JSON(201, cover)
+}
+
+// getCover serves the original cover or one of its thumbnails, selected
+// with ?size=small|medium|large|original (default original). Responses
+// are cacheable and revalidate with If-None-Match or If-Modified-Since.
+func getCover(c *gin.Context) {
+	id := c.Param("id")
+	size := c.DefaultQuery("size", "original")
+	if _, ok := coverSizes[size]; !ok && size != "original" {
+		c.JSON(400, gin.H{"error": "size must be one of small, medium, large, original"})
+		return
+	}
+
+	var contentType, checksum string
+	var updatedAt time.Time
+	err := db.QueryRow(`SELECT bc.content_type, bc.checksum, bc.updated_at
+		FROM book_covers bc JOIN books b ON b.id = bc.book_id AND b.deleted_at IS NULL
+		WHERE bc.book_id = $1`, id).Scan(&contentType, &checksum, &updatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(404, gin.H{"error": "Cover not found"})
+		} else {
+			log.Printf("Database error: %v", err)
+			c.JSON(500, gin.H{"error": "Failed to fetch cover"})
+		}
+		return
+	}
+	if size != "original" {
+		contentType = "image/jpeg"
+	}
+
+	etag := fmt.Sprintf(`"%s-%s"`, checksum[:16], size)
+	lastModified := updatedAt.UTC().Truncate(time.Second)
+	c.Header("ETag", etag)
+	c.Header("Last-Modified", lastModified.Format(http.TimeFormat))
+	c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(coverMaxAge.Seconds())))
+
+	if notModified(c, etag, lastModified) {
+		c.Status(304)
+		return
+	}
+
+	rc, err := blobs.Get(coverKey(id, size))
+	if err != nil {
+		if err == errBlobNotFound {
+			c.JSON(404, gin.H{"error": "Cover not found"})
+		} else {
+			log.Printf("Blob store error: %v", err)
+			c.JSON(500, gin.H{"error": "Failed to fetch cover"})
+		}
+		return
+	}
+	defer rc.Close()
+	c.DataFromReader(200, -1, contentType, rc, nil)
+}
+
+func deleteCover(c *gin.Context) {
+	id := c.Param("id")
+	var deletedID string
+	if err := db.QueryRow("DELETE FROM book_covers WHERE book_id = $1 RETURNING book_id", id).Scan(&deletedID); err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(404, gin.H{"error": "Cover not found"})
+		} else {
+			log.Printf("Database error: %v", err)
+			c.JSON(500, gin.H{"error": "Failed to delete cover"})
+		}
+		return
+	}
+	deleteCoverBlobs(id)
+	c.JSON(200, gin.H{"message": "Cover deleted successfully"})
+}
+
+// deleteCoverBlobs removes every stored size of a book's cover. Failures
+// are logged rather than returned since the metadata row is already gone.
+func deleteCoverBlobs(bookID string) {
+	keys := []string{coverKey(bookID, "original")}
+	for size := range coverSizes {
+		keys = append(keys, coverKey(bookID, size))
+	}
+	for _, key := range keys {
+		if err := blobs.Delete(key); err != nil {
+			log.Printf("Failed to delete blob %s: %v", key, err)
+		}
+	}
+}
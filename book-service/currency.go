@@ -0,0 +1,467 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// currencyExponents lists the ISO 4217 currencies whose minor unit is not
+// a hundredth; every other currency has two decimals.
+var currencyExponents = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0, "PYG": 0,
+	"RWF": 0, "UGX": 0, "UYI": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+	"CLF": 4, "UYW": 4,
+}
+
+// currencyExponent is the number of decimals in currency's minor unit.
+func currencyExponent(currency string) int {
+	if exp, ok := currencyExponents[currency]; ok {
+		return exp
+	}
+	return 2
+}
+
+// BookPrice is a book's list price in a currency other than its own.
+type BookPrice struct {
+	Currency   string `json:"currency"`
+	PriceMinor int64  `json:"price_minor"`
+}
+
+// DisplayPrice is a book's price in the currency a client asked for.
+// Source is "list" when the book has a price set in that currency and
+// "converted" when it was converted from the book's base price, in which
+// case ExchangeRate and RateEffectiveFrom identify the rate used.
+type DisplayPrice struct {
+	Currency          string `json:"currency"`
+	PriceMinor        int64  `json:"price_minor"`
+	Source            string `json:"source"`
+	ExchangeRate      string `json:"exchange_rate,omitempty"`
+	RateEffectiveFrom *Date  `json:"rate_effective_from,omitempty"`
+}
+
+// ExchangeRate says that one unit of Base buys Rate units of Quote from
+// EffectiveFrom until a later rate for the pair takes over.
+type ExchangeRate struct {
+	Base          string    `json:"base"`
+	Quote         string    `json:"quote"`
+	Rate          string    `json:"rate"`
+	EffectiveFrom Date      `json:"effective_from"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// currencyRate is an exchange rate into one target currency, ready for
+// conversion.
+type currencyRate struct {
+	rate          *big.Rat
+	effectiveFrom Date
+}
+
+var errConversionOverflow = errors.New("converted price is too large")
+
+// convertMinor converts amount minor units of from into minor units of
+// to, rounding half away from zero to the target's minor unit. It returns
+// errConversionOverflow when the result does not fit in an int64.
+func convertMinor(amount int64, from, to string, rate *big.Rat) (int64, error) {
+	v := new(big.Rat).Mul(new(big.Rat).SetInt64(amount), rate)
+	shift := currencyExponent(to) - currencyExponent(from)
+	scale := new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(max(shift, -shift))), nil))
+	if shift >= 0 {
+		v.Mul(v, scale)
+	} else {
+		v.Quo(v, scale)
+	}
+
+	// |v| rounded half up is (2|num| + den) / 2den.
+	num := new(big.Int).Abs(v.Num())
+	num.Add(num.Lsh(num, 1), v.Denom())
+	num.Quo(num, new(big.Int).Lsh(v.Denom(), 1))
+	if v.Sign() < 0 {
+		num.Neg(num)
+	}
+	if !num.IsInt64() {
+		return 0, errConversionOverflow
+	}
+	return num.Int64(), nil
+}
+
+// formatRate renders a rate with up to ten decimals.
+func formatRate(rate *big.Rat) string {
+	s := rate.FloatString(10)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+// displayPrice prices b in currency: a list price in that currency, be it
+// the book's own or one from book_prices, else a conversion of its own
+// price with rates keyed by source currency. It returns nil when neither
+// is available, and an error wrapping errConversionOverflow when the
+// conversion is out of range.
+func displayPrice(b Book, currency string, listPrice *int64, rates map[string]currencyRate) (*DisplayPrice, error) {
+	if listPrice != nil {
+		return &DisplayPrice{Currency: currency, PriceMinor: *listPrice, Source: "list"}, nil
+	}
+	if b.PriceMinor == nil {
+		return nil, nil
+	}
+	if b.Currency == currency {
+		return &DisplayPrice{Currency: currency, PriceMinor: *b.PriceMinor, Source: "list"}, nil
+	}
+	r, ok := rates[b.Currency]
+	if !ok {
+		return nil, nil
+	}
+	price, err := convertMinor(*b.PriceMinor, b.Currency, currency, r.rate)
+	if err != nil {
+		return nil, fmt.Errorf("book %s in %s: %w", b.ID, currency, err)
+	}
+	effectiveFrom := r.effectiveFrom
+	return &DisplayPrice{
+		Currency:          currency,
+		PriceMinor:        price,
+		Source:            "converted",
+		ExchangeRate:      formatRate(r.rate),
+		RateEffectiveFrom: &effectiveFrom,
+	}, nil
+}
+
+// requestedCurrency returns the currency asked for with ?currency= or,
+// failing that, the preferred valid entry of an Accept-Currency header
+// such as "EUR, GBP;q=0.8". It returns "" when neither is given.
+func requestedCurrency(c *gin.Context) (string, error) {
+	if raw := c.Query("currency"); raw != "" {
+		currency := strings.ToUpper(strings.TrimSpace(raw))
+		if !isCurrencyCode(currency) {
+			return "", errors.New("currency must be a three-letter ISO 4217 code")
+		}
+		return currency, nil
+	}
+
+	best, bestQ := "", 0.0
+	for _, entry := range strings.Split(c.GetHeader("Accept-Currency"), ",") {
+		code, params, _ := strings.Cut(entry, ";")
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if !isCurrencyCode(code) {
+			continue
+		}
+		q := 1.0
+		if name, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(name) == "q" {
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if q > bestQ {
+			best, bestQ = code, q
+		}
+	}
+	return best, nil
+}
+
+// localizeBooks sets the display price of books in the currency the
+// request asks for, if any. It reports false after responding with an
+// error.
+func (h *BookHandler) localizeBooks(c *gin.Context, books []Book) bool {
+	c.Header("Vary", "Accept-Currency")
+	currency, err := requestedCurrency(c)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return false
+	}
+	if currency == "" || len(books) == 0 {
+		return true
+	}
+	if err := h.repo.LocalizePrices(books, currency); err != nil {
+		if errors.Is(err, errConversionOverflow) {
+			c.JSON(422, gin.H{"error": err.Error()})
+			return false
+		}
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to convert prices"})
+		return false
+	}
+	return true
+}
+
+// loadExchangeRates returns the rates in force today for converting into
+// currency, keyed by source currency. A rate published for the reverse
+// pair is inverted when it is more recent than any direct one.
+func loadExchangeRates(conn *sql.DB, currency string) (map[string]currencyRate, error) {
+	rows, err := conn.Query(`SELECT base, quote, rate::text, effective_from FROM (
+			SELECT DISTINCT ON (base) base, quote, rate, effective_from FROM exchange_rates
+			WHERE quote = $1 AND effective_from <= CURRENT_DATE ORDER BY base, effective_from DESC
+		) direct
+		UNION ALL
+		SELECT base, quote, rate::text, effective_from FROM (
+			SELECT DISTINCT ON (quote) base, quote, rate, effective_from FROM exchange_rates
+			WHERE base = $1 AND effective_from <= CURRENT_DATE ORDER BY quote, effective_from DESC
+		) inverse`, currency)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rates := map[string]currencyRate{}
+	for rows.Next() {
+		var base, quote, raw string
+		var effectiveFrom Date
+		if err := rows.Scan(&base, &quote, &raw, &effectiveFrom); err != nil {
+			return nil, err
+		}
+		rate, ok := new(big.Rat).SetString(raw)
+		if !ok || rate.Sign() <= 0 {
+			return nil, fmt.Errorf("invalid exchange rate %q for %s/%s", raw, base, quote)
+		}
+		addExchangeRate(rates, currency, base, quote, rate, effectiveFrom)
+	}
+	return rates, rows.Err()
+}
+
+// addExchangeRate records the rate of base/quote in rates, inverting it
+// when currency is the base, unless rates already holds a rate for the
+// same source currency that is at least as recent.
+func addExchangeRate(rates map[string]currencyRate, currency, base, quote string, rate *big.Rat, effectiveFrom Date) {
+	r := currencyRate{rate: rate, effectiveFrom: effectiveFrom}
+	source := base
+	if base == currency {
+		source, r.rate = quote, new(big.Rat).Inv(rate)
+	}
+	if existing, ok := rates[source]; ok && !r.effectiveFrom.After(existing.effectiveFrom.Time) {
+		return
+	}
+	rates[source] = r
+}
+
+// getBookPrices lists a book's list prices in other currencies.
+func getBookPrices(c *gin.Context) {
+	id := c.Param("id")
+	exists, err := bookExists(id)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to fetch book prices"})
+		return
+	}
+	if !exists {
+		c.JSON(404, gin.H{"error": "Book not found"})
+		return
+	}
+	prices, err := bookPrices(db, id)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to fetch book prices"})
+		return
+	}
+	c.JSON(200, prices)
+}
+
+func bookPrices(conn *sql.DB, bookID string) ([]BookPrice, error) {
+	rows, err := conn.Query("SELECT currency, price_minor FROM book_prices WHERE book_id = $1 ORDER BY currency", bookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	prices := []BookPrice{}
+	for rows.Next() {
+		var p BookPrice
+		if err := rows.Scan(&p.Currency, &p.PriceMinor); err != nil {
+			return nil, err
+		}
+		prices = append(prices, p)
+	}
+	return prices, rows.Err()
+}
+
+// setBookPrices replaces a book's list prices in other currencies. Its
+// base price stays on the book itself.
+func setBookPrices(c *gin.Context) {
+	id := c.Param("id")
+	var prices []BookPrice
+	if err := c.ShouldBindJSON(&prices); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	var errs ValidationErrors
+	seen := map[string]bool{}
+	for i := range prices {
+		prices[i].Currency = strings.ToUpper(strings.TrimSpace(prices[i].Currency))
+		field := fmt.Sprintf("[%d]", i)
+		switch {
+		case !isCurrencyCode(prices[i].Currency):
+			errs.add(field+".currency", "invalid", "currency must be a three-letter ISO 4217 code")
+		case seen[prices[i].Currency]:
+			errs.add(field+".currency", "duplicate", "%s is listed more than once", prices[i].Currency)
+		}
+		seen[prices[i].Currency] = true
+		if prices[i].PriceMinor < 0 {
+			errs.add(field+".price_minor", "negative", "price_minor must not be negative")
+		}
+	}
+	if errs != nil {
+		respondValidationErrors(c, errs)
+		return
+	}
+
+	err := inTx(func(tx *sql.Tx) error {
+		var currency string
+		if err := tx.QueryRow("SELECT currency FROM books WHERE id = $1 AND deleted_at IS NULL FOR UPDATE", id).Scan(&currency); err != nil {
+			return err
+		}
+		if seen[currency] {
+			return ValidationErrors{{Field: "currency", Code: "base_currency",
+				Message: fmt.Sprintf("%s is the book's own currency; set price_minor on the book instead", currency)}}
+		}
+		if _, err := tx.Exec("DELETE FROM book_prices WHERE book_id = $1", id); err != nil {
+			return err
+		}
+		for _, p := range prices {
+			if _, err := tx.Exec("INSERT INTO book_prices (book_id, currency, price_minor) VALUES ($1, $2, $3)",
+				id, p.Currency, p.PriceMinor); err != nil {
+				return err
+			}
+		}
+		return enqueueBookEvent(tx, bookUpdatedEvent, id)
+	})
+	if err != nil {
+		var verrs ValidationErrors
+		switch {
+		case err == sql.ErrNoRows:
+			c.JSON(404, gin.H{"error": "Book not found"})
+		case errors.As(err, &verrs):
+			respondValidationErrors(c, verrs)
+		default:
+			log.Printf("Database error: %v", err)
+			c.JSON(500, gin.H{"error": "Failed to update book prices"})
+		}
+		return
+	}
+
+	sort.Slice(prices, func(i, j int) bool { return prices[i].Currency < prices[j].Currency })
+	if prices == nil {
+		prices = []BookPrice{}
+	}
+	c.JSON(200, prices)
+}
+
+const exchangeRateColumns = "base, quote, rate::text, effective_from, created_at, updated_at"
+
+func scanExchangeRate(row rowScanner, r *ExchangeRate) error {
+	return row.Scan(&r.Base, &r.Quote, &r.Rate, &r.EffectiveFrom, &r.CreatedAt, &r.UpdatedAt)
+}
+
+// listExchangeRates returns the exchange rate history, newest first,
+// optionally narrowed to ?base= and ?quote=.
+func listExchangeRates(c *gin.Context) {
+	var args []interface{}
+	var conds []string
+	for _, param := range []string{"base", "quote"} {
+		if raw := c.Query(param); raw != "" {
+			args = append(args, strings.ToUpper(raw))
+			conds = append(conds, fmt.Sprintf("%s = $%d", param, len(args)))
+		}
+	}
+	query := "SELECT " + exchangeRateColumns + " FROM exchange_rates"
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	rows, err := db.Query(query+" ORDER BY base, quote, effective_from DESC", args...)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to fetch exchange rates"})
+		return
+	}
+	defer rows.Close()
+
+	rates := []ExchangeRate{}
+	for rows.Next() {
+		var r ExchangeRate
+		if err := scanExchangeRate(rows, &r); err != nil {
+			log.Printf("Row scan error: %v", err)
+			continue
+		}
+		rates = append(rates, r)
+	}
+	c.JSON(200, rates)
+}
+
+// putExchangeRate records the rate for a currency pair from a date,
+// replacing any rate already set for that pair and date.
+func putExchangeRate(c *gin.Context) {
+	var r ExchangeRate
+	if err := c.ShouldBindJSON(&r); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	r.Base = strings.ToUpper(strings.TrimSpace(r.Base))
+	r.Quote = strings.ToUpper(strings.TrimSpace(r.Quote))
+	r.Rate = strings.TrimSpace(r.Rate)
+
+	var errs ValidationErrors
+	if !isCurrencyCode(r.Base) {
+		errs.add("base", "invalid", "base must be a three-letter ISO 4217 code")
+	}
+	if !isCurrencyCode(r.Quote) {
+		errs.add("quote", "invalid", "quote must be a three-letter ISO 4217 code")
+	} else if r.Quote == r.Base {
+		errs.add("quote", "same_currency", "quote must differ from base")
+	}
+	if rate, ok := new(big.Rat).SetString(r.Rate); !ok || strings.Contains(r.Rate, "/") || rate.Sign() <= 0 {
+		errs.add("rate", "invalid", "rate must be a positive decimal number")
+	}
+	if r.EffectiveFrom.IsZero() {
+		errs.add("effective_from", "required", "effective_from is required")
+	}
+	if errs != nil {
+		respondValidationErrors(c, errs)
+		return
+	}
+
+	err := scanExchangeRate(db.QueryRow(`INSERT INTO exchange_rates (base, quote, rate, effective_from)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (base, quote, effective_from) DO UPDATE SET rate = EXCLUDED.rate, updated_at = now()
+		RETURNING `+exchangeRateColumns, r.Base, r.Quote, r.Rate, r.EffectiveFrom), &r)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "22003" {
+			respondValidationErrors(c, ValidationErrors{{Field: "rate", Code: "out_of_range", Message: "rate must be below 10^10 with at most 10 decimals"}})
+			return
+		}
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to save exchange rate"})
+		return
+	}
+	c.JSON(200, r)
+}
+
+// deleteExchangeRate removes the rate of a pair from one date.
+func deleteExchangeRate(c *gin.Context) {
+	date, err := time.Parse(dateLayout, c.Param("effective_from"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "effective_from must be a date in YYYY-MM-DD format"})
+		return
+	}
+	res, err := db.Exec("DELETE FROM exchange_rates WHERE base = $1 AND quote = $2 AND effective_from = $3",
+		strings.ToUpper(c.Param("base")), strings.ToUpper(c.Param("quote")), Date{date})
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to delete exchange rate"})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(404, gin.H{"error": "Exchange rate not found"})
+		return
+	}
+	c.JSON(200, gin.H{"message": "Exchange rate deleted successfully"})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const dateLayout = "2006-01-02"
+
+// Date is a calendar date without a time component. It is encoded as
+// "YYYY-MM-DD" in JSON and maps to a Postgres DATE column.
+type Date struct {
+	time.Time
+}
+
+func (d Date) String() string {
+	return d.Format(dateLayout)
+}
+
+func (d Date) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Date) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	t, err := time.Parse(dateLayout, s)
+	if err != nil {
+		return fmt.Errorf("invalid date %q, expected YYYY-MM-DD", s)
+	}
+	d.Time = t
+	return nil
+}
+
+func (d *Date) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case time.Time:
+		d.Time = time.Date(v.Year(), v.Month(), v.Day(), 0, 0, 0, 0, time.UTC)
+		return nil
+	case string:
+		t, err := time.Parse(dateLayout, v)
+		d.Time = t
+		return err
+	case []byte:
+		t, err := time.Parse(dateLayout, string(v))
+		d.Time = t
+		return err
+	}
+	return fmt.Errorf("cannot scan %T into Date", src)
+}
+
+func (d Date) Value() (driver.Value, error) {
+	return d.String(), nil
+}
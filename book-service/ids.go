@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/lib/pq"
+	"github.com/oklog/ulid/v2"
+)
+
+// validBookID matches client-supplied book IDs: 1-64 characters of
+// letters, digits, '.', '_' or '-', starting with a letter or digit. The
+// restriction keeps IDs safe to embed in URLs and Location headers.
+var validBookID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+var errInvalidBookID = errors.New("id must be 1-64 letters, digits, '.', '_' or '-' and start with a letter or digit")
+
+// newID returns a ULID, which sorts by creation time.
+func newID() string {
+	return ulid.Make().String()
+}
+
+// bookConstraintError maps a Postgres unique violation on one of the books
+// constraints to errDuplicateBookID or errDuplicateISBN, and returns any
+// other error unchanged.
+func bookConstraintError(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != "23505" {
+		return err
+	}
+	switch pqErr.Constraint {
+	case "books_pkey":
+		return errDuplicateBookID
+	case "books_isbn_key":
+		return errDuplicateISBN
+	}
+	return err
+}
+
+// conflictMessage returns a client-facing message when err is a unique
+// violation on one of the books constraints.
+func conflictMessage(err error, b Book) (string, bool) {
+	err = bookConstraintError(err)
+	switch {
+	case errors.Is(err, errDuplicateBookID):
+		return fmt.Sprintf("A book with id %q already exists", b.ID), true
+	case errors.Is(err, errDuplicateISBN):
+		return fmt.Sprintf("A book with ISBN %q already exists", b.ISBN), true
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return "Book conflicts with an existing record", true
+	}
+	return "", false
+}
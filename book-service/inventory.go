@@ -0,0 +1,576 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultReservationTTL = 15 * time.Minute
+	minReservationTTL     = time.Minute
+	maxReservationTTL     = time.Hour
+
+	reservationReapInterval = 30 * time.Second
+
+	// Callers without inventory:manage, which includes customers checking
+	// out through the order service, may hold at most
+	// maxCustomerReservedCopies copies over maxCustomerReservations
+	// pending reservations, each for up to maxCustomerReservationTTL, so
+	// that nobody can keep the stock to themselves by re-reserving.
+	maxCustomerReservationTTL = defaultReservationTTL
+	maxCustomerReservations   = 5
+	maxCustomerReservedCopies = 10
+)
+
+// stockAdjustmentReasons are the accepted values for StockAdjustment.Reason.
+var stockAdjustmentReasons = map[string]bool{
+	"received":   true,
+	"returned":   true,
+	"damaged":    true,
+	"lost":       true,
+	"correction": true,
+}
+
+var (
+	errInsufficientStock  = errors.New("insufficient stock")
+	errReservationClosed  = errors.New("reservation is no longer pending")
+	errReservationExpired = errors.New("reservation has expired")
+	errSoldInVariants     = errors.New("book is sold in variants")
+	errReservationLimit   = errors.New("reservation limit reached")
+)
+
+// stockItem identifies an inventory row: one variant of a book, or the
+// book itself when it is not sold in variants.
+type stockItem struct {
+	BookID    string
+	VariantID string
+}
+
+// where returns a condition selecting the item's rows in an inventory
+// table, with the item bound to $1.
+func (s stockItem) where() (string, interface{}) {
+	if s.VariantID != "" {
+		return "variant_id = $1", s.VariantID
+	}
+	return "book_id = $1 AND variant_id IS NULL", s.BookID
+}
+
+// variantParam is VariantID as a nullable column value.
+func (s stockItem) variantParam() interface{} {
+	if s.VariantID == "" {
+		return nil
+	}
+	return s.VariantID
+}
+
+// Stock is the inventory level of a book or variant. Available is what
+// can still be reserved: copies on hand minus copies held by pending
+// reservations.
+type Stock struct {
+	BookID    string    `json:"book_id"`
+	VariantID *string   `json:"variant_id,omitempty"`
+	OnHand    int       `json:"on_hand"`
+	Reserved  int       `json:"reserved"`
+	Available int       `json:"available"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Reservation holds copies of a book or variant for an order until it is
+// committed, released, or expires.
+type Reservation struct {
+	ID         int64      `json:"id"`
+	BookID     string     `json:"book_id"`
+	VariantID  *string    `json:"variant_id,omitempty"`
+	Quantity   int        `json:"quantity"`
+	Status     string     `json:"status"`
+	Reference  string     `json:"reference,omitempty"`
+	CreatedBy  string     `json:"created_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
+
+type ReservationRequest struct {
+	Quantity   int    `json:"quantity"`
+	TTLSeconds int    `json:"ttl_seconds"`
+	Reference  string `json:"reference"`
+}
+
+// StockAdjustment is an audited change to the on-hand quantity.
+type StockAdjustment struct {
+	ID         int64     `json:"id"`
+	BookID     string    `json:"book_id"`
+	VariantID  *string   `json:"variant_id,omitempty"`
+	Delta      int       `json:"delta"`
+	Reason     string    `json:"reason"`
+	Note       string    `json:"note,omitempty"`
+	AdjustedBy string    `json:"adjusted_by"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+const reservationColumns = "id, book_id, variant_id, quantity, status, reference, created_by, created_at, expires_at, resolved_at"
+
+func scanReservation(row rowScanner, r *Reservation) error {
+	return row.Scan(&r.ID, &r.BookID, &r.VariantID, &r.Quantity, &r.Status, &r.Reference, &r.CreatedBy,
+		&r.CreatedAt, &r.ExpiresAt, &r.ResolvedAt)
+}
+
+// item returns the stock item the reservation holds copies of.
+func (r Reservation) item() stockItem {
+	s := stockItem{BookID: r.BookID}
+	if r.VariantID != nil {
+		s.VariantID = *r.VariantID
+	}
+	return s
+}
+
+// bookExists reports whether a book with the given id exists and is not
+// in the trash.
+func bookExists(id string) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM books WHERE id = $1 AND deleted_at IS NULL)", id).Scan(&exists)
+	return exists, err
+}
+
+// requestedStockItem resolves the book, or the book's variant, whose
+// stock the route addresses. Books sold in variants keep no stock of
+// their own. It reports false after responding with an error.
+func requestedStockItem(c *gin.Context, failure string) (stockItem, bool) {
+	item := stockItem{BookID: c.Param("id"), VariantID: c.Param("variant_id")}
+	var bookFound, variantFound bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM books WHERE id = $1 AND deleted_at IS NULL),
+		EXISTS (SELECT 1 FROM book_variants WHERE book_id = $1 AND ($2 = '' OR id = $2))`,
+		item.BookID, item.VariantID).Scan(&bookFound, &variantFound)
+	switch {
+	case err != nil:
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": failure})
+	case !bookFound:
+		c.JSON(404, gin.H{"error": "Book not found"})
+	case item.VariantID != "" && !variantFound:
+		c.JSON(404, gin.H{"error": "Variant not found"})
+	case item.VariantID == "" && variantFound:
+		respondSoldInVariants(c, item.BookID)
+	default:
+		return item, true
+	}
+	return item, false
+}
+
+func respondSoldInVariants(c *gin.Context, bookID string) {
+	c.JSON(409, gin.H{"error": "Book is sold in variants; use the stock of one of its variants",
+		"variants": "/books/" + bookID + "/variants"})
+}
+
+// guardBookStock stops the first variant of a book being added while tx
+// changes the book's own stock, and returns errSoldInVariants if the book
+// has variants by now. Variant stock needs no guard.
+func guardBookStock(tx *sql.Tx, item stockItem) error {
+	if item.VariantID != "" {
+		return nil
+	}
+	var hasVariants bool
+	err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM book_variants v WHERE v.book_id = b.id)
+		FROM books b WHERE b.id = $1 FOR SHARE`, item.BookID).Scan(&hasVariants)
+	if err != nil {
+		return err
+	}
+	if hasVariants {
+		return errSoldInVariants
+	}
+	return nil
+}
+
+// newStock returns an empty stock level for item.
+func newStock(item stockItem) Stock {
+	s := Stock{BookID: item.BookID}
+	if item.VariantID != "" {
+		s.VariantID = &item.VariantID
+	}
+	return s
+}
+
+func getStock(c *gin.Context) {
+	item, ok := requestedStockItem(c, "Failed to fetch stock")
+	if !ok {
+		return
+	}
+
+	s := newStock(item)
+	where, arg := item.where()
+	err := db.QueryRow("SELECT on_hand, reserved, updated_at FROM inventory WHERE "+where, arg).
+		Scan(&s.OnHand, &s.Reserved, &s.UpdatedAt)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to fetch stock"})
+		return
+	}
+	s.Available = s.OnHand - s.Reserved
+	c.JSON(200, s)
+}
+
+// reserveStock holds copies of a book or variant. The inventory row is
+// locked with SELECT ... FOR UPDATE so concurrent reservations for the
+// same item are serialised and cannot oversell.
+func reserveStock(c *gin.Context) {
+	var req ReservationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if req.Quantity < 1 {
+		c.JSON(400, gin.H{"error": "quantity must be at least 1"})
+		return
+	}
+	limited := !hasPermission(c, permInventoryManage)
+	maxTTL := maxReservationTTL
+	if limited {
+		maxTTL = maxCustomerReservationTTL
+	}
+	ttl := defaultReservationTTL
+	if req.TTLSeconds != 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+		if ttl < minReservationTTL || ttl > maxTTL {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("ttl_seconds must be between %d and %d",
+				int(minReservationTTL.Seconds()), int(maxTTL.Seconds()))})
+			return
+		}
+	}
+
+	item, ok := requestedStockItem(c, "Failed to reserve stock")
+	if !ok {
+		return
+	}
+
+	username := c.GetString("username")
+	var r Reservation
+	err := inTx(func(tx *sql.Tx) error {
+		if err := guardBookStock(tx, item); err != nil {
+			return err
+		}
+		if limited {
+			// The lock serialises a customer's reservations so that
+			// concurrent ones cannot all pass the limit.
+			if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('reservations:' || $1))", username); err != nil {
+				return err
+			}
+			var active, held int
+			err := tx.QueryRow(`SELECT COUNT(*), COALESCE(SUM(quantity), 0) FROM stock_reservations
+				WHERE created_by = $1 AND status = 'pending' AND expires_at > now()`, username).Scan(&active, &held)
+			if err != nil {
+				return err
+			}
+			if err := checkReservationLimit(active, held, req.Quantity); err != nil {
+				return err
+			}
+		}
+		where, arg := item.where()
+		var onHand, reserved int
+		err := tx.QueryRow("SELECT on_hand, reserved FROM inventory WHERE "+where+" FOR UPDATE", arg).
+			Scan(&onHand, &reserved)
+		if err == sql.ErrNoRows {
+			return errInsufficientStock
+		}
+		if err != nil {
+			return err
+		}
+		if onHand-reserved < req.Quantity {
+			return errInsufficientStock
+		}
+
+		if _, err := tx.Exec("UPDATE inventory SET reserved = reserved + $2, updated_at = now() WHERE "+where, arg, req.Quantity); err != nil {
+			return err
+		}
+		return scanReservation(tx.QueryRow(`INSERT INTO stock_reservations (book_id, variant_id, quantity, reference, created_by, expires_at)
+			VALUES ($1, $2, $3, $4, $5, now() + $6 * interval '1 second')
+			RETURNING `+reservationColumns,
+			item.BookID, item.variantParam(), req.Quantity, req.Reference, username, int(ttl.Seconds())), &r)
+	})
+	if err != nil {
+		switch err {
+		case errInsufficientStock:
+			body := gin.H{"error": "Insufficient stock", "book_id": item.BookID}
+			if item.VariantID != "" {
+				body["variant_id"] = item.VariantID
+			}
+			c.JSON(409, body)
+		case errSoldInVariants:
+			respondSoldInVariants(c, item.BookID)
+		case errReservationLimit:
+			c.JSON(429, gin.H{"error": fmt.Sprintf("You may hold at most %d copies over %d pending reservations; "+
+				"commit or release some first", maxCustomerReservedCopies, maxCustomerReservations)})
+		default:
+			log.Printf("Database error: %v", err)
+			c.JSON(500, gin.H{"error": "Failed to reserve stock"})
+		}
+		return
+	}
+
+	c.JSON(201, r)
+}
+
+// checkReservationLimit reports errReservationLimit when a customer who
+// holds held copies over active pending reservations asks for quantity
+// more.
+func checkReservationLimit(active, held, quantity int) error {
+	if active+1 > maxCustomerReservations || held+quantity > maxCustomerReservedCopies {
+		return errReservationLimit
+	}
+	return nil
+}
+
+// canAccessReservation reports whether the caller may see and resolve r:
+// its creator or someone who manages inventory. Others are told it does
+// not exist, so reservation ids cannot be probed.
+func canAccessReservation(c *gin.Context, r Reservation) bool {
+	return r.CreatedBy == c.GetString("username") || hasPermission(c, permInventoryManage)
+}
+
+func getReservation(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(404, gin.H{"error": "Reservation not found"})
+		return
+	}
+
+	var r Reservation
+	err = scanReservation(db.QueryRow("SELECT "+reservationColumns+" FROM stock_reservations WHERE id = $1", id), &r)
+	if err == nil && !canAccessReservation(c, r) {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(404, gin.H{"error": "Reservation not found"})
+		} else {
+			log.Printf("Database error: %v", err)
+			c.JSON(500, gin.H{"error": "Failed to fetch reservation"})
+		}
+		return
+	}
+	c.JSON(200, r)
+}
+
+// commitReservation turns a pending reservation into a sale: the copies
+// leave both on_hand and reserved.
+func commitReservation(c *gin.Context) {
+	resolveReservation(c, "committed", "on_hand = on_hand - $2, reserved = reserved - $2")
+}
+
+// releaseReservation returns the reserved copies to the available pool.
+func releaseReservation(c *gin.Context) {
+	resolveReservation(c, "released", "reserved = reserved - $2")
+}
+
+// resolveReservation moves a pending reservation to status and applies
+// inventoryChange to the inventory row of the reserved item. The reservation row is
+// locked before the inventory row, matching the order used by the reaper.
+func resolveReservation(c *gin.Context, status, inventoryChange string) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(404, gin.H{"error": "Reservation not found"})
+		return
+	}
+
+	var r Reservation
+	err = inTx(func(tx *sql.Tx) error {
+		err := scanReservation(tx.QueryRow("SELECT "+reservationColumns+" FROM stock_reservations WHERE id = $1 FOR UPDATE", id), &r)
+		if err != nil {
+			return err
+		}
+		if !canAccessReservation(c, r) {
+			return sql.ErrNoRows
+		}
+		if r.Status != "pending" {
+			return errReservationClosed
+		}
+		if !r.ExpiresAt.After(time.Now()) {
+			// Leave the expiry to the reaper so its inventory bookkeeping
+			// stays in one place.
+			return errReservationExpired
+		}
+
+		where, arg := r.item().where()
+		if _, err := tx.Exec("UPDATE inventory SET "+inventoryChange+", updated_at = now() WHERE "+where, arg, r.Quantity); err != nil {
+			return err
+		}
+		return tx.QueryRow("UPDATE stock_reservations SET status = $2, resolved_at = now() WHERE id = $1 RETURNING status, resolved_at", id, status).
+			Scan(&r.Status, &r.ResolvedAt)
+	})
+	switch err {
+	case nil:
+		c.JSON(200, r)
+	case sql.ErrNoRows:
+		c.JSON(404, gin.H{"error": "Reservation not found"})
+	case errReservationClosed:
+		c.JSON(409, gin.H{"error": "Reservation is already " + r.Status, "reservation": r})
+	case errReservationExpired:
+		c.JSON(410, gin.H{"error": "Reservation has expired"})
+	default:
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to update reservation"})
+	}
+}
+
+// adjustStock records an admin change to the on-hand quantity together
+// with its reason. On-hand stock can never drop below what is reserved.
+func adjustStock(c *gin.Context) {
+	var adj StockAdjustment
+	if err := c.ShouldBindJSON(&adj); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if adj.Delta == 0 {
+		c.JSON(400, gin.H{"error": "delta must be non-zero"})
+		return
+	}
+	if !stockAdjustmentReasons[adj.Reason] {
+		c.JSON(400, gin.H{"error": "reason must be one of received, returned, damaged, lost, correction"})
+		return
+	}
+
+	item, ok := requestedStockItem(c, "Failed to adjust stock")
+	if !ok {
+		return
+	}
+
+	s := newStock(item)
+	adj.BookID, adj.VariantID = s.BookID, s.VariantID
+	adj.AdjustedBy = c.GetString("username")
+	err := inTx(func(tx *sql.Tx) error {
+		if err := guardBookStock(tx, item); err != nil {
+			return err
+		}
+		conflict := "(book_id) WHERE variant_id IS NULL"
+		if item.VariantID != "" {
+			conflict = "(variant_id) WHERE variant_id IS NOT NULL"
+		}
+		if _, err := tx.Exec("INSERT INTO inventory (book_id, variant_id) VALUES ($1, $2) ON CONFLICT "+conflict+" DO NOTHING",
+			item.BookID, item.variantParam()); err != nil {
+			return err
+		}
+		where, arg := item.where()
+		err := tx.QueryRow("SELECT on_hand, reserved FROM inventory WHERE "+where+" FOR UPDATE", arg).
+			Scan(&s.OnHand, &s.Reserved)
+		if err != nil {
+			return err
+		}
+		if s.OnHand+adj.Delta < s.Reserved {
+			return errInsufficientStock
+		}
+
+		err = tx.QueryRow("UPDATE inventory SET on_hand = on_hand + $2, updated_at = now() WHERE "+where+" RETURNING on_hand, reserved, updated_at", arg, adj.Delta).
+			Scan(&s.OnHand, &s.Reserved, &s.UpdatedAt)
+		if err != nil {
+			return err
+		}
+		return tx.QueryRow(`INSERT INTO stock_adjustments (book_id, variant_id, delta, reason, note, adjusted_by)
+			VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created_at`,
+			item.BookID, item.variantParam(), adj.Delta, adj.Reason, adj.Note, adj.AdjustedBy).Scan(&adj.ID, &adj.CreatedAt)
+	})
+	if err != nil {
+		switch err {
+		case errInsufficientStock:
+			c.JSON(409, gin.H{"error": "Adjustment would leave fewer copies on hand than are reserved", "on_hand": s.OnHand, "reserved": s.Reserved})
+		case errSoldInVariants:
+			respondSoldInVariants(c, item.BookID)
+		default:
+			log.Printf("Database error: %v", err)
+			c.JSON(500, gin.H{"error": "Failed to adjust stock"})
+		}
+		return
+	}
+
+	s.Available = s.OnHand - s.Reserved
+	c.JSON(201, gin.H{"adjustment": adj, "stock": s})
+}
+
+// listStockAdjustments returns the latest adjustments of a book's own
+// stock or of one of its variants.
+func listStockAdjustments(c *gin.Context) {
+	item := stockItem{BookID: c.Param("id"), VariantID: c.Param("variant_id")}
+	where, arg := item.where()
+	rows, err := db.Query(`SELECT id, book_id, variant_id, delta, reason, note, adjusted_by, created_at
+		FROM stock_adjustments WHERE `+where+` ORDER BY created_at DESC, id DESC LIMIT 100`, arg)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to fetch stock adjustments"})
+		return
+	}
+	defer rows.Close()
+
+	adjustments := []StockAdjustment{}
+	for rows.Next() {
+		var a StockAdjustment
+		if err := rows.Scan(&a.ID, &a.BookID, &a.VariantID, &a.Delta, &a.Reason, &a.Note, &a.AdjustedBy, &a.CreatedAt); err != nil {
+			log.Printf("Row scan error: %v", err)
+			continue
+		}
+		adjustments = append(adjustments, a)
+	}
+	c.JSON(200, adjustments)
+}
+
+// expireReservations releases every pending reservation past its expiry
+// in a single statement and returns how many were expired. SKIP LOCKED
+// leaves reservations that are being committed or released to their
+// owning transaction.
+func expireReservations() (int64, error) {
+	res, err := db.Exec(`WITH expired AS (
+			UPDATE stock_reservations SET status = 'expired', resolved_at = now()
+			WHERE id IN (
+				SELECT id FROM stock_reservations
+				WHERE status = 'pending' AND expires_at <= now()
+				ORDER BY expires_at
+				LIMIT 500
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING book_id, variant_id, quantity
+		)
+		UPDATE inventory i SET reserved = i.reserved - e.quantity, updated_at = now()
+		FROM (SELECT book_id, variant_id, SUM(quantity) AS quantity FROM expired GROUP BY book_id, variant_id) e
+		WHERE i.book_id = e.book_id AND i.variant_id IS NOT DISTINCT FROM e.variant_id`)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// startReservationReaper periodically expires stale reservations.
+func startReservationReaper() {
+	go func() {
+		ticker := time.NewTicker(reservationReapInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			n, err := expireReservations()
+			if err != nil {
+				log.Printf("Failed to expire reservations: %v", err)
+			} else if n > 0 {
+				log.Printf("Released stock for expired reservations on %d item(s)", n)
+			}
+		}
+	}()
+}
+
+// inTx runs fn in a transaction, committing if it returns nil.
+func inTx(fn func(*sql.Tx) error) error {
+	return withTx(db, fn)
+}
+
+// withTx runs fn in a transaction on conn, committing if it returns nil.
+func withTx(conn *sql.DB, fn func(*sql.Tx) error) error {
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"maps"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// memoryBookRepository is a BookRepository held in process memory, used
+// by the handler tests. Of the author links it only keeps the ones book
+// writes make, to the author keyed by match key. It does not track
+// categories, variants or series, so books have none of them and the
+// category filter matches nothing; search is a plain
+// case-insensitive prefix match.
+// Ratings are never set since reviews are not stored here, and no catalog
+// events are published. Prices are only shown in a book's own currency as
+// there are no list prices or exchange rates.
+type memoryBookRepository struct {
+	mu           sync.RWMutex
+	books        map[string]Book
+	contributors map[string][]BookContributor
+	now          func() time.Time
+}
+
+func newMemoryBookRepository() *memoryBookRepository {
+	return &memoryBookRepository{books: map[string]Book{}, contributors: map[string][]BookContributor{}, now: time.Now}
+}
+
+// cloneBook copies b so that callers cannot reach stored values through
+// its pointer fields.
+func cloneBook(b Book) Book {
+	if b.PriceMinor != nil {
+		v := *b.PriceMinor
+		b.PriceMinor = &v
+	}
+	if b.PublicationDate != nil {
+		v := *b.PublicationDate
+		b.PublicationDate = &v
+	}
+	if b.PageCount != nil {
+		v := *b.PageCount
+		b.PageCount = &v
+	}
+	if b.DeletedAt != nil {
+		v := *b.DeletedAt
+		b.DeletedAt = &v
+	}
+	if b.RatingAverage != nil {
+		v := *b.RatingAverage
+		b.RatingAverage = &v
+	}
+	b.Contributors, b.Categories, b.Prices, b.Variants, b.Series, b.DisplayPrice = nil, nil, nil, nil, nil, nil
+	return b
+}
+
+// isbnTaken reports whether a live book other than id uses isbn. Callers
+// must hold mu.
+func (r *memoryBookRepository) isbnTaken(isbn, id string) bool {
+	if isbn == "" {
+		return false
+	}
+	for _, other := range r.books {
+		if other.ID != id && other.DeletedAt == nil && other.ISBN == isbn {
+			return true
+		}
+	}
+	return false
+}
+
+// syncAuthor stands in for syncPrimaryAuthor, replacing the "author"
+// links of a book with one to the author of name. Callers must hold mu.
+func (r *memoryBookRepository) syncAuthor(bookID, name string) {
+	key := authorMatchKey(name)
+	links := []BookContributor{}
+	linked := false
+	for _, bc := range r.contributors[bookID] {
+		if bc.Role == "author" && bc.AuthorID != key {
+			continue
+		}
+		linked = linked || bc.Role == "author"
+		links = append(links, bc)
+	}
+	if !linked {
+		links = append(links, BookContributor{AuthorID: key, Name: name, Role: "author"})
+	}
+	r.contributors[bookID] = links
+}
+
+func (r *memoryBookRepository) Create(b *Book) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.books[b.ID]; ok {
+		return errDuplicateBookID
+	}
+	if r.isbnTaken(b.ISBN, b.ID) {
+		return errDuplicateISBN
+	}
+	now := r.now().UTC()
+	b.Version, b.CreatedAt, b.UpdatedAt = 1, now, now
+	b.DeletedAt, b.DeletedBy = nil, ""
+	r.books[b.ID] = cloneBook(*b)
+	r.syncAuthor(b.ID, b.Author)
+	return nil
+}
+
+func (r *memoryBookRepository) Get(id string, includeDeleted bool) (Book, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	b, ok := r.books[id]
+	if !ok || (b.DeletedAt != nil && !includeDeleted) {
+		return Book{}, errBookNotFound
+	}
+	return cloneBook(b), nil
+}
+
+func (r *memoryBookRepository) LoadRelations(b *Book) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	b.Contributors = append([]BookContributor{}, r.contributors[b.ID]...)
+	return nil
+}
+
+func (r *memoryBookRepository) LocalizePrices(books []Book, currency string) error {
+	for i := range books {
+		price, err := displayPrice(books[i], currency, nil, nil)
+		if err != nil {
+			return err
+		}
+		books[i].DisplayPrice = price
+	}
+	return nil
+}
+
+// compareSortValues orders two cursor values of a sort field the way
+// Postgres orders the underlying column.
+func compareSortValues(field, a, b string) int {
+	switch field {
+	case "price":
+		x, _ := strconv.ParseInt(a, 10, 64)
+		y, _ := strconv.ParseInt(b, 10, 64)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	case "rating":
+		x, _ := strconv.ParseFloat(a, 64)
+		y, _ := strconv.ParseFloat(b, 64)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	case "created_at":
+		x, _ := time.Parse(time.RFC3339Nano, a)
+		y, _ := time.Parse(time.RFC3339Nano, b)
+		return x.Compare(y)
+	}
+	return strings.Compare(a, b)
+}
+
+func (r *memoryBookRepository) List(q bookListQuery) (BookPage, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	// position compares a book against a (value, id) key in sort order.
+	position := func(b Book, value, id string) int {
+		cmp := compareSortValues(q.Sort.Field, q.Sort.value(b), value)
+		if cmp == 0 {
+			cmp = strings.Compare(b.ID, id)
+		}
+		if q.Sort.Desc {
+			cmp = -cmp
+		}
+		return cmp
+	}
+
+	var matched []Book
+	for _, b := range r.books {
+		if b.DeletedAt != nil ||
+			(q.Author != "" && !strings.EqualFold(b.Author, q.Author)) ||
+			(q.TitlePrefix != "" && !strings.HasPrefix(strings.ToLower(b.Title), strings.ToLower(q.TitlePrefix))) ||
+			q.Category != "" {
+			continue
+		}
+		matched = append(matched, b)
+	}
+	total := len(matched)
+
+	sort.Slice(matched, func(i, j int) bool {
+		return position(matched[i], q.Sort.value(matched[j]), matched[j].ID) < 0
+	})
+
+	rows := []Book{}
+	for _, b := range matched {
+		if q.Cursor != nil && position(b, q.Cursor.Value, q.Cursor.ID) <= 0 {
+			continue
+		}
+		rows = append(rows, cloneBook(b))
+		if len(rows) > q.Limit {
+			break
+		}
+	}
+
+	page := newBookPage(q, rows)
+	if q.IncludeTotal {
+		page.Total = &total
+	}
+	return page, nil
+}
+
+func (r *memoryBookRepository) Update(b *Book) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.books[b.ID]
+	if !ok || stored.DeletedAt != nil {
+		return errBookNotFound
+	}
+	if stored.Version != b.Version {
+		return errBookVersionConflict
+	}
+	if r.isbnTaken(b.ISBN, b.ID) {
+		return errDuplicateISBN
+	}
+	b.Version = stored.Version + 1
+	b.CreatedAt, b.UpdatedAt = stored.CreatedAt, r.now().UTC()
+	b.DeletedAt, b.DeletedBy = nil, ""
+	r.books[b.ID] = cloneBook(*b)
+	if authorMatchKey(b.Author) != authorMatchKey(stored.Author) {
+		r.syncAuthor(b.ID, b.Author)
+	}
+	return nil
+}
+
+func (r *memoryBookRepository) Delete(id, deletedBy string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b, ok := r.books[id]
+	if !ok || b.DeletedAt != nil {
+		return errBookNotFound
+	}
+	now := r.now().UTC()
+	b.DeletedAt, b.DeletedBy = &now, deletedBy
+	b.Version++
+	b.UpdatedAt = now
+	r.books[id] = b
+	return nil
+}
+
+func (r *memoryBookRepository) Restore(id string) (Book, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b, ok := r.books[id]
+	if !ok || b.DeletedAt == nil {
+		return Book{}, errBookNotFound
+	}
+	if r.isbnTaken(b.ISBN, b.ID) {
+		return Book{}, errDuplicateISBN
+	}
+	b.DeletedAt, b.DeletedBy = nil, ""
+	b.Version++
+	b.UpdatedAt = r.now().UTC()
+	r.books[id] = b
+	return cloneBook(b), nil
+}
+
+func (r *memoryBookRepository) ListTrash(limit, offset int) ([]Book, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var trash []Book
+	for _, b := range r.books {
+		if b.DeletedAt != nil {
+			trash = append(trash, cloneBook(b))
+		}
+	}
+	sort.Slice(trash, func(i, j int) bool {
+		if !trash[i].DeletedAt.Equal(*trash[j].DeletedAt) {
+			return trash[i].DeletedAt.After(*trash[j].DeletedAt)
+		}
+		return trash[i].ID < trash[j].ID
+	})
+
+	books := []Book{}
+	if offset < len(trash) {
+		books = trash[offset:min(offset+limit, len(trash))]
+	}
+	return books, nil
+}
+
+// Import applies the rows one by one; with dryRun they are applied to a
+// copy of the store that is then dropped.
+func (r *memoryBookRepository) Import(rows []importRow, restore, dryRun bool) ([]ImportRowResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	live, liveContributors := r.books, r.contributors
+	if dryRun {
+		r.books, r.contributors = maps.Clone(live), maps.Clone(liveContributors)
+		defer func() { r.books, r.contributors = live, liveContributors }()
+	}
+
+	results := make([]ImportRowResult, 0, len(rows))
+	for _, row := range rows {
+		var stored *Book
+		if existing, ok := r.books[row.book.ID]; ok {
+			stored = &existing
+		}
+		b, errs, err := importBook(row, stored, restore)
+		if err == nil && errs == nil && r.isbnTaken(b.ISBN, b.ID) {
+			err = errDuplicateISBN
+		}
+		if err == nil && errs == nil {
+			now := r.now().UTC()
+			if stored == nil {
+				b.Version, b.CreatedAt = 1, now
+			} else {
+				b.Version++
+			}
+			b.UpdatedAt, b.DeletedAt, b.DeletedBy = now, nil, ""
+			r.books[b.ID] = cloneBook(b)
+			if stored == nil || authorMatchKey(b.Author) != authorMatchKey(stored.Author) {
+				r.syncAuthor(b.ID, b.Author)
+			}
+		}
+		results = append(results, importResult(row, stored == nil, errs, err))
+	}
+	return results, nil
+}
+
+// Stats groups authors by match key, the in-memory stand-in for author
+// identity. AuthorID carries the match key.
+func (r *memoryBookRepository) Stats() (BookStats, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	stats := BookStats{TopAuthors: []AuthorStats{}, LastUpdated: r.now()}
+	byKey := map[string]*AuthorStats{}
+	for _, b := range r.books {
+		if b.DeletedAt != nil {
+			continue
+		}
+		stats.TotalBooks++
+		key := authorMatchKey(b.Author)
+		if stat, ok := byKey[key]; ok {
+			stat.Count++
+		} else {
+			byKey[key] = &AuthorStats{AuthorID: key, Author: b.Author, Count: 1}
+		}
+	}
+	for _, stat := range byKey {
+		stats.TopAuthors = append(stats.TopAuthors, *stat)
+	}
+	sort.Slice(stats.TopAuthors, func(i, j int) bool {
+		a, b := stats.TopAuthors[i], stats.TopAuthors[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Author < b.Author
+	})
+	if len(stats.TopAuthors) > 10 {
+		stats.TopAuthors = stats.TopAuthors[:10]
+	}
+	return stats, nil
+}
+
+// Search matches books where every query term is a prefix of a word in
+// the title, author or description, ranked by the number of words hit.
+func (r *memoryBookRepository) Search(q string, limit int) (string, []SearchResult, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	split := func(s string) []string {
+		return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+	}
+	terms := split(q)
+
+	results := []SearchResult{}
+	for _, b := range r.books {
+		if b.DeletedAt != nil || len(terms) == 0 {
+			continue
+		}
+		words := split(b.Title + " " + b.Author + " " + b.Description)
+		hits := 0
+		for _, term := range terms {
+			found := false
+			for _, w := range words {
+				if strings.HasPrefix(w, term) {
+					found = true
+					hits++
+				}
+			}
+			if !found {
+				hits = 0
+				break
+			}
+		}
+		if hits > 0 {
+			results = append(results, SearchResult{Book: cloneBook(b), Rank: float64(hits)})
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Rank != results[j].Rank {
+			return results[i].Rank > results[j].Rank
+		}
+		return results[i].Book.ID < results[j].Book.ID
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return "fulltext", results, nil
+}
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS books (
+    id     TEXT PRIMARY KEY,
+    title  TEXT NOT NULL,
+    author TEXT NOT NULL
+);
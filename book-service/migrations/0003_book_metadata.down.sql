@@ -0,0 +1,12 @@
+DROP INDEX IF EXISTS books_isbn_key;
+
+ALTER TABLE books
+    DROP COLUMN IF EXISTS isbn,
+    DROP COLUMN IF EXISTS price_minor,
+    DROP COLUMN IF EXISTS currency,
+    DROP COLUMN IF EXISTS description,
+    DROP COLUMN IF EXISTS publisher,
+    DROP COLUMN IF EXISTS publication_date,
+    DROP COLUMN IF EXISTS language,
+    DROP COLUMN IF EXISTS page_count,
+    DROP COLUMN IF EXISTS format;
@@ -0,0 +1,12 @@
+ALTER TABLE books
+    ADD COLUMN IF NOT EXISTS isbn             TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS price_minor      BIGINT,
+    ADD COLUMN IF NOT EXISTS currency         TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS description      TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS publisher        TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS publication_date DATE,
+    ADD COLUMN IF NOT EXISTS language         TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS page_count       INTEGER,
+    ADD COLUMN IF NOT EXISTS format           TEXT NOT NULL DEFAULT '';
+
+CREATE UNIQUE INDEX IF NOT EXISTS books_isbn_key ON books (isbn) WHERE isbn <> '';
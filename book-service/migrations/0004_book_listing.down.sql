@@ -0,0 +1,10 @@
+DROP INDEX IF EXISTS books_lower_title_prefix_idx;
+DROP INDEX IF EXISTS books_lower_author_idx;
+DROP INDEX IF EXISTS books_price_id_idx;
+DROP INDEX IF EXISTS books_created_at_id_idx;
+DROP INDEX IF EXISTS books_author_id_idx;
+DROP INDEX IF EXISTS books_title_id_idx;
+
+ALTER TABLE books
+    DROP COLUMN IF EXISTS updated_at,
+    DROP COLUMN IF EXISTS created_at;
@@ -0,0 +1,13 @@
+ALTER TABLE books
+    ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+-- Keyset pagination indexes: one per sort key, with id as the tie-breaker.
+CREATE INDEX IF NOT EXISTS books_title_id_idx ON books (title, id);
+CREATE INDEX IF NOT EXISTS books_author_id_idx ON books (author, id);
+CREATE INDEX IF NOT EXISTS books_created_at_id_idx ON books (created_at, id);
+CREATE INDEX IF NOT EXISTS books_price_id_idx ON books ((COALESCE(price_minor, 9223372036854775807)), id);
+
+-- Filters: case-insensitive author match and title prefix.
+CREATE INDEX IF NOT EXISTS books_lower_author_idx ON books (lower(author));
+CREATE INDEX IF NOT EXISTS books_lower_title_prefix_idx ON books (lower(title) text_pattern_ops);
@@ -0,0 +1,35 @@
+CREATE TABLE IF NOT EXISTS inventory (
+    book_id    TEXT PRIMARY KEY REFERENCES books (id) ON DELETE CASCADE,
+    on_hand    INTEGER NOT NULL DEFAULT 0 CHECK (on_hand >= 0),
+    reserved   INTEGER NOT NULL DEFAULT 0 CHECK (reserved >= 0),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CHECK (reserved <= on_hand)
+);
+
+CREATE TABLE IF NOT EXISTS stock_reservations (
+    id          BIGSERIAL PRIMARY KEY,
+    book_id     TEXT NOT NULL REFERENCES books (id) ON DELETE CASCADE,
+    quantity    INTEGER NOT NULL CHECK (quantity > 0),
+    status      TEXT NOT NULL DEFAULT 'pending'
+                CHECK (status IN ('pending', 'committed', 'released', 'expired')),
+    reference   TEXT NOT NULL DEFAULT '',
+    created_by  TEXT NOT NULL DEFAULT '',
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at  TIMESTAMPTZ NOT NULL,
+    resolved_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS stock_reservations_pending_expiry_idx
+    ON stock_reservations (expires_at) WHERE status = 'pending';
+
+CREATE TABLE IF NOT EXISTS stock_adjustments (
+    id          BIGSERIAL PRIMARY KEY,
+    book_id     TEXT NOT NULL REFERENCES books (id) ON DELETE CASCADE,
+    delta       INTEGER NOT NULL CHECK (delta <> 0),
+    reason      TEXT NOT NULL,
+    note        TEXT NOT NULL DEFAULT '',
+    adjusted_by TEXT NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS stock_adjustments_book_idx ON stock_adjustments (book_id, created_at);
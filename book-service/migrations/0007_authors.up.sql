@@ -0,0 +1,53 @@
+CREATE TABLE IF NOT EXISTS authors (
+    id         TEXT PRIMARY KEY,
+    name       TEXT NOT NULL,
+    biography  TEXT NOT NULL DEFAULT '',
+    aliases    TEXT[] NOT NULL DEFAULT '{}',
+    -- Normalised forms of name and aliases (lower case, letters and digits
+    -- only) used to resolve free-text author names to an author.
+    match_keys TEXT[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS authors_match_keys_idx ON authors USING GIN (match_keys);
+CREATE INDEX IF NOT EXISTS authors_lower_name_idx ON authors (lower(name));
+
+CREATE TABLE IF NOT EXISTS book_authors (
+    book_id   TEXT NOT NULL REFERENCES books (id) ON DELETE CASCADE,
+    author_id TEXT NOT NULL REFERENCES authors (id) ON DELETE RESTRICT,
+    role      TEXT NOT NULL DEFAULT 'author'
+              CHECK (role IN ('author', 'editor', 'translator', 'illustrator', 'narrator')),
+    position  INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (book_id, author_id, role)
+);
+
+CREATE INDEX IF NOT EXISTS book_authors_author_idx ON book_authors (author_id, role);
+
+-- Turn the existing free-text authors into author records. Spellings that
+-- only differ in case, spacing or punctuation ("J.K. Rowling" and
+-- "J. K. Rowling") collapse into one author named after the most common
+-- spelling.
+WITH spellings AS (
+    SELECT author, regexp_replace(lower(author), '[^[:alnum:]]', '', 'g') AS key, COUNT(*) AS n
+    FROM books
+    WHERE btrim(author) <> ''
+    GROUP BY author
+), ranked AS (
+    SELECT key, author, ROW_NUMBER() OVER (PARTITION BY key ORDER BY n DESC, author) AS rn
+    FROM spellings
+    WHERE key <> ''
+)
+INSERT INTO authors (id, name, aliases, match_keys)
+SELECT 'mig-' || md5(r.key), r.author,
+       ARRAY(SELECT s.author FROM spellings s WHERE s.key = r.key AND s.author <> r.author ORDER BY s.author),
+       ARRAY[r.key]
+FROM ranked r
+WHERE r.rn = 1
+ON CONFLICT (id) DO NOTHING;
+
+INSERT INTO book_authors (book_id, author_id, role)
+SELECT b.id, 'mig-' || md5(regexp_replace(lower(b.author), '[^[:alnum:]]', '', 'g')), 'author'
+FROM books b
+WHERE regexp_replace(lower(b.author), '[^[:alnum:]]', '', 'g') <> ''
+ON CONFLICT DO NOTHING;
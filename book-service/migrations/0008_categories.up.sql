@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS categories (
+    id         TEXT PRIMARY KEY,
+    parent_id  TEXT REFERENCES categories (id) ON DELETE RESTRICT,
+    name       TEXT NOT NULL,
+    slug       TEXT NOT NULL,
+    position   INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CHECK (parent_id IS NULL OR parent_id <> id)
+);
+
+-- Sibling slugs are unique; root categories share the '' parent key.
+CREATE UNIQUE INDEX IF NOT EXISTS categories_parent_slug_key ON categories ((COALESCE(parent_id, '')), slug);
+CREATE INDEX IF NOT EXISTS categories_parent_idx ON categories (parent_id, position);
+
+CREATE TABLE IF NOT EXISTS book_categories (
+    book_id     TEXT NOT NULL REFERENCES books (id) ON DELETE CASCADE,
+    category_id TEXT NOT NULL REFERENCES categories (id) ON DELETE CASCADE,
+    PRIMARY KEY (book_id, category_id)
+);
+
+CREATE INDEX IF NOT EXISTS book_categories_category_idx ON book_categories (category_id, book_id);
@@ -0,0 +1,10 @@
+DELETE FROM books WHERE deleted_at IS NOT NULL;
+
+DROP INDEX IF EXISTS books_isbn_key;
+CREATE UNIQUE INDEX books_isbn_key ON books (isbn) WHERE isbn <> '';
+
+DROP INDEX IF EXISTS books_deleted_at_idx;
+
+ALTER TABLE books
+    DROP COLUMN IF EXISTS deleted_by,
+    DROP COLUMN IF EXISTS deleted_at;
@@ -0,0 +1,10 @@
+-- Cover image metadata; the image bytes live in the blob store.
+CREATE TABLE IF NOT EXISTS book_covers (
+    book_id      TEXT PRIMARY KEY REFERENCES books (id) ON DELETE CASCADE,
+    content_type TEXT NOT NULL,
+    width        INTEGER NOT NULL,
+    height       INTEGER NOT NULL,
+    size_bytes   BIGINT NOT NULL,
+    checksum     TEXT NOT NULL,
+    updated_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+);
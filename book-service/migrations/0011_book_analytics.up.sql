@@ -0,0 +1,35 @@
+-- One row per live book with the attributes the analytics endpoint groups
+-- by. Refreshed periodically by the service, so reads never touch the
+-- base tables.
+CREATE MATERIALIZED VIEW IF NOT EXISTS book_analytics AS
+WITH RECURSIVE roots AS (
+    SELECT id, id AS root_id FROM categories WHERE parent_id IS NULL
+    UNION ALL
+    SELECT c.id, r.root_id FROM categories c JOIN roots r ON c.parent_id = r.id
+)
+SELECT
+    b.id AS book_id,
+    b.title,
+    b.author,
+    b.created_at,
+    b.language,
+    CASE
+        WHEN b.price_minor IS NULL THEN 'unpriced'
+        WHEN b.price_minor < 1000 THEN 'under_10'
+        WHEN b.price_minor < 2500 THEN '10_to_25'
+        WHEN b.price_minor < 5000 THEN '25_to_50'
+        ELSE '50_and_over'
+    END AS price_band,
+    COALESCE((SELECT array_agg(DISTINCT r.root_id)
+              FROM book_categories bc JOIN roots r ON r.id = bc.category_id
+              WHERE bc.book_id = b.id), '{}') AS genre_ids,
+    COALESCE((SELECT SUM(sr.quantity)
+              FROM stock_reservations sr
+              WHERE sr.book_id = b.id AND sr.status = 'committed'), 0) AS copies_ordered,
+    now() AS refreshed_at
+FROM books b
+WHERE b.deleted_at IS NULL;
+
+-- Required by REFRESH MATERIALIZED VIEW CONCURRENTLY.
+CREATE UNIQUE INDEX IF NOT EXISTS book_analytics_book_id_key ON book_analytics (book_id);
+CREATE INDEX IF NOT EXISTS book_analytics_created_at_idx ON book_analytics (created_at);
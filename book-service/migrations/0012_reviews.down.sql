@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS books_rating_idx;
+
+ALTER TABLE books
+    DROP COLUMN IF EXISTS rating_average,
+    DROP COLUMN IF EXISTS rating_count;
+
+DROP TABLE IF EXISTS reviews;
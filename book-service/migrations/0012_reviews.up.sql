@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS reviews (
+    id         BIGSERIAL PRIMARY KEY,
+    book_id    TEXT NOT NULL REFERENCES books (id) ON DELETE CASCADE,
+    username   TEXT NOT NULL,
+    rating     SMALLINT NOT NULL CHECK (rating BETWEEN 1 AND 5),
+    title      TEXT NOT NULL DEFAULT '',
+    body       TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (book_id, username)
+);
+
+CREATE INDEX IF NOT EXISTS reviews_book_created_idx ON reviews (book_id, created_at DESC, id DESC);
+
+-- Aggregates kept in step with reviews so that listings can sort by rating.
+ALTER TABLE books
+    ADD COLUMN IF NOT EXISTS rating_count INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS rating_average NUMERIC(3, 2);
+
+CREATE INDEX IF NOT EXISTS books_rating_idx ON books ((COALESCE(rating_average, 0)), id);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS book_copurchases;
+DROP TABLE IF EXISTS purchases;
@@ -0,0 +1,21 @@
+-- Purchases seen on the order_events stream, one row per order. Book ids
+-- are not foreign keys: events may name books that were since purged.
+CREATE TABLE IF NOT EXISTS purchases (
+    order_id   TEXT PRIMARY KEY,
+    book_id    TEXT NOT NULL,
+    username   TEXT NOT NULL,
+    ordered_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS purchases_username_idx ON purchases (username, book_id);
+CREATE INDEX IF NOT EXISTS purchases_book_idx ON purchases (book_id);
+
+-- Symmetric co-purchase matrix: how many customers bought both books.
+CREATE TABLE IF NOT EXISTS book_copurchases (
+    book_id       TEXT NOT NULL,
+    other_book_id TEXT NOT NULL,
+    customers     INTEGER NOT NULL CHECK (customers > 0),
+    PRIMARY KEY (book_id, other_book_id)
+);
+
+CREATE INDEX IF NOT EXISTS book_copurchases_rank_idx ON book_copurchases (book_id, customers DESC);
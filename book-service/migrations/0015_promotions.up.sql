@@ -0,0 +1,41 @@
+-- Promotions discount book prices. scope_id names a book, author or
+-- category (genre promotions cover its whole subtree) and is empty for
+-- catalog-wide promotions; it is not a foreign key since it points into
+-- different tables depending on scope.
+CREATE TABLE IF NOT EXISTS promotions (
+    id              TEXT PRIMARY KEY,
+    name            TEXT NOT NULL,
+    kind            TEXT NOT NULL CHECK (kind IN ('percentage', 'fixed')),
+    value           BIGINT NOT NULL CHECK (value > 0),
+    currency        TEXT NOT NULL DEFAULT '',
+    scope           TEXT NOT NULL CHECK (scope IN ('book', 'author', 'genre', 'catalog')),
+    scope_id        TEXT NOT NULL DEFAULT '',
+    stacking        TEXT NOT NULL DEFAULT 'exclusive' CHECK (stacking IN ('exclusive', 'stackable')),
+    code            TEXT UNIQUE,
+    max_redemptions INTEGER CHECK (max_redemptions > 0),
+    per_user_limit  INTEGER CHECK (per_user_limit > 0),
+    redemptions     INTEGER NOT NULL DEFAULT 0,
+    starts_at       TIMESTAMPTZ NOT NULL,
+    ends_at         TIMESTAMPTZ,
+    active          BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CHECK (kind <> 'percentage' OR value <= 100),
+    CHECK (ends_at IS NULL OR ends_at > starts_at)
+);
+
+CREATE INDEX IF NOT EXISTS promotions_scope_idx ON promotions (scope, scope_id) WHERE active;
+
+-- One row per promotion applied to an order, recorded at checkout.
+CREATE TABLE IF NOT EXISTS promotion_redemptions (
+    promotion_id   TEXT NOT NULL REFERENCES promotions (id) ON DELETE CASCADE,
+    order_id       TEXT NOT NULL,
+    username       TEXT NOT NULL,
+    book_id        TEXT NOT NULL,
+    discount_minor BIGINT NOT NULL,
+    redeemed_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (promotion_id, order_id)
+);
+
+CREATE INDEX IF NOT EXISTS promotion_redemptions_user_idx ON promotion_redemptions (promotion_id, username);
+CREATE INDEX IF NOT EXISTS promotion_redemptions_order_idx ON promotion_redemptions (order_id);
@@ -0,0 +1,25 @@
+-- List prices of a book in currencies other than its own. A book's
+-- price_minor/currency remains its base price.
+CREATE TABLE IF NOT EXISTS book_prices (
+    book_id     TEXT NOT NULL REFERENCES books (id) ON DELETE CASCADE,
+    currency    TEXT NOT NULL CHECK (currency ~ '^[A-Z]{3}$'),
+    price_minor BIGINT NOT NULL CHECK (price_minor >= 0),
+    PRIMARY KEY (book_id, currency)
+);
+
+CREATE INDEX IF NOT EXISTS book_prices_currency_idx ON book_prices (currency, book_id);
+
+-- Admin-maintained exchange rates: one unit of base buys rate units of
+-- quote from effective_from until the next rate for the pair takes over.
+CREATE TABLE IF NOT EXISTS exchange_rates (
+    base           TEXT NOT NULL CHECK (base ~ '^[A-Z]{3}$'),
+    quote          TEXT NOT NULL CHECK (quote ~ '^[A-Z]{3}$'),
+    rate           NUMERIC(20, 10) NOT NULL CHECK (rate > 0),
+    effective_from DATE NOT NULL,
+    created_at     TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at     TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (base, quote, effective_from),
+    CHECK (base <> quote)
+);
+
+CREATE INDEX IF NOT EXISTS exchange_rates_quote_idx ON exchange_rates (quote, base, effective_from DESC);
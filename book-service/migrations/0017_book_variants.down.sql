@@ -0,0 +1,15 @@
+DROP INDEX IF EXISTS stock_adjustments_variant_idx;
+DROP INDEX IF EXISTS inventory_variant_key;
+DROP INDEX IF EXISTS inventory_book_key;
+
+-- Variant stock has no book-level equivalent and is discarded.
+DELETE FROM stock_adjustments WHERE variant_id IS NOT NULL;
+DELETE FROM stock_reservations WHERE variant_id IS NOT NULL;
+DELETE FROM inventory WHERE variant_id IS NOT NULL;
+
+ALTER TABLE stock_adjustments DROP COLUMN IF EXISTS variant_id;
+ALTER TABLE stock_reservations DROP COLUMN IF EXISTS variant_id;
+ALTER TABLE inventory DROP COLUMN IF EXISTS variant_id;
+ALTER TABLE inventory ADD PRIMARY KEY (book_id);
+
+DROP TABLE IF EXISTS book_variants;
@@ -0,0 +1,30 @@
+-- Sellable editions of a book (hardcover, ebook, ...). A variant without
+-- a price sells at the book's price.
+CREATE TABLE IF NOT EXISTS book_variants (
+    id          TEXT PRIMARY KEY,
+    book_id     TEXT NOT NULL REFERENCES books (id) ON DELETE CASCADE,
+    sku         TEXT NOT NULL UNIQUE,
+    format      TEXT NOT NULL,
+    isbn        TEXT NOT NULL DEFAULT '',
+    price_minor BIGINT CHECK (price_minor >= 0),
+    currency    TEXT NOT NULL DEFAULT '',
+    status      TEXT NOT NULL DEFAULT 'available'
+                CHECK (status IN ('available', 'preorder', 'discontinued')),
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS book_variants_book_idx ON book_variants (book_id, created_at);
+CREATE UNIQUE INDEX IF NOT EXISTS book_variants_isbn_key ON book_variants (isbn) WHERE isbn <> '';
+
+-- Stock is kept per variant for books sold in variants and per book
+-- otherwise. A variant with stock history cannot be deleted.
+ALTER TABLE inventory ADD COLUMN IF NOT EXISTS variant_id TEXT REFERENCES book_variants (id);
+ALTER TABLE stock_reservations ADD COLUMN IF NOT EXISTS variant_id TEXT REFERENCES book_variants (id);
+ALTER TABLE stock_adjustments ADD COLUMN IF NOT EXISTS variant_id TEXT REFERENCES book_variants (id);
+
+ALTER TABLE inventory DROP CONSTRAINT IF EXISTS inventory_pkey;
+CREATE UNIQUE INDEX IF NOT EXISTS inventory_book_key ON inventory (book_id) WHERE variant_id IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS inventory_variant_key ON inventory (variant_id) WHERE variant_id IS NOT NULL;
+CREATE INDEX IF NOT EXISTS stock_adjustments_variant_idx ON stock_adjustments (variant_id, created_at)
+    WHERE variant_id IS NOT NULL;
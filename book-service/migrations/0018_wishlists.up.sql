@@ -0,0 +1,24 @@
+-- Named lists of books a customer saved for later. share_token, when set,
+-- opens a read-only public view of the list.
+CREATE TABLE IF NOT EXISTS wishlists (
+    id          TEXT PRIMARY KEY,
+    username    TEXT NOT NULL,
+    name        TEXT NOT NULL,
+    share_token TEXT UNIQUE,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS wishlists_username_name_key ON wishlists (username, lower(name));
+
+-- Items keep the title and author the book had when it was saved and do
+-- not reference books, so that they outlive the book being purged and can
+-- be shown as unavailable.
+CREATE TABLE IF NOT EXISTS wishlist_items (
+    wishlist_id TEXT NOT NULL REFERENCES wishlists (id) ON DELETE CASCADE,
+    book_id     TEXT NOT NULL,
+    title       TEXT NOT NULL,
+    author      TEXT NOT NULL,
+    added_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (wishlist_id, book_id)
+);
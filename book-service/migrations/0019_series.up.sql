@@ -0,0 +1,24 @@
+-- A series is an ordered run of books. total_books is the planned length
+-- ("book 3 of 7") when more books are announced than are in the catalog.
+CREATE TABLE IF NOT EXISTS series (
+    id          TEXT PRIMARY KEY,
+    name        TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    total_books INTEGER CHECK (total_books > 0),
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS series_lower_name_idx ON series (lower(name));
+
+-- Positions give the reading order. Fractional positions (2.5) place
+-- novellas and short stories between the main books; 0 is a prequel.
+CREATE TABLE IF NOT EXISTS series_books (
+    series_id TEXT NOT NULL REFERENCES series (id) ON DELETE CASCADE,
+    book_id   TEXT NOT NULL REFERENCES books (id) ON DELETE CASCADE,
+    position  NUMERIC(8, 2) NOT NULL CHECK (position >= 0),
+    PRIMARY KEY (series_id, book_id),
+    CONSTRAINT series_books_position_key UNIQUE (series_id, position)
+);
+
+CREATE INDEX IF NOT EXISTS series_books_book_idx ON series_books (book_id);
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/streadway/amqp"
+)
+
+// Catalog change events, published to the bookEventsExchange topic
+// exchange with the event type as routing key. book.updated also covers
+// restores from the trash, so consumers should treat it as an upsert.
+const (
+	bookEventsExchange = "book_events"
+
+	bookCreatedEvent = "book.created"
+	bookUpdatedEvent = "book.updated"
+	bookDeletedEvent = "book.deleted"
+)
+
+const (
+	outboxBatchSize    = 100
+	outboxPollInterval = time.Second
+	outboxRetention    = 7 * 24 * time.Hour
+	outboxPruneEvery   = time.Hour
+)
+
+// BookEvent is the body of a catalog change message. Book is the state of
+// the book right after the change, without its contributors or categories.
+// Delivery is at least once and not strictly ordered, so consumers should
+// dedupe on EventID and ignore events older than the book version they
+// hold. Category changes do not bump the version and are sent with the
+// current one.
+type BookEvent struct {
+	EventID    string    `json:"event_id"`
+	Type       string    `json:"type"`
+	BookID     string    `json:"book_id"`
+	OccurredAt time.Time `json:"occurred_at"`
+	Book       Book      `json:"book"`
+}
+
+// enqueueBookEvent records an event about bookID in the outbox as part of
+// tx, so that it is published if and only if tx commits.
+func enqueueBookEvent(tx *sql.Tx, eventType, bookID string) error {
+	e := BookEvent{EventID: newID(), Type: eventType, BookID: bookID, OccurredAt: time.Now().UTC()}
+	if err := scanBook(tx.QueryRow("SELECT "+bookColumns+" FROM books WHERE id = $1", bookID), &e.Book); err != nil {
+		return err
+	}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO outbox_events (event_id, routing_key, payload) VALUES ($1, $2, $3)",
+		e.EventID, eventType, payload)
+	return err
+}
+
+// enqueueBookEvents records a book.updated event for every book selected
+// by query, which returns book ids. It serves changes to shared records,
+// such as authors and categories, that show up on many books at once.
+func enqueueBookEvents(tx *sql.Tx, query string, args ...interface{}) error {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := enqueueBookEvent(tx, bookUpdatedEvent, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// publishOutbox publishes the oldest pending events and marks them as
+// published, returning how many it sent. Rows are locked with SKIP LOCKED
+// so that several replicas can relay side by side.
+func publishOutbox(ch *amqp.Channel, confirms <-chan amqp.Confirmation) (int, error) {
+	var published pq.Int64Array
+	err := inTx(func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT id, event_id, routing_key, payload, created_at FROM outbox_events
+			WHERE published_at IS NULL ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED`, outboxBatchSize)
+		if err != nil {
+			return err
+		}
+		type pending struct {
+			id         int64
+			eventID    string
+			routingKey string
+			payload    []byte
+			createdAt  time.Time
+		}
+		var batch []pending
+		for rows.Next() {
+			var p pending
+			if err := rows.Scan(&p.id, &p.eventID, &p.routingKey, &p.payload, &p.createdAt); err != nil {
+				rows.Close()
+				return err
+			}
+			batch = append(batch, p)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, p := range batch {
+			err := ch.Publish(bookEventsExchange, p.routingKey, false, false, amqp.Publishing{
+				ContentType:  "application/json",
+				DeliveryMode: amqp.Persistent,
+				MessageId:    p.eventID,
+				Type:         p.routingKey,
+				Timestamp:    p.createdAt,
+				Body:         p.payload,
+			})
+			if err != nil {
+				return err
+			}
+			if confirm, ok := <-confirms; !ok || !confirm.Ack {
+				return errors.New("broker did not confirm book event " + p.eventID)
+			}
+			published = append(published, p.id)
+		}
+		if len(published) == 0 {
+			return nil
+		}
+		_, err = tx.Exec("UPDATE outbox_events SET published_at = now() WHERE id = ANY($1)", published)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(published), nil
+}
+
+// pruneOutbox deletes events published longer than outboxRetention ago.
+func pruneOutbox() {
+	res, err := db.Exec("DELETE FROM outbox_events WHERE published_at < now() - $1 * interval '1 second'",
+		outboxRetention.Seconds())
+	if err != nil {
+		log.Printf("Outbox prune failed: %v", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("Pruned %d published book events", n)
+	}
+}
+
+// relayOutbox publishes outbox events until the broker connection drops.
+// Events are marked published only after the broker confirms them.
+func relayOutbox() error {
+	conn, err := amqp.Dial(rabbitMQURL())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	if err := ch.ExchangeDeclare(bookEventsExchange, "topic", true, false, false, false, nil); err != nil {
+		return err
+	}
+	if err := ch.Confirm(false); err != nil {
+		return err
+	}
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+
+	log.Printf("Relaying book events to %s", bookEventsExchange)
+	var lastPrune time.Time
+	for {
+		n, err := publishOutbox(ch, confirms)
+		if err != nil {
+			return err
+		}
+		if time.Since(lastPrune) >= outboxPruneEvery {
+			pruneOutbox()
+			lastPrune = time.Now()
+		}
+		if n < outboxBatchSize {
+			time.Sleep(outboxPollInterval)
+		}
+	}
+}
+
+// startOutboxRelay keeps the outbox relay running, reconnecting whenever
+// it fails.
+func startOutboxRelay() {
+	go func() {
+		for {
+			if err := relayOutbox(); err != nil {
+				log.Printf("Book events relay stopped: %v", err)
+			}
+			time.Sleep(brokerRetryDelay)
+		}
+	}()
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// sortKey describes how a public sort name is ordered in SQL and how a
+// cursor value for it is cast back for comparison.
+type sortKey struct {
+	expr string
+	cast string
+}
+
+// bookSortKeys are the sort names accepted by GET /books. Unpriced books
+// sort after every priced one and unrated books rank as zero.
+var bookSortKeys = map[string]sortKey{
+	"title":      {expr: "title", cast: "text"},
+	"author":     {expr: "author", cast: "text"},
+	"created_at": {expr: "created_at", cast: "timestamptz"},
+	"price":      {expr: "COALESCE(price_minor, 9223372036854775807)", cast: "bigint"},
+	"rating":     {expr: "COALESCE(rating_average, 0)", cast: "numeric"},
+}
+
+type bookSort struct {
+	Field string
+	Desc  bool
+}
+
+// parseBookSort accepts a sort name optionally prefixed with "-" for
+// descending order. The default is ascending by title.
+func parseBookSort(s string) (bookSort, error) {
+	if s == "" {
+		return bookSort{Field: "title"}, nil
+	}
+	sort := bookSort{Field: strings.TrimPrefix(s, "-"), Desc: strings.HasPrefix(s, "-")}
+	if _, ok := bookSortKeys[sort.Field]; !ok {
+		return bookSort{}, fmt.Errorf("unsupported sort %q", sort.Field)
+	}
+	return sort, nil
+}
+
+func (s bookSort) String() string {
+	if s.Desc {
+		return "-" + s.Field
+	}
+	return s.Field
+}
+
+func (s bookSort) orderBy() string {
+	dir := "ASC"
+	if s.Desc {
+		dir = "DESC"
+	}
+	return fmt.Sprintf("%s %s, id %s", bookSortKeys[s.Field].expr, dir, dir)
+}
+
+// value returns the sort key of b as it is stored in a cursor.
+func (s bookSort) value(b Book) string {
+	switch s.Field {
+	case "author":
+		return b.Author
+	case "created_at":
+		return b.CreatedAt.UTC().Format(time.RFC3339Nano)
+	case "price":
+		if b.PriceMinor == nil {
+			return strconv.FormatInt(1<<63-1, 10)
+		}
+		return strconv.FormatInt(*b.PriceMinor, 10)
+	case "rating":
+		if b.RatingAverage == nil {
+			return "0.00"
+		}
+		return strconv.FormatFloat(*b.RatingAverage, 'f', 2, 64)
+	}
+	return b.Title
+}
+
+// bookCursor is the position after the last row of a page. It is handed
+// to clients as an opaque base64 string.
+type bookCursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    string `json:"id"`
+}
+
+func encodeCursor(c bookCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (bookCursor, error) {
+	var c bookCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, errors.New("malformed cursor")
+	}
+	if err := json.Unmarshal(data, &c); err != nil || c.ID == "" {
+		return c, errors.New("malformed cursor")
+	}
+	return c, nil
+}
+
+// bookListQuery is the parsed form of the GET /books query string.
+type bookListQuery struct {
+	Limit        int
+	Sort         bookSort
+	Cursor       *bookCursor
+	Author       string
+	TitlePrefix  string
+	Category     string
+	IncludeTotal bool
+}
+
+func parseBookListQuery(c *gin.Context) (bookListQuery, error) {
+	q := bookListQuery{
+		Limit:        defaultPageSize,
+		Author:       strings.TrimSpace(c.Query("author")),
+		TitlePrefix:  strings.TrimSpace(c.Query("title_prefix")),
+		Category:     c.Query("category"),
+		IncludeTotal: c.Query("include_total") == "true",
+	}
+
+	if raw := c.Query("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+		q.Limit = limit
+	}
+
+	sort, err := parseBookSort(c.Query("sort"))
+	if err != nil {
+		return q, err
+	}
+	q.Sort = sort
+
+	if raw := c.Query("cursor"); raw != "" {
+		cursor, err := decodeCursor(raw)
+		if err != nil {
+			return q, err
+		}
+		if cursor.Sort != q.Sort.String() {
+			return q, errors.New("cursor does not match the requested sort")
+		}
+		q.Cursor = &cursor
+	}
+	return q, nil
+}
+
+// filter returns the WHERE clause for the query's filters, appending its
+// parameters to args. The cursor condition is only added when withCursor
+// is set, so the same filter can back the total count.
+func (q bookListQuery) filter(args *[]interface{}, withCursor bool) string {
+	conds := []string{"deleted_at IS NULL"}
+	arg := func(v interface{}) string {
+		*args = append(*args, v)
+		return fmt.Sprintf("$%d", len(*args))
+	}
+
+	if q.Author != "" {
+		conds = append(conds, "lower(author) = lower("+arg(q.Author)+")")
+	}
+	if q.TitlePrefix != "" {
+		conds = append(conds, "lower(title) LIKE "+arg(escapeLike(strings.ToLower(q.TitlePrefix))+"%"))
+	}
+	if q.Category != "" {
+		conds = append(conds, "id IN (SELECT book_id FROM book_categories WHERE category_id IN ("+categorySubtree(arg(q.Category))+"))")
+	}
+	if withCursor && q.Cursor != nil {
+		key := bookSortKeys[q.Sort.Field]
+		op := ">"
+		if q.Sort.Desc {
+			op = "<"
+		}
+		conds = append(conds, fmt.Sprintf("(%s, id) %s (%s::%s, %s)",
+			key.expr, op, arg(q.Cursor.Value), key.cast, arg(q.Cursor.ID)))
+	}
+	return strings.Join(conds, " AND ")
+}
+
+// escapeLike escapes the LIKE wildcards in s.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// BookPage is one page of GET /books results. The handler sends Items as
+// the body and the rest as headers; see writeBookPage.
+type BookPage struct {
+	Items      []Book `json:"items"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	Total      *int   `json:"total,omitempty"`
+}
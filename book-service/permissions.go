@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Permissions guarding the book-service routes. Which roles hold them is
+// configured with BOOK_ROLE_PERMISSIONS.
+const (
+	// permCatalogWrite covers creating, editing and deleting books and
+	// authors, imports, cover images and contributor/category links.
+	permCatalogWrite = "catalog:write"
+	// permCatalogAdmin covers the trash, the category taxonomy and
+	// rebuilding derived data such as analytics and recommendations.
+	permCatalogAdmin = "catalog:admin"
+	// permInventoryManage covers stock adjustments.
+	permInventoryManage = "inventory:manage"
+	// permReviewsModerate allows deleting other customers' reviews.
+	permReviewsModerate = "reviews:moderate"
+	// permPricingManage covers promotions and promo codes.
+	permPricingManage = "pricing:manage"
+	// permPricingRedeem covers recording and releasing the promotion
+	// redemptions of orders. The order service holds it; customers must
+	// not, or they could use up a code's redemptions with made-up orders.
+	permPricingRedeem = "pricing:redeem"
+
+	// allPermissions grants every permission.
+	allPermissions = "*"
+)
+
+var knownPermissions = map[string]bool{
+	permCatalogWrite:    true,
+	permCatalogAdmin:    true,
+	permInventoryManage: true,
+	permReviewsModerate: true,
+	permPricingManage:   true,
+	permPricingRedeem:   true,
+	allPermissions:      true,
+}
+
+// defaultRolePermissions applies when BOOK_ROLE_PERMISSIONS is not set.
+const defaultRolePermissions = "admin=*;catalog-editor=catalog:write;order-service=pricing:redeem"
+
+// rolePermissions maps a token's role to the permissions it holds.
+type rolePermissions map[string]map[string]bool
+
+// parseRolePermissions reads a mapping such as
+// "admin=*;catalog-editor=catalog:write,reviews:moderate".
+func parseRolePermissions(spec string) (rolePermissions, error) {
+	perms := rolePermissions{}
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		role, list, ok := strings.Cut(entry, "=")
+		role = strings.TrimSpace(role)
+		if !ok || role == "" {
+			return nil, fmt.Errorf("invalid entry %q, want role=permission,...", entry)
+		}
+		if perms[role] == nil {
+			perms[role] = map[string]bool{}
+		}
+		for _, p := range strings.Split(list, ",") {
+			p = strings.TrimSpace(p)
+			if p == "" {
+				continue
+			}
+			if !knownPermissions[p] {
+				return nil, fmt.Errorf("unknown permission %q for role %q", p, role)
+			}
+			perms[role][p] = true
+		}
+	}
+	return perms, nil
+}
+
+func mustParseRolePermissions(spec string) rolePermissions {
+	perms, err := parseRolePermissions(spec)
+	if err != nil {
+		panic(err)
+	}
+	return perms
+}
+
+// permissions is the active role mapping, replaced at startup by
+// loadPermissions.
+var permissions = mustParseRolePermissions(defaultRolePermissions)
+
+// loadPermissions applies BOOK_ROLE_PERMISSIONS, if set.
+func loadPermissions() error {
+	spec := os.Getenv("BOOK_ROLE_PERMISSIONS")
+	if spec == "" {
+		return nil
+	}
+	perms, err := parseRolePermissions(spec)
+	if err != nil {
+		return fmt.Errorf("BOOK_ROLE_PERMISSIONS: %w", err)
+	}
+	permissions = perms
+	return nil
+}
+
+// allows reports whether role holds perm.
+func (p rolePermissions) allows(role, perm string) bool {
+	return p[role][perm] || p[role][allPermissions]
+}
+
+// rolesWith lists the roles holding perm, for error messages.
+func (p rolePermissions) rolesWith(perm string) []string {
+	var roles []string
+	for role := range p {
+		if p.allows(role, perm) {
+			roles = append(roles, role)
+		}
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+// hasPermission reports whether the caller's role holds perm.
+func hasPermission(c *gin.Context, perm string) bool {
+	return permissions.allows(c.GetString("role"), perm)
+}
+
+// requirePermission rejects requests whose role does not hold perm.
+func requirePermission(perm string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hasPermission(c, perm) {
+			c.JSON(403, gin.H{
+				"error":      fmt.Sprintf("Your role does not have the %s permission required for this action", perm),
+				"permission": perm,
+				"roles":      permissions.rolesWith(perm),
+			})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// postgresBookRepository is the production BookRepository. Writes keep
+// the author links in book_authors in step with the free-text author.
+type postgresBookRepository struct {
+	db *sql.DB
+}
+
+func newPostgresBookRepository(db *sql.DB) *postgresBookRepository {
+	return &postgresBookRepository{db: db}
+}
+
+func (r *postgresBookRepository) Create(b *Book) error {
+	query := `INSERT INTO books (id, title, author, isbn, price_minor, currency, description,
+		publisher, publication_date, language, page_count, format)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		RETURNING version, created_at, updated_at`
+	err := withTx(r.db, func(tx *sql.Tx) error {
+		err := tx.QueryRow(query, b.ID, b.Title, b.Author, b.ISBN, b.PriceMinor, b.Currency,
+			b.Description, b.Publisher, b.PublicationDate, b.Language, b.PageCount, b.Format).Scan(&b.Version, &b.CreatedAt, &b.UpdatedAt)
+		if err != nil {
+			return err
+		}
+		if err := syncPrimaryAuthor(tx, b.ID, b.Author); err != nil {
+			return err
+		}
+		return enqueueBookEvent(tx, bookCreatedEvent, b.ID)
+	})
+	return bookConstraintError(err)
+}
+
+func (r *postgresBookRepository) Get(id string, includeDeleted bool) (Book, error) {
+	query := "SELECT " + bookColumns + " FROM books WHERE id = $1 AND deleted_at IS NULL"
+	if includeDeleted {
+		query = "SELECT " + bookColumns + " FROM books WHERE id = $1"
+	}
+	var b Book
+	err := scanBook(r.db.QueryRow(query, id), &b)
+	if err == sql.ErrNoRows {
+		return b, errBookNotFound
+	}
+	return b, err
+}
+
+func (r *postgresBookRepository) LoadRelations(b *Book) error {
+	contributors, err := bookContributors(r.db, b.ID)
+	if err != nil {
+		return err
+	}
+	categories, err := bookCategories(r.db, b.ID)
+	if err != nil {
+		return err
+	}
+	prices, err := bookPrices(r.db, b.ID)
+	if err != nil {
+		return err
+	}
+	variants, err := bookVariants(r.db, b.ID)
+	if err != nil {
+		return err
+	}
+	series, err := bookSeries(r.db, b.ID)
+	if err != nil {
+		return err
+	}
+	b.Contributors, b.Categories, b.Prices, b.Variants, b.Series = contributors, categories, prices, variants, series
+	return nil
+}
+
+// LocalizePrices prefers list prices in currency and otherwise converts
+// with the exchange rates in force today.
+func (r *postgresBookRepository) LocalizePrices(books []Book, currency string) error {
+	ids := make([]string, len(books))
+	for i, b := range books {
+		ids[i] = b.ID
+	}
+	rows, err := r.db.Query("SELECT book_id, price_minor FROM book_prices WHERE currency = $1 AND book_id = ANY($2)",
+		currency, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	listPrices := map[string]int64{}
+	for rows.Next() {
+		var id string
+		var price int64
+		if err := rows.Scan(&id, &price); err != nil {
+			rows.Close()
+			return err
+		}
+		listPrices[id] = price
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rates, err := loadExchangeRates(r.db, currency)
+	if err != nil {
+		return err
+	}
+	for i := range books {
+		var listPrice *int64
+		if price, ok := listPrices[books[i].ID]; ok {
+			listPrice = &price
+		}
+		price, err := displayPrice(books[i], currency, listPrice, rates)
+		if err != nil {
+			return err
+		}
+		books[i].DisplayPrice = price
+	}
+	return nil
+}
+
+func (r *postgresBookRepository) List(q bookListQuery) (BookPage, error) {
+	var args []interface{}
+	where := q.filter(&args, true)
+	query := fmt.Sprintf("SELECT %s FROM books WHERE %s ORDER BY %s LIMIT %d",
+		bookColumns, where, q.Sort.orderBy(), q.Limit+1)
+	books, err := r.queryBooks(query, args...)
+	if err != nil {
+		return BookPage{}, err
+	}
+	page := newBookPage(q, books)
+
+	if q.IncludeTotal {
+		var countArgs []interface{}
+		var total int
+		err := r.db.QueryRow("SELECT COUNT(*) FROM books WHERE "+q.filter(&countArgs, false), countArgs...).Scan(&total)
+		if err != nil {
+			return BookPage{}, err
+		}
+		page.Total = &total
+	}
+	return page, nil
+}
+
+func (r *postgresBookRepository) queryBooks(query string, args ...interface{}) ([]Book, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	books := []Book{}
+	for rows.Next() {
+		var b Book
+		if err := scanBook(rows, &b); err != nil {
+			return nil, err
+		}
+		books = append(books, b)
+	}
+	return books, rows.Err()
+}
+
+// Update locks the row first so that the author links are only re-synced
+// when the author actually changed.
+func (r *postgresBookRepository) Update(b *Book) error {
+	query := `UPDATE books SET title = $2, author = $3, isbn = $4, price_minor = $5, currency = $6,
+		description = $7, publisher = $8, publication_date = $9, language = $10, page_count = $11,
+		format = $12, version = version + 1, updated_at = now()
+		WHERE id = $1 AND version = $13 RETURNING version, updated_at`
+	err := withTx(r.db, func(tx *sql.Tx) error {
+		var previousAuthor string
+		err := tx.QueryRow("SELECT author FROM books WHERE id = $1 AND deleted_at IS NULL FOR UPDATE", b.ID).Scan(&previousAuthor)
+		if err == sql.ErrNoRows {
+			return errBookNotFound
+		} else if err != nil {
+			return err
+		}
+
+		err = tx.QueryRow(query, b.ID, b.Title, b.Author, b.ISBN, b.PriceMinor, b.Currency,
+			b.Description, b.Publisher, b.PublicationDate, b.Language, b.PageCount, b.Format,
+			b.Version).Scan(&b.Version, &b.UpdatedAt)
+		if err == sql.ErrNoRows {
+			return errBookVersionConflict
+		} else if err != nil {
+			return err
+		}
+		if authorMatchKey(b.Author) != authorMatchKey(previousAuthor) {
+			if err := syncPrimaryAuthor(tx, b.ID, b.Author); err != nil {
+				return err
+			}
+		}
+		return enqueueBookEvent(tx, bookUpdatedEvent, b.ID)
+	})
+	return bookConstraintError(err)
+}
+
+// Import writes the batch in one transaction, locking each existing
+// row before merging into it and isolating each row behind a savepoint.
+// The transaction is rolled back instead of committed when dryRun is set.
+func (r *postgresBookRepository) Import(rows []importRow, restore, dryRun bool) ([]ImportRowResult, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	results := make([]ImportRowResult, 0, len(rows))
+	for _, row := range rows {
+		if _, err := tx.Exec("SAVEPOINT import_row"); err != nil {
+			return nil, err
+		}
+		inserted, errs, err := importBookRow(tx, row, restore)
+		if err != nil || errs != nil {
+			if _, rbErr := tx.Exec("ROLLBACK TO SAVEPOINT import_row"); rbErr != nil {
+				return nil, rbErr
+			}
+		} else if _, err := tx.Exec("RELEASE SAVEPOINT import_row"); err != nil {
+			return nil, err
+		}
+		results = append(results, importResult(row, inserted, errs, err))
+	}
+
+	if dryRun {
+		return results, nil
+	}
+	return results, tx.Commit()
+}
+
+// importBookRow writes one import row and reports whether it created the
+// book.
+func importBookRow(tx *sql.Tx, row importRow, restore bool) (bool, ValidationErrors, error) {
+	var stored *Book
+	var existing Book
+	err := scanBook(tx.QueryRow("SELECT "+bookColumns+" FROM books WHERE id = $1 FOR UPDATE", row.book.ID), &existing)
+	if err == nil {
+		stored = &existing
+	} else if err != sql.ErrNoRows {
+		return false, nil, err
+	}
+	b, errs, err := importBook(row, stored, restore)
+	if err != nil || errs != nil {
+		return false, errs, err
+	}
+
+	args := []interface{}{b.ID, b.Title, b.Author, b.ISBN, b.PriceMinor, b.Currency,
+		b.Description, b.Publisher, b.PublicationDate, b.Language, b.PageCount, b.Format}
+	event := bookCreatedEvent
+	if stored == nil {
+		_, err = tx.Exec(`INSERT INTO books (id, title, author, isbn, price_minor, currency, description,
+			publisher, publication_date, language, page_count, format)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`, args...)
+	} else {
+		event = bookUpdatedEvent
+		_, err = tx.Exec(`UPDATE books SET title = $2, author = $3, isbn = $4, price_minor = $5, currency = $6,
+			description = $7, publisher = $8, publication_date = $9, language = $10, page_count = $11,
+			format = $12, version = version + 1, updated_at = now(), deleted_at = NULL, deleted_by = ''
+			WHERE id = $1`, args...)
+	}
+	// As in Update, the author links are only re-synced when the author
+	// changed: a co-authored book stores its byline as "A, B", which
+	// syncPrimaryAuthor would turn into a single author "A, B".
+	if err == nil && (stored == nil || authorMatchKey(b.Author) != authorMatchKey(stored.Author)) {
+		err = syncPrimaryAuthor(tx, b.ID, b.Author)
+	}
+	if err == nil {
+		err = enqueueBookEvent(tx, event, b.ID)
+	}
+	return stored == nil, nil, err
+}
+
+func (r *postgresBookRepository) Delete(id, deletedBy string) error {
+	err := withTx(r.db, func(tx *sql.Tx) error {
+		var deletedID string
+		err := tx.QueryRow(`UPDATE books SET deleted_at = now(), deleted_by = $2, version = version + 1, updated_at = now()
+			WHERE id = $1 AND deleted_at IS NULL RETURNING id`, id, deletedBy).Scan(&deletedID)
+		if err != nil {
+			return err
+		}
+		return enqueueBookEvent(tx, bookDeletedEvent, id)
+	})
+	if err == sql.ErrNoRows {
+		return errBookNotFound
+	}
+	return err
+}
+
+func (r *postgresBookRepository) Restore(id string) (Book, error) {
+	var b Book
+	err := withTx(r.db, func(tx *sql.Tx) error {
+		row := tx.QueryRow(`UPDATE books SET deleted_at = NULL, deleted_by = '', version = version + 1, updated_at = now()
+			WHERE id = $1 AND deleted_at IS NOT NULL RETURNING `+bookColumns, id)
+		if err := scanBook(row, &b); err != nil {
+			return err
+		}
+		return enqueueBookEvent(tx, bookUpdatedEvent, id)
+	})
+	if err == sql.ErrNoRows {
+		return b, errBookNotFound
+	}
+	return b, bookConstraintError(err)
+}
+
+func (r *postgresBookRepository) ListTrash(limit, offset int) ([]Book, error) {
+	return r.queryBooks(`SELECT `+bookColumns+` FROM books
+		WHERE deleted_at IS NOT NULL
+		ORDER BY deleted_at DESC, id
+		LIMIT $1 OFFSET $2`, limit, offset)
+}
+
+// Stats groups the top authors by author identity rather than spelling.
+func (r *postgresBookRepository) Stats() (BookStats, error) {
+	stats := BookStats{TopAuthors: []AuthorStats{}, LastUpdated: time.Now()}
+	if err := r.db.QueryRow("SELECT COUNT(*) FROM books WHERE deleted_at IS NULL").Scan(&stats.TotalBooks); err != nil {
+		return stats, err
+	}
+
+	rows, err := r.db.Query(`SELECT a.id, a.name, COUNT(DISTINCT ba.book_id) AS count
+		FROM book_authors ba
+		JOIN authors a ON a.id = ba.author_id
+		JOIN books b ON b.id = ba.book_id AND b.deleted_at IS NULL
+		WHERE ba.role = 'author'
+		GROUP BY a.id, a.name
+		ORDER BY count DESC, a.name
+		LIMIT 10`)
+	if err != nil {
+		return stats, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var stat AuthorStats
+		if err := rows.Scan(&stat.AuthorID, &stat.Author, &stat.Count); err != nil {
+			return stats, err
+		}
+		stats.TopAuthors = append(stats.TopAuthors, stat)
+	}
+	return stats, rows.Err()
+}
+
+// Search tries a prefix full-text query first and falls back to trigram
+// matching when it finds nothing.
+func (r *postgresBookRepository) Search(q string, limit int) (string, []SearchResult, error) {
+	if tsq := prefixTSQuery(q); tsq != "" {
+		results, err := r.fullTextSearch(tsq, limit)
+		if err != nil || len(results) > 0 {
+			return "fulltext", results, err
+		}
+	}
+	results, err := r.fuzzySearch(q, limit)
+	return "fuzzy", results, err
+}
+
+// fullTextSearch ranks books whose search_vector matches tsq.
+func (r *postgresBookRepository) fullTextSearch(tsq string, limit int) ([]SearchResult, error) {
+	query := fmt.Sprintf(`SELECT %s,
+			ts_rank(search_vector, query) AS rank,
+			ts_headline('english', title, query, $2),
+			ts_headline('english', description, query, $2)
+		FROM books, to_tsquery('english', $1) query
+		WHERE search_vector @@ query AND deleted_at IS NULL
+		ORDER BY rank DESC, id
+		LIMIT $3`, prefixColumns("books", bookColumns))
+	rows, err := r.db.Query(query, tsq, headlineOptions, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []SearchResult{}
+	for rows.Next() {
+		var res SearchResult
+		var titleHL, descHL string
+		err := scanBookWith(rows, &res.Book, &res.Rank, &titleHL, &descHL)
+		if err != nil {
+			return nil, err
+		}
+		res.Highlights = map[string]string{"title": titleHL}
+		if res.Book.Description != "" && strings.Contains(descHL, "<mark>") {
+			res.Highlights["description"] = descHL
+		}
+		results = append(results, res)
+	}
+	return results, rows.Err()
+}
+
+// fuzzySearch falls back to trigram similarity on title and author so that
+// misspellings such as "tolkein" still find "Tolkien". The % operator uses
+// pg_trgm.similarity_threshold (0.3 by default) and the trigram indexes.
+func (r *postgresBookRepository) fuzzySearch(q string, limit int) ([]SearchResult, error) {
+	query := fmt.Sprintf(`SELECT %s,
+			GREATEST(similarity(author, $1), similarity(title, $1)) AS rank
+		FROM books
+		WHERE (author %% $1 OR title %% $1) AND deleted_at IS NULL
+		ORDER BY rank DESC, id
+		LIMIT $2`, bookColumns)
+	rows, err := r.db.Query(query, q, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []SearchResult{}
+	for rows.Next() {
+		var res SearchResult
+		if err := scanBookWith(rows, &res.Book, &res.Rank); err != nil {
+			return nil, err
+		}
+		results = append(results, res)
+	}
+	return results, rows.Err()
+}
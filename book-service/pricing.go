@@ -0,0 +1,386 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AppliedPromotion is one promotion's share of a price quote.
+type AppliedPromotion struct {
+	PromotionID   string `json:"promotion_id"`
+	Name          string `json:"name"`
+	Kind          string `json:"kind"`
+	Value         int64  `json:"value"`
+	Code          string `json:"code,omitempty"`
+	DiscountMinor int64  `json:"discount_minor"`
+}
+
+// PriceQuote is the effective price of a book for one customer at one
+// moment. CodeStatus reports what happened to the promo code, if one was
+// given: applied, not_combinable (valid, but a better deal does not use
+// it), not_applicable, exhausted, inactive or invalid.
+type PriceQuote struct {
+	BookID            string             `json:"book_id"`
+	VariantID         string             `json:"variant_id,omitempty"`
+	Currency          string             `json:"currency"`
+	ListPriceMinor    int64              `json:"list_price_minor"`
+	PriceMinor        int64              `json:"price_minor"`
+	DiscountMinor     int64              `json:"discount_minor"`
+	AppliedPromotions []AppliedPromotion `json:"applied_promotions"`
+	Code              string             `json:"code,omitempty"`
+	CodeStatus        string             `json:"code_status,omitempty"`
+	QuotedAt          time.Time          `json:"quoted_at"`
+}
+
+var (
+	// errBookNotForSale is returned when pricing a book without a price.
+	errBookNotForSale = errors.New("book has no price")
+	// errVariantNotFound is returned when pricing an unknown variant.
+	errVariantNotFound = errors.New("variant not found")
+)
+
+// promotionDiscount is what p takes off price, or 0 when it does not apply
+// to a book priced in currency. Percentages round half up.
+func promotionDiscount(p Promotion, price int64, currency string) int64 {
+	switch p.Kind {
+	case "percentage":
+		return (price*p.Value + 50) / 100
+	case "fixed":
+		if p.Currency != currency {
+			return 0
+		}
+		return min(p.Value, price)
+	}
+	return 0
+}
+
+// applyPromotions applies promos one after another, percentages before
+// fixed amounts so that a fixed discount is never itself discounted.
+func applyPromotions(price int64, currency string, promos []Promotion) (int64, []AppliedPromotion) {
+	ordered := append([]Promotion(nil), promos...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].Kind == "percentage" && ordered[j].Kind != "percentage"
+	})
+	applied := []AppliedPromotion{}
+	for _, p := range ordered {
+		discount := promotionDiscount(p, price, currency)
+		if discount <= 0 {
+			continue
+		}
+		price -= discount
+		applied = append(applied, AppliedPromotion{PromotionID: p.ID, Name: p.Name, Kind: p.Kind,
+			Value: p.Value, Code: p.Code, DiscountMinor: discount})
+	}
+	return price, applied
+}
+
+// bestPrice picks the cheapest allowed combination of promos: any single
+// exclusive promotion, or every stackable promotion together. Ties go to
+// the combination found first, with promos taken in order.
+func bestPrice(price int64, currency string, promos []Promotion) (int64, []AppliedPromotion) {
+	best, bestApplied := price, []AppliedPromotion{}
+	consider := func(candidate []Promotion) {
+		if final, applied := applyPromotions(price, currency, candidate); final < best {
+			best, bestApplied = final, applied
+		}
+	}
+	var stackable []Promotion
+	for _, p := range promos {
+		if p.Stacking == "stackable" {
+			stackable = append(stackable, p)
+		} else {
+			consider([]Promotion{p})
+		}
+	}
+	if len(stackable) > 0 {
+		consider(stackable)
+	}
+	return best, bestApplied
+}
+
+// promotionCandidate is a promotion together with how often the customer
+// being quoted has redeemed it.
+type promotionCandidate struct {
+	Promotion
+	userRedemptions int
+}
+
+// exhausted reports whether a usage limit stops the promotion applying.
+func (p promotionCandidate) exhausted() bool {
+	return (p.MaxRedemptions != nil && p.Redemptions >= *p.MaxRedemptions) ||
+		(p.PerUserLimit != nil && p.userRedemptions >= *p.PerUserLimit)
+}
+
+// running reports whether the promotion is in effect at t.
+func (p Promotion) running(t time.Time) bool {
+	return p.Active && !p.StartsAt.After(t) && (p.EndsAt == nil || p.EndsAt.After(t))
+}
+
+// promotionScopeQuery selects the promotions whose scope covers book $1:
+// the book itself, one of its credited authors, one of its categories or
+// their ancestors, or the whole catalog. $2 is the customer.
+const promotionScopeQuery = `WITH RECURSIVE genres AS (
+		SELECT category_id AS id FROM book_categories WHERE book_id = $1
+		UNION
+		SELECT c.parent_id FROM categories c JOIN genres g ON c.id = g.id WHERE c.parent_id IS NOT NULL
+	)
+	SELECT ` + promotionColumns + `,
+		(SELECT COUNT(*) FROM promotion_redemptions r WHERE r.promotion_id = p.id AND r.username = $2)
+	FROM promotions p
+	WHERE (p.scope = 'catalog'
+		OR (p.scope = 'book' AND p.scope_id = $1)
+		OR (p.scope = 'author' AND p.scope_id IN (SELECT author_id FROM book_authors WHERE book_id = $1 AND role = 'author'))
+		OR (p.scope = 'genre' AND p.scope_id IN (SELECT id FROM genres)))`
+
+// quotePrice prices b for username at now, honouring code. Promotions are
+// locked when forUpdate is set so that redemption limits hold under
+// concurrent checkouts.
+func quotePrice(tx *sql.Tx, b Book, username, code string, now time.Time, forUpdate bool) (PriceQuote, error) {
+	if b.PriceMinor == nil {
+		return PriceQuote{}, errBookNotForSale
+	}
+	code = strings.ToUpper(strings.TrimSpace(code))
+	quote := PriceQuote{BookID: b.ID, Currency: b.Currency, ListPriceMinor: *b.PriceMinor, Code: code, QuotedAt: now}
+
+	query := promotionScopeQuery + " AND (p.code IS NULL OR p.code = $3) ORDER BY p.id"
+	if forUpdate {
+		query += " FOR UPDATE OF p"
+	}
+	rows, err := tx.Query(query, b.ID, username, code)
+	if err != nil {
+		return quote, err
+	}
+	var eligible []Promotion
+	var codePromo *promotionCandidate
+	for rows.Next() {
+		var p promotionCandidate
+		if err := scanPromotionWith(rows, &p.Promotion, &p.userRedemptions); err != nil {
+			rows.Close()
+			return quote, err
+		}
+		if p.Code != "" {
+			codePromo = &p
+		}
+		if p.running(now) && !p.exhausted() {
+			eligible = append(eligible, p.Promotion)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return quote, err
+	}
+
+	quote.PriceMinor, quote.AppliedPromotions = bestPrice(quote.ListPriceMinor, b.Currency, eligible)
+	quote.DiscountMinor = quote.ListPriceMinor - quote.PriceMinor
+
+	if code == "" {
+		return quote, nil
+	}
+	var exists bool
+	if codePromo == nil {
+		// The code either does not exist or covers other books.
+		if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM promotions WHERE code = $1)", code).Scan(&exists); err != nil {
+			return quote, err
+		}
+	}
+	quote.CodeStatus = promoCodeStatus(quote, codePromo, exists, now)
+	return quote, nil
+}
+
+// promoCodeStatus is the CodeStatus of quote. codePromo is the promotion
+// its code unlocks among those covering the book, if any, and exists
+// whether the code names any promotion at all.
+func promoCodeStatus(quote PriceQuote, codePromo *promotionCandidate, exists bool, now time.Time) string {
+	switch {
+	case codePromo == nil && exists:
+		return "not_applicable"
+	case codePromo == nil:
+		return "invalid"
+	case !codePromo.running(now):
+		return "inactive"
+	case codePromo.exhausted():
+		return "exhausted"
+	case promotionDiscount(codePromo.Promotion, quote.ListPriceMinor, quote.Currency) == 0:
+		return "not_applicable"
+	}
+	for _, a := range quote.AppliedPromotions {
+		if a.PromotionID == codePromo.ID {
+			return "applied"
+		}
+	}
+	return "not_combinable"
+}
+
+// variantForSale returns b as sold in its variant variantID, at the
+// variant's price when it has one and at the book's otherwise. An empty
+// variantID returns b unchanged.
+func variantForSale(b Book, variantID string) (Book, error) {
+	if variantID == "" {
+		return b, nil
+	}
+	v, err := bookVariant(db, b.ID, variantID)
+	if err == sql.ErrNoRows {
+		return b, errVariantNotFound
+	}
+	if err != nil {
+		return b, err
+	}
+	if v.PriceMinor != nil {
+		b.PriceMinor, b.Currency = v.PriceMinor, v.Currency
+	}
+	return b, nil
+}
+
+func respondPriceError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errBookNotFound):
+		c.JSON(404, gin.H{"error": "Book not found"})
+	case errors.Is(err, errVariantNotFound):
+		c.JSON(404, gin.H{"error": "Variant not found"})
+	case errors.Is(err, errBookNotForSale):
+		c.JSON(422, gin.H{"error": "Book has no price"})
+	default:
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to price book"})
+	}
+}
+
+// getBookPrice quotes the effective price of a book, or of the variant
+// given as ?variant_id=, for the caller now, applying the promo code given
+// as ?code=.
+func (h *BookHandler) getBookPrice(c *gin.Context) {
+	b, err := h.repo.Get(c.Param("id"), false)
+	if err == nil {
+		b, err = variantForSale(b, c.Query("variant_id"))
+	}
+	if err != nil {
+		respondPriceError(c, err)
+		return
+	}
+	var quote PriceQuote
+	err = withTx(db, func(tx *sql.Tx) error {
+		var err error
+		quote, err = quotePrice(tx, b, c.GetString("username"), c.Query("code"), time.Now().UTC(), false)
+		return err
+	})
+	if err != nil {
+		respondPriceError(c, err)
+		return
+	}
+	quote.VariantID = c.Query("variant_id")
+	c.JSON(200, quote)
+}
+
+// redeemBookPrice prices a book, or its variant variant_id, for a
+// checkout and records the applied promotions against order_id, counting them towards their usage limits.
+// A promo code that cannot be used fails the request with 422 so that
+// checkout can tell the customer; order_id may only be priced once.
+func (h *BookHandler) redeemBookPrice(c *gin.Context) {
+	var in struct {
+		OrderID   string `json:"order_id"`
+		VariantID string `json:"variant_id"`
+		Code      string `json:"code"`
+	}
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	in.OrderID = strings.TrimSpace(in.OrderID)
+	if in.OrderID == "" {
+		respondValidationErrors(c, ValidationErrors{{Field: "order_id", Code: "required", Message: "order_id is required"}})
+		return
+	}
+
+	b, err := uncached(h.repo).Get(c.Param("id"), false)
+	if err == nil {
+		b, err = variantForSale(b, in.VariantID)
+	}
+	if err != nil {
+		respondPriceError(c, err)
+		return
+	}
+
+	username := c.GetString("username")
+	var quote PriceQuote
+	var alreadyPriced bool
+	err = withTx(db, func(tx *sql.Tx) error {
+		var err error
+		if quote, err = quotePrice(tx, b, username, in.Code, time.Now().UTC(), true); err != nil {
+			return err
+		}
+		if quote.CodeStatus != "" && quote.CodeStatus != "applied" && quote.CodeStatus != "not_combinable" {
+			return nil
+		}
+		err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM promotion_redemptions WHERE order_id = $1)", in.OrderID).Scan(&alreadyPriced)
+		if err != nil || alreadyPriced {
+			return err
+		}
+		for _, a := range quote.AppliedPromotions {
+			_, err := tx.Exec(`INSERT INTO promotion_redemptions (promotion_id, order_id, username, book_id, discount_minor)
+				VALUES ($1, $2, $3, $4, $5)`, a.PromotionID, in.OrderID, username, b.ID, a.DiscountMinor)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec("UPDATE promotions SET redemptions = redemptions + 1 WHERE id = $1", a.PromotionID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		respondPriceError(c, err)
+		return
+	}
+	if quote.CodeStatus != "" && quote.CodeStatus != "applied" && quote.CodeStatus != "not_combinable" {
+		c.JSON(422, gin.H{"error": "Promo code cannot be used: " + strings.ReplaceAll(quote.CodeStatus, "_", " "), "code_status": quote.CodeStatus})
+		return
+	}
+	if alreadyPriced {
+		c.JSON(409, gin.H{"error": "Order has already been priced"})
+		return
+	}
+	quote.VariantID = in.VariantID
+	c.JSON(200, quote)
+}
+
+// releaseRedemptions undoes the redemptions recorded by redeemBookPrice
+// for an order that was not placed after all, so that the promotions no
+// longer count it and the order can be priced again. Only the customer
+// who redeemed them, or someone who manages pricing, can release them.
+// Releasing an order with no redemptions succeeds and releases nothing.
+func releaseRedemptions(c *gin.Context) {
+	bookID, orderID := c.Param("id"), c.Param("order_id")
+	var released int64
+	err := inTx(func(tx *sql.Tx) error {
+		// Lock the promotions first, in the order redeemBookPrice does.
+		_, err := tx.Exec(`SELECT id FROM promotions WHERE id IN (
+				SELECT promotion_id FROM promotion_redemptions WHERE book_id = $1 AND order_id = $2)
+			ORDER BY id FOR UPDATE`, bookID, orderID)
+		if err != nil {
+			return err
+		}
+		res, err := tx.Exec(`WITH released AS (
+				DELETE FROM promotion_redemptions
+				WHERE book_id = $1 AND order_id = $2 AND (username = $3 OR $4)
+				RETURNING promotion_id
+			)
+			UPDATE promotions p SET redemptions = p.redemptions - 1 FROM released r WHERE p.id = r.promotion_id`,
+			bookID, orderID, c.GetString("username"), hasPermission(c, permPricingManage))
+		if err != nil {
+			return err
+		}
+		released, err = res.RowsAffected()
+		return err
+	})
+	if err != nil {
+		respondPriceError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{"order_id": orderID, "released": released})
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+const maxPromotionNameLength = 200
+
+// promotionCodePattern is the accepted shape of a promo code once
+// upper-cased.
+var promotionCodePattern = regexp.MustCompile(`^[A-Z0-9_-]{3,32}$`)
+
+// Promotion discounts the price of the books in its scope while it runs.
+// Percentage promotions take Value percent off; fixed ones take Value
+// minor units of Currency off books priced in that currency. Promotions
+// with a Code only apply when the customer enters it.
+type Promotion struct {
+	ID             string     `json:"id"`
+	Name           string     `json:"name"`
+	Kind           string     `json:"kind"`
+	Value          int64      `json:"value"`
+	Currency       string     `json:"currency,omitempty"`
+	Scope          string     `json:"scope"`
+	ScopeID        string     `json:"scope_id,omitempty"`
+	Stacking       string     `json:"stacking"`
+	Code           string     `json:"code,omitempty"`
+	MaxRedemptions *int       `json:"max_redemptions,omitempty"`
+	PerUserLimit   *int       `json:"per_user_limit,omitempty"`
+	Redemptions    int        `json:"redemptions"`
+	StartsAt       time.Time  `json:"starts_at"`
+	EndsAt         *time.Time `json:"ends_at,omitempty"`
+	Active         bool       `json:"active"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// PromotionUpdate carries the editable fields of a promotion; fields
+// left out are untouched by PATCH. The optional code, max_redemptions,
+// per_user_limit and ends_at are removed with an explicit null.
+type PromotionUpdate struct {
+	Name           *string             `json:"name"`
+	Value          *int64              `json:"value"`
+	Currency       *string             `json:"currency"`
+	Stacking       *string             `json:"stacking"`
+	Code           nullable[string]    `json:"code"`
+	MaxRedemptions nullable[int]       `json:"max_redemptions"`
+	PerUserLimit   nullable[int]       `json:"per_user_limit"`
+	StartsAt       *time.Time          `json:"starts_at"`
+	EndsAt         nullable[time.Time] `json:"ends_at"`
+	Active         *bool               `json:"active"`
+}
+
+// nullable is a PATCH field that tells a missing key, which leaves the
+// value alone, from an explicit null, which clears it.
+type nullable[T any] struct {
+	Set   bool
+	Value *T
+}
+
+func (n *nullable[T]) UnmarshalJSON(data []byte) error {
+	n.Set, n.Value = true, nil
+	if string(data) == "null" {
+		return nil
+	}
+	n.Value = new(T)
+	return json.Unmarshal(data, n.Value)
+}
+
+func (u PromotionUpdate) apply(p *Promotion) {
+	if u.Name != nil {
+		p.Name = *u.Name
+	}
+	if u.Value != nil {
+		p.Value = *u.Value
+	}
+	if u.Currency != nil {
+		p.Currency = *u.Currency
+	}
+	if u.Stacking != nil {
+		p.Stacking = *u.Stacking
+	}
+	if u.Code.Set {
+		p.Code = ""
+		if u.Code.Value != nil {
+			p.Code = *u.Code.Value
+		}
+	}
+	if u.MaxRedemptions.Set {
+		p.MaxRedemptions = u.MaxRedemptions.Value
+	}
+	if u.PerUserLimit.Set {
+		p.PerUserLimit = u.PerUserLimit.Value
+	}
+	if u.StartsAt != nil {
+		p.StartsAt = *u.StartsAt
+	}
+	if u.EndsAt.Set {
+		p.EndsAt = u.EndsAt.Value
+	}
+	if u.Active != nil {
+		p.Active = *u.Active
+	}
+}
+
+const promotionColumns = `id, name, kind, value, currency, scope, scope_id, stacking, COALESCE(code, ''),
+	max_redemptions, per_user_limit, redemptions, starts_at, ends_at, active, created_at, updated_at`
+
+func scanPromotionWith(row rowScanner, p *Promotion, extra ...interface{}) error {
+	dest := []interface{}{&p.ID, &p.Name, &p.Kind, &p.Value, &p.Currency, &p.Scope, &p.ScopeID,
+		&p.Stacking, &p.Code, &p.MaxRedemptions, &p.PerUserLimit, &p.Redemptions, &p.StartsAt,
+		&p.EndsAt, &p.Active, &p.CreatedAt, &p.UpdatedAt}
+	return row.Scan(append(dest, extra...)...)
+}
+
+func scanPromotion(row rowScanner, p *Promotion) error {
+	return scanPromotionWith(row, p)
+}
+
+// validatePromotion normalises p in place (trimmed name, upper-case code
+// and currency) and reports rule violations.
+func validatePromotion(p *Promotion) ValidationErrors {
+	var errs ValidationErrors
+	p.Name = strings.TrimSpace(p.Name)
+	p.Currency = strings.ToUpper(strings.TrimSpace(p.Currency))
+	p.Code = strings.ToUpper(strings.TrimSpace(p.Code))
+	p.ScopeID = strings.TrimSpace(p.ScopeID)
+
+	if p.Name == "" {
+		errs.add("name", "required", "name is required")
+	} else if utf8.RuneCountInString(p.Name) > maxPromotionNameLength {
+		errs.add("name", "too_long", "name must be at most %d characters", maxPromotionNameLength)
+	}
+
+	switch p.Kind {
+	case "percentage":
+		if p.Value < 1 || p.Value > 100 {
+			errs.add("value", "out_of_range", "value must be a percentage between 1 and 100")
+		}
+		if p.Currency != "" {
+			errs.add("currency", "not_allowed", "currency only applies to fixed promotions")
+		}
+	case "fixed":
+		if p.Value < 1 {
+			errs.add("value", "out_of_range", "value must be a positive amount in minor units")
+		}
+		if !isCurrencyCode(p.Currency) {
+			errs.add("currency", "invalid", "fixed promotions need a three-letter ISO 4217 currency")
+		}
+	default:
+		errs.add("kind", "invalid", "kind must be percentage or fixed")
+	}
+
+	switch p.Scope {
+	case "catalog":
+		if p.ScopeID != "" {
+			errs.add("scope_id", "not_allowed", "catalog promotions cannot have a scope_id")
+		}
+	case "book", "author", "genre":
+		if p.ScopeID == "" {
+			errs.add("scope_id", "required", "scope_id is required for %s promotions", p.Scope)
+		}
+	default:
+		errs.add("scope", "invalid", "scope must be one of book, author, genre, catalog")
+	}
+
+	if p.Stacking != "exclusive" && p.Stacking != "stackable" {
+		errs.add("stacking", "invalid", "stacking must be exclusive or stackable")
+	}
+	if p.Code != "" && !promotionCodePattern.MatchString(p.Code) {
+		errs.add("code", "invalid", "code must be 3 to 32 letters, digits, dashes or underscores")
+	}
+	if p.MaxRedemptions != nil && *p.MaxRedemptions < 1 {
+		errs.add("max_redemptions", "out_of_range", "max_redemptions must be at least 1")
+	}
+	if p.PerUserLimit != nil && *p.PerUserLimit < 1 {
+		errs.add("per_user_limit", "out_of_range", "per_user_limit must be at least 1")
+	}
+	if p.EndsAt != nil && !p.EndsAt.After(p.StartsAt) {
+		errs.add("ends_at", "out_of_range", "ends_at must be after starts_at")
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// checkPromotionScope verifies that the book, author or category a
+// promotion targets exists.
+func checkPromotionScope(tx *sql.Tx, p Promotion) error {
+	var query string
+	switch p.Scope {
+	case "book":
+		query = "SELECT EXISTS (SELECT 1 FROM books WHERE id = $1 AND deleted_at IS NULL)"
+	case "author":
+		query = "SELECT EXISTS (SELECT 1 FROM authors WHERE id = $1)"
+	case "genre":
+		query = "SELECT EXISTS (SELECT 1 FROM categories WHERE id = $1)"
+	default:
+		return nil
+	}
+	var exists bool
+	if err := tx.QueryRow(query, p.ScopeID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ValidationErrors{{Field: "scope_id", Code: "not_found", Message: fmt.Sprintf("scope_id must refer to an existing %s", p.Scope)}}
+	}
+	return nil
+}
+
+// nullableCode stores an empty code as NULL so that the unique constraint
+// only applies to real codes.
+func nullableCode(code string) interface{} {
+	if code == "" {
+		return nil
+	}
+	return code
+}
+
+func respondPromotionError(c *gin.Context, err error, action string) {
+	var errs ValidationErrors
+	var pqErr *pq.Error
+	switch {
+	case err == sql.ErrNoRows:
+		c.JSON(404, gin.H{"error": "Promotion not found"})
+	case errors.As(err, &errs):
+		respondValidationErrors(c, errs)
+	case errors.As(err, &pqErr) && pqErr.Code == "23505":
+		c.JSON(409, gin.H{"error": "Another promotion already uses this code"})
+	default:
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to " + action + " promotion"})
+	}
+}
+
+// listPromotions returns every promotion, most recently started first.
+// With running=true only promotions in effect now are listed.
+func listPromotions(c *gin.Context) {
+	query := "SELECT " + promotionColumns + " FROM promotions"
+	if c.Query("running") == "true" {
+		query += " WHERE active AND starts_at <= now() AND (ends_at IS NULL OR ends_at > now())"
+	}
+	rows, err := db.Query(query + " ORDER BY starts_at DESC, id")
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to fetch promotions"})
+		return
+	}
+	defer rows.Close()
+
+	promotions := []Promotion{}
+	for rows.Next() {
+		var p Promotion
+		if err := scanPromotion(rows, &p); err != nil {
+			log.Printf("Row scan error: %v", err)
+			continue
+		}
+		promotions = append(promotions, p)
+	}
+	c.JSON(200, promotions)
+}
+
+func getPromotion(c *gin.Context) {
+	var p Promotion
+	err := scanPromotion(db.QueryRow("SELECT "+promotionColumns+" FROM promotions WHERE id = $1", c.Param("id")), &p)
+	if err != nil {
+		respondPromotionError(c, err, "fetch")
+		return
+	}
+	c.JSON(200, p)
+}
+
+// createPromotion adds a promotion. starts_at defaults to now, stacking to
+// exclusive and active to true.
+func createPromotion(c *gin.Context) {
+	var in struct {
+		Promotion
+		Active *bool `json:"active"`
+	}
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	p := in.Promotion
+	p.ID, p.Redemptions, p.Active = newID(), 0, in.Active == nil || *in.Active
+	if p.StartsAt.IsZero() {
+		p.StartsAt = time.Now().UTC()
+	}
+	if p.Stacking == "" {
+		p.Stacking = "exclusive"
+	}
+	if errs := validatePromotion(&p); errs != nil {
+		respondValidationErrors(c, errs)
+		return
+	}
+
+	err := inTx(func(tx *sql.Tx) error {
+		if err := checkPromotionScope(tx, p); err != nil {
+			return err
+		}
+		return tx.QueryRow(`INSERT INTO promotions (id, name, kind, value, currency, scope, scope_id, stacking,
+				code, max_redemptions, per_user_limit, starts_at, ends_at, active)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+			RETURNING created_at, updated_at`,
+			p.ID, p.Name, p.Kind, p.Value, p.Currency, p.Scope, p.ScopeID, p.Stacking, nullableCode(p.Code),
+			p.MaxRedemptions, p.PerUserLimit, p.StartsAt, p.EndsAt, p.Active).Scan(&p.CreatedAt, &p.UpdatedAt)
+	})
+	if err != nil {
+		respondPromotionError(c, err, "create")
+		return
+	}
+	c.Header("Location", "/promotions/"+p.ID)
+	c.JSON(201, p)
+}
+
+// updatePromotion edits a promotion. Its kind and scope are fixed once
+// created; set active to false to stop it early.
+func updatePromotion(c *gin.Context) {
+	var u PromotionUpdate
+	if err := c.ShouldBindJSON(&u); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	var p Promotion
+	err := inTx(func(tx *sql.Tx) error {
+		if err := scanPromotion(tx.QueryRow("SELECT "+promotionColumns+" FROM promotions WHERE id = $1 FOR UPDATE", c.Param("id")), &p); err != nil {
+			return err
+		}
+		u.apply(&p)
+		if errs := validatePromotion(&p); errs != nil {
+			return errs
+		}
+		return tx.QueryRow(`UPDATE promotions SET name = $2, value = $3, currency = $4, stacking = $5, code = $6,
+				max_redemptions = $7, per_user_limit = $8, starts_at = $9, ends_at = $10, active = $11, updated_at = now()
+			WHERE id = $1 RETURNING updated_at`,
+			p.ID, p.Name, p.Value, p.Currency, p.Stacking, nullableCode(p.Code), p.MaxRedemptions,
+			p.PerUserLimit, p.StartsAt, p.EndsAt, p.Active).Scan(&p.UpdatedAt)
+	})
+	if err != nil {
+		respondPromotionError(c, err, "update")
+		return
+	}
+	c.JSON(200, p)
+}
+
+// deletePromotion removes a promotion together with its redemption
+// history. Deactivate it instead to keep the history.
+func deletePromotion(c *gin.Context) {
+	res, err := db.Exec("DELETE FROM promotions WHERE id = $1", c.Param("id"))
+	if err != nil {
+		respondPromotionError(c, err, "delete")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(404, gin.H{"error": "Promotion not found"})
+		return
+	}
+	c.JSON(200, gin.H{"message": "Promotion deleted successfully"})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+)
+
+var (
+	errBookNotFound        = errors.New("book not found")
+	errBookVersionConflict = errors.New("book has been modified by another request")
+	errDuplicateBookID     = errors.New("duplicate book id")
+	errDuplicateISBN       = errors.New("duplicate isbn")
+)
+
+// BookRepository stores the catalog behind the book handlers. Books in
+// the trash are invisible to every method unless stated otherwise.
+// Implementations report missing books as errBookNotFound and unique
+// violations as errDuplicateBookID or errDuplicateISBN.
+//
+// It covers the books themselves: the BookHandler routes, imports and the
+// price quotes that read a book. Authors, categories, inventory,
+// promotions, variants, series, reviews, wishlists and exchange rates are
+// served from the package db by their own handlers, so their tests need
+// Postgres; LoadRelations and LocalizePrices only read them.
+type BookRepository interface {
+	// Create inserts b and fills in its version and timestamps.
+	Create(b *Book) error
+	// Get returns a book, including books in the trash if includeDeleted
+	// is set.
+	Get(id string, includeDeleted bool) (Book, error)
+	// LoadRelations fills in the contributors, categories, list prices,
+	// variants and series of b.
+	LoadRelations(b *Book) error
+	// LocalizePrices sets the DisplayPrice of books in currency. A price
+	// that converts out of range is an error wrapping
+	// errConversionOverflow.
+	LocalizePrices(books []Book, currency string) error
+	// List returns one page of books matching q.
+	List(q bookListQuery) (BookPage, error)
+	// Update writes the editable fields of b provided the stored version
+	// still equals b.Version, and returns errBookVersionConflict if not.
+	// On success b carries the new version and update time.
+	Update(b *Book) error
+	// Delete moves a book to the trash.
+	Delete(id, deletedBy string) error
+	// Restore takes a book out of the trash and returns it.
+	Restore(id string) (Book, error)
+	// ListTrash returns deleted books, most recently deleted first.
+	ListTrash(limit, offset int) ([]Book, error)
+	// Stats summarises the catalog.
+	Stats() (BookStats, error)
+	// Search ranks books matching free text. Mode reports which matching
+	// strategy produced the results.
+	Search(q string, limit int) (mode string, results []SearchResult, err error)
+	// Import writes a batch of import rows and reports on each. A row
+	// creates its book or updates only the columns it supplies, and is
+	// validated as it would be stored; a failed row leaves the others in
+	// the batch alone. Books in the trash are restored by a row if restore
+	// is set and left alone otherwise. With dryRun nothing is written.
+	Import(rows []importRow, restore, dryRun bool) ([]ImportRowResult, error)
+}
+
+// newBookPage trims rows fetched with one extra row beyond q.Limit into a
+// page, setting the cursor when that extra row shows there is more.
+func newBookPage(q bookListQuery, rows []Book) BookPage {
+	page := BookPage{Items: rows}
+	if len(page.Items) > q.Limit {
+		page.Items = page.Items[:q.Limit]
+		last := page.Items[q.Limit-1]
+		page.NextCursor = encodeCursor(bookCursor{Sort: q.Sort.String(), Value: q.Sort.value(last), ID: last.ID})
+	}
+	return page
+}
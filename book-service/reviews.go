@@ -0,0 +1,350 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+const (
+	maxReviewTitleLength = 200
+	maxReviewBodyLength  = 5000
+)
+
+// Review is one customer's rating of a book, optionally with text.
+type Review struct {
+	ID        int64     `json:"id"`
+	BookID    string    `json:"book_id"`
+	Username  string    `json:"username"`
+	Rating    int       `json:"rating"`
+	Title     string    `json:"title,omitempty"`
+	Body      string    `json:"body,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ReviewUpdate carries the editable fields of a review; nil fields are
+// left untouched by PATCH.
+type ReviewUpdate struct {
+	Rating *int    `json:"rating"`
+	Title  *string `json:"title"`
+	Body   *string `json:"body"`
+}
+
+// ReviewPage is returned by GET /books/:id/reviews.
+type ReviewPage struct {
+	RatingAverage *float64 `json:"rating_average"`
+	RatingCount   int      `json:"rating_count"`
+	Reviews       []Review `json:"reviews"`
+}
+
+const reviewColumns = "id, book_id, username, rating, title, body, created_at, updated_at"
+
+func scanReview(row rowScanner, r *Review) error {
+	return row.Scan(&r.ID, &r.BookID, &r.Username, &r.Rating, &r.Title, &r.Body, &r.CreatedAt, &r.UpdatedAt)
+}
+
+// validateReview trims r's text and reports rule violations.
+func validateReview(r *Review) ValidationErrors {
+	var errs ValidationErrors
+	r.Title = strings.TrimSpace(r.Title)
+	r.Body = strings.TrimSpace(r.Body)
+
+	if r.Rating < 1 || r.Rating > 5 {
+		errs.add("rating", "out_of_range", "rating must be between 1 and 5")
+	}
+	if utf8.RuneCountInString(r.Title) > maxReviewTitleLength {
+		errs.add("title", "too_long", "title must be at most %d characters", maxReviewTitleLength)
+	}
+	if utf8.RuneCountInString(r.Body) > maxReviewBodyLength {
+		errs.add("body", "too_long", "body must be at most %d characters", maxReviewBodyLength)
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// refreshBookRating recomputes the rating aggregates of a book. It leaves
+// the book's version alone so that reviews never cause edit conflicts.
+func refreshBookRating(tx *sql.Tx, bookID string) error {
+	_, err := tx.Exec(`UPDATE books SET
+			rating_count = (SELECT COUNT(*) FROM reviews WHERE book_id = $1),
+			rating_average = (SELECT ROUND(AVG(rating), 2) FROM reviews WHERE book_id = $1)
+		WHERE id = $1`, bookID)
+	return err
+}
+
+// orderServiceURL is where order history is looked up, configured with
+// ORDER_SERVICE_URL.
+func orderServiceURL() string {
+	if url := os.Getenv("ORDER_SERVICE_URL"); url != "" {
+		return url
+	}
+	return "http://order-service:8081"
+}
+
+// hasOrderedBook asks order-service whether the caller has a completed
+// order for bookID, forwarding their token so that only their own history
+// is visible.
+func hasOrderedBook(c *gin.Context, bookID string) (bool, error) {
+	req, err := http.NewRequest(http.MethodGet, orderServiceURL()+"/orders", nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", c.GetHeader("Authorization"))
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("order service returned status code %d", resp.StatusCode)
+	}
+
+	var orders []struct {
+		BookID string `json:"book_id"`
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&orders); err != nil {
+		return false, err
+	}
+	for _, o := range orders {
+		if o.BookID == bookID && o.Status == "completed" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// listReviews returns a book's reviews, newest first, with its rating
+// aggregates. Supports limit and offset.
+func listReviews(c *gin.Context) {
+	id := c.Param("id")
+	limit, offset := defaultPageSize, 0
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxPageSize {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxPageSize)})
+			return
+		}
+		limit = n
+	}
+	if raw := c.Query("offset"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			c.JSON(400, gin.H{"error": "offset must be a non-negative integer"})
+			return
+		}
+		offset = n
+	}
+
+	page := ReviewPage{Reviews: []Review{}}
+	err := db.QueryRow("SELECT rating_average, rating_count FROM books WHERE id = $1 AND deleted_at IS NULL", id).
+		Scan(&page.RatingAverage, &page.RatingCount)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(404, gin.H{"error": "Book not found"})
+		} else {
+			log.Printf("Database error: %v", err)
+			c.JSON(500, gin.H{"error": "Failed to fetch reviews"})
+		}
+		return
+	}
+
+	rows, err := db.Query(`SELECT `+reviewColumns+` FROM reviews WHERE book_id = $1
+		ORDER BY created_at DESC, id DESC LIMIT $2 OFFSET $3`, id, limit, offset)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to fetch reviews"})
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r Review
+		if err := scanReview(rows, &r); err != nil {
+			log.Printf("Row scan error: %v", err)
+			continue
+		}
+		page.Reviews = append(page.Reviews, r)
+	}
+	c.JSON(200, page)
+}
+
+// createReview adds the caller's review of a book. Each user may review a
+// book once, and only after ordering it.
+func createReview(c *gin.Context) {
+	id := c.Param("id")
+	var r Review
+	if err := c.ShouldBindJSON(&r); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if errs := validateReview(&r); errs != nil {
+		respondValidationErrors(c, errs)
+		return
+	}
+
+	exists, err := bookExists(id)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to create review"})
+		return
+	}
+	if !exists {
+		c.JSON(404, gin.H{"error": "Book not found"})
+		return
+	}
+
+	ordered, err := hasOrderedBook(c, id)
+	if err != nil {
+		log.Printf("Order history lookup failed: %v", err)
+		c.JSON(503, gin.H{"error": "Could not verify order history"})
+		return
+	}
+	if !ordered {
+		c.JSON(403, gin.H{"error": "Only customers who ordered this book can review it"})
+		return
+	}
+
+	r.BookID, r.Username = id, c.GetString("username")
+	err = inTx(func(tx *sql.Tx) error {
+		err := scanReview(tx.QueryRow(`INSERT INTO reviews (book_id, username, rating, title, body)
+			VALUES ($1, $2, $3, $4, $5) RETURNING `+reviewColumns,
+			r.BookID, r.Username, r.Rating, r.Title, r.Body), &r)
+		if err != nil {
+			return err
+		}
+		return refreshBookRating(tx, id)
+	})
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			c.JSON(409, gin.H{"error": "You have already reviewed this book; edit your existing review instead"})
+			return
+		}
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to create review"})
+		return
+	}
+
+	c.Header("Location", fmt.Sprintf("/books/%s/reviews/%d", id, r.ID))
+	c.JSON(201, r)
+}
+
+// errReviewNotFound and errNotReviewAuthor are returned from the review
+// write transactions.
+var (
+	errReviewNotFound  = errors.New("review not found")
+	errNotReviewAuthor = errors.New("not the review author")
+)
+
+// lockReview loads a review of the book in the path for update and checks
+// that the caller may change it. Moderators may delete any review.
+func lockReview(tx *sql.Tx, c *gin.Context, allowModerator bool) (Review, error) {
+	var r Review
+	reviewID, err := strconv.ParseInt(c.Param("review_id"), 10, 64)
+	if err != nil {
+		return r, errReviewNotFound
+	}
+	err = scanReview(tx.QueryRow("SELECT "+reviewColumns+" FROM reviews WHERE id = $1 AND book_id = $2 FOR UPDATE",
+		reviewID, c.Param("id")), &r)
+	if err == sql.ErrNoRows {
+		return r, errReviewNotFound
+	} else if err != nil {
+		return r, err
+	}
+	if r.Username != c.GetString("username") && !(allowModerator && hasPermission(c, permReviewsModerate)) {
+		return r, errNotReviewAuthor
+	}
+	return r, nil
+}
+
+func respondReviewError(c *gin.Context, err error, action string) {
+	var verrs ValidationErrors
+	switch {
+	case errors.As(err, &verrs):
+		respondValidationErrors(c, verrs)
+	case err == errReviewNotFound:
+		c.JSON(404, gin.H{"error": "Review not found"})
+	case err == errNotReviewAuthor:
+		c.JSON(403, gin.H{"error": "You can only " + action + " your own reviews"})
+	default:
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to " + action + " review"})
+	}
+}
+
+// updateReview lets a user edit their own review.
+func updateReview(c *gin.Context) {
+	var u ReviewUpdate
+	if err := c.ShouldBindJSON(&u); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	var r Review
+	err := inTx(func(tx *sql.Tx) error {
+		var err error
+		if r, err = lockReview(tx, c, false); err != nil {
+			return err
+		}
+		if u.Rating != nil {
+			r.Rating = *u.Rating
+		}
+		if u.Title != nil {
+			r.Title = *u.Title
+		}
+		if u.Body != nil {
+			r.Body = *u.Body
+		}
+		if errs := validateReview(&r); errs != nil {
+			return errs
+		}
+
+		err = tx.QueryRow(`UPDATE reviews SET rating = $2, title = $3, body = $4, updated_at = now()
+			WHERE id = $1 RETURNING updated_at`, r.ID, r.Rating, r.Title, r.Body).Scan(&r.UpdatedAt)
+		if err != nil {
+			return err
+		}
+		return refreshBookRating(tx, r.BookID)
+	})
+	if err != nil {
+		respondReviewError(c, err, "edit")
+		return
+	}
+	c.JSON(200, r)
+}
+
+// deleteReview removes a review. Users may delete their own reviews and
+// moderators (admins by default) any review.
+func deleteReview(c *gin.Context) {
+	err := inTx(func(tx *sql.Tx) error {
+		r, err := lockReview(tx, c, true)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM reviews WHERE id = $1", r.ID); err != nil {
+			return err
+		}
+		return refreshBookRating(tx, r.BookID)
+	})
+	if err != nil {
+		respondReviewError(c, err, "delete")
+		return
+	}
+	c.JSON(200, gin.H{"message": "Review deleted successfully"})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+
+	headlineOptions = "StartSel=<mark>, StopSel=</mark>, MaxWords=35, MinWords=15, MaxFragments=2"
+)
+
+// SearchResult is one ranked match with highlighted snippets.
+type SearchResult struct {
+	Book       Book              `json:"book"`
+	Rank       float64           `json:"rank"`
+	Highlights map[string]string `json:"highlights,omitempty"`
+}
+
+// SearchResponse is returned by GET /books/search. Mode is "fulltext"
+// when the tsvector query matched and "fuzzy" when the trigram fallback
+// produced the results.
+type SearchResponse struct {
+	Query   string         `json:"query"`
+	Mode    string         `json:"mode"`
+	Results []SearchResult `json:"results"`
+}
+
+// prefixTSQuery turns free text into a to_tsquery expression where every
+// term must match as a prefix, e.g. "lord ring" becomes "lord:* & ring:*".
+// Punctuation and tsquery operators in the input are dropped.
+func prefixTSQuery(q string) string {
+	terms := strings.FieldsFunc(q, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(terms) == 0 {
+		return ""
+	}
+	for i := range terms {
+		terms[i] = strings.ToLower(terms[i]) + ":*"
+	}
+	return strings.Join(terms, " & ")
+}
+
+func (h *BookHandler) searchBooks(c *gin.Context) {
+	q := strings.TrimSpace(c.Query("q"))
+	if q == "" {
+		c.JSON(400, gin.H{"error": "Query parameter q is required"})
+		return
+	}
+
+	limit := defaultSearchLimit
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxSearchLimit {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxSearchLimit)})
+			return
+		}
+		limit = n
+	}
+
+	mode, results, err := h.repo.Search(q, limit)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to search books"})
+		return
+	}
+	c.JSON(200, SearchResponse{Query: q, Mode: mode, Results: results})
+}
+
+// prefixColumns qualifies every column in a comma-separated list with
+// table, for queries that join other relations.
+func prefixColumns(table, columns string) string {
+	cols := strings.Split(columns, ", ")
+	for i, col := range cols {
+		cols[i] = table + "." + col
+	}
+	return strings.Join(cols, ", ")
+}
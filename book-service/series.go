@@ -0,0 +1,496 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+const (
+	maxSeriesNameLength        = 300
+	maxSeriesDescriptionLength = 10000
+	maxSeriesPosition          = 999999.99
+)
+
+// Series is an ordered run of books. TotalBooks is the planned number of
+// books when more are announced than the catalog holds; BookCount is the
+// number of live books in the series. Books is only populated when a
+// single series is read.
+type Series struct {
+	ID          string       `json:"id"`
+	Name        string       `json:"name"`
+	Description string       `json:"description,omitempty"`
+	TotalBooks  *int         `json:"total_books,omitempty"`
+	BookCount   int          `json:"book_count"`
+	Books       []SeriesBook `json:"books,omitempty"`
+	CreatedAt   time.Time    `json:"created_at"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+}
+
+// SeriesUpdate carries the editable fields of a series; nil fields are
+// left untouched by PATCH and a total_books of 0 clears it.
+type SeriesUpdate struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+	TotalBooks  *int    `json:"total_books"`
+}
+
+func (u SeriesUpdate) apply(s *Series) {
+	if u.Name != nil {
+		s.Name = *u.Name
+	}
+	if u.Description != nil {
+		s.Description = *u.Description
+	}
+	if u.TotalBooks != nil {
+		s.TotalBooks = u.TotalBooks
+		if *u.TotalBooks == 0 {
+			s.TotalBooks = nil
+		}
+	}
+}
+
+// SeriesBook is a book at its position in a series' reading order.
+type SeriesBook struct {
+	Position float64 `json:"position"`
+	Book     Book    `json:"book"`
+}
+
+// SeriesRef places a book in a series for its detail page: book Position
+// of Total. Total is the series' planned length if set and otherwise the
+// number of whole-numbered live books from position 1 on, so that
+// novellas and prequels do not inflate it.
+type SeriesRef struct {
+	ID       string  `json:"id"`
+	Name     string  `json:"name"`
+	Position float64 `json:"position"`
+	Total    int     `json:"total"`
+}
+
+const seriesColumns = `s.id, s.name, s.description, s.total_books, s.created_at, s.updated_at,
+	(SELECT COUNT(*) FROM series_books sb JOIN books b ON b.id = sb.book_id
+		WHERE sb.series_id = s.id AND b.deleted_at IS NULL)`
+
+func scanSeries(row rowScanner, s *Series) error {
+	return row.Scan(&s.ID, &s.Name, &s.Description, &s.TotalBooks, &s.CreatedAt, &s.UpdatedAt, &s.BookCount)
+}
+
+// validateSeries trims s's fields and reports rule violations.
+func validateSeries(s *Series) ValidationErrors {
+	var errs ValidationErrors
+	s.Name = strings.TrimSpace(s.Name)
+	s.Description = strings.TrimSpace(s.Description)
+
+	if s.Name == "" {
+		errs.add("name", "required", "name is required")
+	} else if utf8.RuneCountInString(s.Name) > maxSeriesNameLength {
+		errs.add("name", "too_long", "name must be at most %d characters", maxSeriesNameLength)
+	}
+	if utf8.RuneCountInString(s.Description) > maxSeriesDescriptionLength {
+		errs.add("description", "too_long", "description must be at most %d characters", maxSeriesDescriptionLength)
+	}
+	if s.TotalBooks != nil && *s.TotalBooks < 1 {
+		errs.add("total_books", "invalid", "total_books must be a positive integer")
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// validateSeriesPosition accepts positions from 0 to maxSeriesPosition
+// with at most two decimal places.
+func validateSeriesPosition(position float64) ValidationErrors {
+	var errs ValidationErrors
+	if position < 0 || position > maxSeriesPosition {
+		errs.add("position", "out_of_range", "position must be between 0 and %.2f", maxSeriesPosition)
+	} else if cents := position * 100; math.Abs(cents-math.Round(cents)) > 1e-6 {
+		errs.add("position", "invalid", "position must have at most two decimal places")
+	}
+	return errs
+}
+
+// bookSeries returns the series a book belongs to, by name.
+func bookSeries(conn *sql.DB, bookID string) ([]SeriesRef, error) {
+	rows, err := conn.Query(`SELECT s.id, s.name, sb.position,
+			COALESCE(s.total_books, (SELECT COUNT(*) FROM series_books o JOIN books ob ON ob.id = o.book_id
+				WHERE o.series_id = s.id AND ob.deleted_at IS NULL AND o.position >= 1 AND o.position = trunc(o.position)))
+		FROM series_books sb JOIN series s ON s.id = sb.series_id
+		WHERE sb.book_id = $1
+		ORDER BY lower(s.name), s.id`, bookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refs := []SeriesRef{}
+	for rows.Next() {
+		var ref SeriesRef
+		if err := rows.Scan(&ref.ID, &ref.Name, &ref.Position, &ref.Total); err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+	return refs, rows.Err()
+}
+
+// seriesBooks returns the live books of a series in reading order.
+func seriesBooks(seriesID string) ([]SeriesBook, error) {
+	rows, err := db.Query(`SELECT `+prefixColumns("b", bookColumns)+`, sb.position
+		FROM series_books sb JOIN books b ON b.id = sb.book_id
+		WHERE sb.series_id = $1 AND b.deleted_at IS NULL
+		ORDER BY sb.position`, seriesID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	books := []SeriesBook{}
+	for rows.Next() {
+		var sb SeriesBook
+		if err := scanBookWith(rows, &sb.Book, &sb.Position); err != nil {
+			return nil, err
+		}
+		books = append(books, sb)
+	}
+	return books, rows.Err()
+}
+
+// enqueueSeriesEvents records a book.updated event for every live book in
+// a series, since each one shows the series' name and length.
+func enqueueSeriesEvents(tx *sql.Tx, seriesID string) error {
+	return enqueueBookEvents(tx, `SELECT sb.book_id FROM series_books sb JOIN books b ON b.id = sb.book_id
+		WHERE sb.series_id = $1 AND b.deleted_at IS NULL`, seriesID)
+}
+
+func respondSeriesError(c *gin.Context, err error, action string) {
+	var errs ValidationErrors
+	var pqErr *pq.Error
+	switch {
+	case err == sql.ErrNoRows:
+		c.JSON(404, gin.H{"error": "Series not found"})
+	case errors.Is(err, errBookNotFound):
+		c.JSON(404, gin.H{"error": "Book not found"})
+	case errors.As(err, &errs):
+		respondValidationErrors(c, errs)
+	case errors.As(err, &pqErr) && pqErr.Code == "23505":
+		c.JSON(409, gin.H{"error": "Another book already has this position in the series"})
+	default:
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to " + action + " series"})
+	}
+}
+
+func listSeries(c *gin.Context) {
+	limit, offset := defaultPageSize, 0
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxPageSize {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxPageSize)})
+			return
+		}
+		limit = n
+	}
+	if raw := c.Query("offset"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			c.JSON(400, gin.H{"error": "offset must be a non-negative integer"})
+			return
+		}
+		offset = n
+	}
+
+	args := []interface{}{limit, offset}
+	where := "TRUE"
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		args = append(args, "%"+escapeLike(strings.ToLower(q))+"%")
+		where = "lower(s.name) LIKE $3"
+	}
+
+	rows, err := db.Query(`SELECT `+seriesColumns+` FROM series s
+		WHERE `+where+`
+		ORDER BY lower(s.name), s.id
+		LIMIT $1 OFFSET $2`, args...)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to fetch series"})
+		return
+	}
+	defer rows.Close()
+
+	list := []Series{}
+	for rows.Next() {
+		var s Series
+		if err := scanSeries(rows, &s); err != nil {
+			log.Printf("Row scan error: %v", err)
+			continue
+		}
+		list = append(list, s)
+	}
+	c.JSON(200, list)
+}
+
+// getSeries returns a series with its books in reading order.
+func getSeries(c *gin.Context) {
+	var s Series
+	if err := scanSeries(db.QueryRow("SELECT "+seriesColumns+" FROM series s WHERE s.id = $1", c.Param("id")), &s); err != nil {
+		respondSeriesError(c, err, "fetch")
+		return
+	}
+	books, err := seriesBooks(s.ID)
+	if err != nil {
+		respondSeriesError(c, err, "fetch")
+		return
+	}
+	s.Books = books
+	c.JSON(200, s)
+}
+
+func createSeries(c *gin.Context) {
+	var s Series
+	if err := c.ShouldBindJSON(&s); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if errs := validateSeries(&s); errs != nil {
+		respondValidationErrors(c, errs)
+		return
+	}
+
+	s.ID, s.BookCount, s.Books = newID(), 0, nil
+	err := db.QueryRow(`INSERT INTO series (id, name, description, total_books) VALUES ($1, $2, $3, $4)
+		RETURNING created_at, updated_at`, s.ID, s.Name, s.Description, s.TotalBooks).Scan(&s.CreatedAt, &s.UpdatedAt)
+	if err != nil {
+		respondSeriesError(c, err, "create")
+		return
+	}
+	c.Header("Location", "/series/"+s.ID)
+	c.JSON(201, s)
+}
+
+func updateSeries(c *gin.Context) {
+	var u SeriesUpdate
+	if err := c.ShouldBindJSON(&u); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	var s Series
+	err := inTx(func(tx *sql.Tx) error {
+		if err := scanSeries(tx.QueryRow("SELECT "+seriesColumns+" FROM series s WHERE s.id = $1 FOR UPDATE OF s", c.Param("id")), &s); err != nil {
+			return err
+		}
+		u.apply(&s)
+		if errs := validateSeries(&s); errs != nil {
+			return errs
+		}
+		err := tx.QueryRow(`UPDATE series SET name = $2, description = $3, total_books = $4, updated_at = now()
+			WHERE id = $1 RETURNING updated_at`, s.ID, s.Name, s.Description, s.TotalBooks).Scan(&s.UpdatedAt)
+		if err != nil {
+			return err
+		}
+		return enqueueSeriesEvents(tx, s.ID)
+	})
+	if err != nil {
+		respondSeriesError(c, err, "update")
+		return
+	}
+	c.JSON(200, s)
+}
+
+// deleteSeries removes a series; its books stay in the catalog.
+func deleteSeries(c *gin.Context) {
+	err := inTx(func(tx *sql.Tx) error {
+		if err := enqueueSeriesEvents(tx, c.Param("id")); err != nil {
+			return err
+		}
+		res, err := tx.Exec("DELETE FROM series WHERE id = $1", c.Param("id"))
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return sql.ErrNoRows
+		}
+		return nil
+	})
+	if err != nil {
+		respondSeriesError(c, err, "delete")
+		return
+	}
+	c.JSON(200, gin.H{"message": "Series deleted successfully"})
+}
+
+// setSeriesBook adds a book to a series at the given position, or moves
+// it there if it is already in the series. A book can belong to several
+// series.
+func setSeriesBook(c *gin.Context) {
+	var in struct {
+		Position *float64 `json:"position"`
+	}
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	var errs ValidationErrors
+	if in.Position == nil {
+		errs.add("position", "required", "position is required")
+	} else {
+		errs = validateSeriesPosition(*in.Position)
+	}
+	if errs != nil {
+		respondValidationErrors(c, errs)
+		return
+	}
+
+	seriesID, bookID := c.Param("id"), c.Param("book_id")
+	var added bool
+	err := inTx(func(tx *sql.Tx) error {
+		var id string
+		if err := tx.QueryRow("SELECT id FROM series WHERE id = $1 FOR UPDATE", seriesID).Scan(&id); err != nil {
+			return err
+		}
+		var live bool
+		if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM books WHERE id = $1 AND deleted_at IS NULL)", bookID).Scan(&live); err != nil {
+			return err
+		}
+		if !live {
+			return errBookNotFound
+		}
+
+		res, err := tx.Exec("UPDATE series_books SET position = $3 WHERE series_id = $1 AND book_id = $2",
+			seriesID, bookID, *in.Position)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			added = true
+			_, err = tx.Exec("INSERT INTO series_books (series_id, book_id, position) VALUES ($1, $2, $3)",
+				seriesID, bookID, *in.Position)
+			if err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec("UPDATE series SET updated_at = now() WHERE id = $1", seriesID); err != nil {
+			return err
+		}
+		return enqueueSeriesEvents(tx, seriesID)
+	})
+	if err != nil {
+		respondSeriesError(c, err, "update")
+		return
+	}
+
+	status := 200
+	if added {
+		status = 201
+	}
+	c.JSON(status, gin.H{"series_id": seriesID, "book_id": bookID, "position": *in.Position})
+}
+
+// removeSeriesBook takes a book out of a series.
+func removeSeriesBook(c *gin.Context) {
+	seriesID, bookID := c.Param("id"), c.Param("book_id")
+	err := inTx(func(tx *sql.Tx) error {
+		var id string
+		if err := tx.QueryRow("SELECT id FROM series WHERE id = $1 FOR UPDATE", seriesID).Scan(&id); err != nil {
+			return err
+		}
+		res, err := tx.Exec("DELETE FROM series_books WHERE series_id = $1 AND book_id = $2", seriesID, bookID)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return errBookNotFound
+		}
+		if _, err := tx.Exec("UPDATE series SET updated_at = now() WHERE id = $1", seriesID); err != nil {
+			return err
+		}
+		if err := enqueueBookEvent(tx, bookUpdatedEvent, bookID); err != nil {
+			return err
+		}
+		return enqueueSeriesEvents(tx, seriesID)
+	})
+	if errors.Is(err, errBookNotFound) {
+		c.JSON(404, gin.H{"error": "Book is not in this series"})
+		return
+	}
+	if err != nil {
+		respondSeriesError(c, err, "update")
+		return
+	}
+	c.JSON(200, gin.H{"message": "Book removed from series"})
+}
+
+// getNextInSeries suggests the caller's next book in a series, using the
+// purchases recorded from order-service's order events. It is the first
+// book after the furthest one they ordered that they have not ordered
+// yet; once they have reached the end it falls back to books they
+// skipped, and next is null when they have ordered them all. Someone who
+// has ordered nothing from the series starts at the beginning.
+func getNextInSeries(c *gin.Context) {
+	var s Series
+	if err := scanSeries(db.QueryRow("SELECT "+seriesColumns+" FROM series s WHERE s.id = $1", c.Param("id")), &s); err != nil {
+		respondSeriesError(c, err, "fetch")
+		return
+	}
+	books, err := seriesBooks(s.ID)
+	if err != nil {
+		respondSeriesError(c, err, "fetch")
+		return
+	}
+
+	rows, err := db.Query(`SELECT DISTINCT p.book_id FROM purchases p
+		JOIN series_books sb ON sb.book_id = p.book_id AND sb.series_id = $2
+		WHERE p.username = $1`, c.GetString("username"), s.ID)
+	if err != nil {
+		respondSeriesError(c, err, "fetch")
+		return
+	}
+	defer rows.Close()
+	ordered := map[string]bool{}
+	orderedIDs := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			respondSeriesError(c, err, "fetch")
+			return
+		}
+		ordered[id] = true
+		orderedIDs = append(orderedIDs, id)
+	}
+	if err := rows.Err(); err != nil {
+		respondSeriesError(c, err, "fetch")
+		return
+	}
+
+	furthest := -1
+	for i, sb := range books {
+		if ordered[sb.Book.ID] {
+			furthest = i
+		}
+	}
+	var next *SeriesBook
+	for _, candidates := range [][]SeriesBook{books[furthest+1:], books} {
+		for i := range candidates {
+			if !ordered[candidates[i].Book.ID] {
+				next = &candidates[i]
+				break
+			}
+		}
+		if next != nil {
+			break
+		}
+	}
+
+	c.JSON(200, gin.H{"series_id": s.ID, "ordered_book_ids": orderedIDs, "next": next})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultTrashRetention = 30 * 24 * time.Hour
+	trashPurgeInterval    = time.Hour
+)
+
+// trashRetention is how long deleted books stay restorable, configured
+// with BOOK_TRASH_RETENTION as a Go duration such as "720h".
+func trashRetention() time.Duration {
+	raw := os.Getenv("BOOK_TRASH_RETENTION")
+	if raw == "" {
+		return defaultTrashRetention
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		log.Printf("Invalid BOOK_TRASH_RETENTION %q, using %s", raw, defaultTrashRetention)
+		return defaultTrashRetention
+	}
+	return d
+}
+
+// listTrash pages through deleted books, most recently deleted first.
+func (h *BookHandler) listTrash(c *gin.Context) {
+	limit, offset := defaultPageSize, 0
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxPageSize {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxPageSize)})
+			return
+		}
+		limit = n
+	}
+	if raw := c.Query("offset"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			c.JSON(400, gin.H{"error": "offset must be a non-negative integer"})
+			return
+		}
+		offset = n
+	}
+
+	books, err := h.repo.ListTrash(limit, offset)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to fetch trash"})
+		return
+	}
+	c.JSON(200, books)
+}
+
+// restoreBook takes a book out of the trash. It fails with 409 if another
+// book has claimed its ISBN in the meantime.
+func (h *BookHandler) restoreBook(c *gin.Context) {
+	id := c.Param("id")
+	b, err := h.repo.Restore(id)
+	if err != nil {
+		if err == errBookNotFound {
+			c.JSON(404, gin.H{"error": "Book not found in trash"})
+			return
+		}
+		if deleted, getErr := h.repo.Get(id, true); getErr == nil {
+			b = deleted
+		}
+		if msg, ok := conflictMessage(err, b); ok {
+			c.JSON(409, gin.H{"error": msg})
+		} else {
+			log.Printf("Database error: %v", err)
+			c.JSON(500, gin.H{"error": "Failed to restore book"})
+		}
+		return
+	}
+	c.Header("ETag", bookETag(b))
+	c.JSON(200, b)
+}
+
+// purgeTrash permanently deletes books that have been in the trash for
+// longer than retention. Dependent rows go with them by cascade; cover
+// images are removed from the blob store afterwards.
+func purgeTrash(retention time.Duration) (int64, error) {
+	rows, err := db.Query("DELETE FROM books WHERE deleted_at < now() - $1 * interval '1 second' RETURNING id", retention.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	for _, id := range ids {
+		deleteCoverBlobs(id)
+	}
+	return int64(len(ids)), nil
+}
+
+// startTrashPurge periodically empties expired books from the trash.
+func startTrashPurge() {
+	retention := trashRetention()
+	go func() {
+		ticker := time.NewTicker(trashPurgeInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			n, err := purgeTrash(retention)
+			if err != nil {
+				log.Printf("Failed to purge trash: %v", err)
+			} else if n > 0 {
+				log.Printf("Purged %d book(s) from the trash", n)
+			}
+		}
+	}()
+}
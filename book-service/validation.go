@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	maxTitleLength       = 500
+	maxAuthorLength      = 300
+	maxPublisherLength   = 300
+	maxDescriptionLength = 10000
+	maxPageCount         = 100000
+)
+
+// bookFormats are the accepted values of Book.Format.
+var bookFormats = map[string]bool{
+	"hardcover": true,
+	"paperback": true,
+	"ebook":     true,
+	"audiobook": true,
+}
+
+// iso639Codes are the ISO 639-1 two-letter language codes.
+var iso639Codes = func() map[string]bool {
+	codes := map[string]bool{}
+	for _, code := range strings.Fields(`
+		aa ab ae af ak am an ar as av ay az ba be bg bh bi bm bn bo br bs ca ce ch co cr cs cu cv cy
+		da de dv dz ee el en eo es et eu fa ff fi fj fo fr fy ga gd gl gn gu gv ha he hi ho hr ht hu
+		hy hz ia id ie ig ii ik io is it iu ja jv ka kg ki kj kk kl km kn ko kr ks ku kv kw ky la lb
+		lg li ln lo lt lu lv mg mh mi mk ml mn mr ms mt my na nb nd ne ng nl nn no nr nv ny oc oj om
+		or os pa pi pl ps pt qu rm rn ro ru rw sa sc sd se sg si sk sl sm sn so sq sr ss st su sv sw
+		ta te tg th ti tk tl tn to tr ts tt tw ty ug uk ur uz ve vi vo wa wo xh yi yo za zh zu`) {
+		codes[code] = true
+	}
+	return codes
+}()
+
+// FieldError describes why one field of a request was rejected.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors collects every FieldError found in a request so that
+// clients can report them all at once.
+type ValidationErrors []FieldError
+
+func (v ValidationErrors) Error() string {
+	msgs := make([]string, len(v))
+	for i, fe := range v {
+		msgs[i] = fe.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (v *ValidationErrors) add(field, code, format string, args ...interface{}) {
+	*v = append(*v, FieldError{Field: field, Code: code, Message: fmt.Sprintf(format, args...)})
+}
+
+// messages returns the error messages as a plain list.
+func (v ValidationErrors) messages() []string {
+	msgs := make([]string, len(v))
+	for i, fe := range v {
+		msgs[i] = fe.Message
+	}
+	return msgs
+}
+
+// respondValidationErrors writes a 422 listing every field error.
+func respondValidationErrors(c *gin.Context, errs ValidationErrors) {
+	c.JSON(422, gin.H{"error": "Validation failed", "fields": errs})
+}
+
+// validateBook normalises b in place (trimmed strings, ISBN-13 without
+// separators, upper-case currency, lower-case language) and returns the
+// rule violations, or nil when b is valid.
+func validateBook(b *Book) ValidationErrors {
+	var errs ValidationErrors
+
+	b.Title = strings.TrimSpace(b.Title)
+	b.Author = strings.TrimSpace(b.Author)
+	b.Publisher = strings.TrimSpace(b.Publisher)
+	b.Description = strings.TrimSpace(b.Description)
+	b.Currency = strings.ToUpper(strings.TrimSpace(b.Currency))
+	b.Language = strings.ToLower(strings.TrimSpace(b.Language))
+	b.Format = strings.ToLower(strings.TrimSpace(b.Format))
+
+	if b.ID != "" && !validBookID.MatchString(b.ID) {
+		errs.add("id", "invalid", "%s", errInvalidBookID.Error())
+	}
+
+	requireLength := func(field, value string, max int) {
+		if value == "" {
+			errs.add(field, "required", "%s is required", field)
+		} else if utf8.RuneCountInString(value) > max {
+			errs.add(field, "too_long", "%s must be at most %d characters", field, max)
+		}
+	}
+	limitLength := func(field, value string, max int) {
+		if utf8.RuneCountInString(value) > max {
+			errs.add(field, "too_long", "%s must be at most %d characters", field, max)
+		}
+	}
+	requireLength("title", b.Title, maxTitleLength)
+	requireLength("author", b.Author, maxAuthorLength)
+	limitLength("publisher", b.Publisher, maxPublisherLength)
+	limitLength("description", b.Description, maxDescriptionLength)
+
+	if b.ISBN != "" {
+		isbn, err := normalizeISBN(b.ISBN)
+		if err != nil {
+			errs.add("isbn", "invalid", "%s", err.Error())
+		} else {
+			b.ISBN = isbn
+		}
+	}
+
+	if b.PriceMinor != nil {
+		if *b.PriceMinor < 0 {
+			errs.add("price_minor", "negative", "price_minor must not be negative")
+		}
+		if b.Currency == "" {
+			errs.add("currency", "required", "currency is required when price_minor is set")
+		}
+	}
+	if b.Currency != "" && !isCurrencyCode(b.Currency) {
+		errs.add("currency", "invalid", "currency must be a three-letter ISO 4217 code")
+	}
+
+	if b.Language != "" && !isLanguageCode(b.Language) {
+		errs.add("language", "invalid", "language must be an ISO 639-1 code such as \"en\" or \"en-gb\"")
+	}
+
+	if b.PageCount != nil && (*b.PageCount < 1 || *b.PageCount > maxPageCount) {
+		errs.add("page_count", "out_of_range", "page_count must be between 1 and %d", maxPageCount)
+	}
+
+	if b.Format != "" && !bookFormats[b.Format] {
+		errs.add("format", "invalid", "format must be one of hardcover, paperback, ebook, audiobook")
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func isCurrencyCode(s string) bool {
+	if len(s) != 3 {
+		return false
+	}
+	for _, r := range s {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// isLanguageCode accepts an ISO 639-1 code optionally followed by a
+// two-letter region, e.g. "en" or "en-gb".
+func isLanguageCode(s string) bool {
+	lang, region, hasRegion := strings.Cut(s, "-")
+	if !iso639Codes[lang] {
+		return false
+	}
+	if !hasRegion {
+		return true
+	}
+	if len(region) != 2 {
+		return false
+	}
+	for _, r := range region {
+		if r < 'a' || r > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeISBN validates an ISBN-10 or ISBN-13 checksum and returns the
+// equivalent ISBN-13 as 13 digits. Hyphens and spaces are ignored.
+func normalizeISBN(s string) (string, error) {
+	s = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(s))
+
+	switch len(s) {
+	case 10:
+		sum := 0
+		for i, r := range s {
+			var d int
+			switch {
+			case r >= '0' && r <= '9':
+				d = int(r - '0')
+			case r == 'X' && i == 9:
+				d = 10
+			default:
+				return "", fmt.Errorf("isbn %q contains invalid characters", s)
+			}
+			sum += (10 - i) * d
+		}
+		if sum%11 != 0 {
+			return "", fmt.Errorf("isbn %q has an invalid ISBN-10 checksum", s)
+		}
+		isbn13 := "978" + s[:9]
+		return isbn13 + string(rune('0'+isbn13CheckDigit(isbn13))), nil
+
+	case 13:
+		for _, r := range s {
+			if r < '0' || r > '9' {
+				return "", fmt.Errorf("isbn %q contains invalid characters", s)
+			}
+		}
+		if !strings.HasPrefix(s, "978") && !strings.HasPrefix(s, "979") {
+			return "", fmt.Errorf("isbn %q must start with 978 or 979", s)
+		}
+		if int(s[12]-'0') != isbn13CheckDigit(s[:12]) {
+			return "", fmt.Errorf("isbn %q has an invalid ISBN-13 checksum", s)
+		}
+		return s, nil
+	}
+	return "", fmt.Errorf("isbn %q must have 10 or 13 digits", s)
+}
+
+// isbn13CheckDigit computes the check digit for the first 12 digits of an
+// ISBN-13.
+func isbn13CheckDigit(digits string) int {
+	sum := 0
+	for i := 0; i < 12; i++ {
+		d := int(digits[i] - '0')
+		if i%2 == 1 {
+			d *= 3
+		}
+		sum += d
+	}
+	return (10 - sum%10) % 10
+}
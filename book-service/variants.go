@@ -0,0 +1,328 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// skuPattern is the accepted shape of a SKU once upper-cased.
+var skuPattern = regexp.MustCompile(`^[A-Z0-9][A-Z0-9._-]{0,63}$`)
+
+// variantStatuses are the accepted values of Variant.Status.
+var variantStatuses = map[string]bool{
+	"available":    true,
+	"preorder":     true,
+	"discontinued": true,
+}
+
+// Variant is a sellable edition of a book, such as its hardcover or its
+// audiobook, with its own SKU, ISBN, price and stock. A variant without a
+// price sells at the book's price. Available is the stock that can still
+// be reserved.
+type Variant struct {
+	ID         string    `json:"id"`
+	BookID     string    `json:"book_id"`
+	SKU        string    `json:"sku"`
+	Format     string    `json:"format"`
+	ISBN       string    `json:"isbn,omitempty"`
+	PriceMinor *int64    `json:"price_minor,omitempty"`
+	Currency   string    `json:"currency,omitempty"`
+	Status     string    `json:"status"`
+	Available  int       `json:"available"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// VariantUpdate carries the editable fields of a variant; nil fields are
+// left untouched by PATCH.
+type VariantUpdate struct {
+	SKU        *string `json:"sku"`
+	Format     *string `json:"format"`
+	ISBN       *string `json:"isbn"`
+	PriceMinor *int64  `json:"price_minor"`
+	Currency   *string `json:"currency"`
+	Status     *string `json:"status"`
+}
+
+func (u VariantUpdate) apply(v *Variant) {
+	if u.SKU != nil {
+		v.SKU = *u.SKU
+	}
+	if u.Format != nil {
+		v.Format = *u.Format
+	}
+	if u.ISBN != nil {
+		v.ISBN = *u.ISBN
+	}
+	if u.PriceMinor != nil {
+		v.PriceMinor = u.PriceMinor
+	}
+	if u.Currency != nil {
+		v.Currency = *u.Currency
+	}
+	if u.Status != nil {
+		v.Status = *u.Status
+	}
+}
+
+// variantSelect reads variants as v together with their available stock,
+// matching scanVariant.
+const variantSelect = `SELECT v.id, v.book_id, v.sku, v.format, v.isbn, v.price_minor, v.currency, v.status,
+		COALESCE((SELECT i.on_hand - i.reserved FROM inventory i WHERE i.variant_id = v.id), 0),
+		v.created_at, v.updated_at
+	FROM book_variants v JOIN books b ON b.id = v.book_id AND b.deleted_at IS NULL`
+
+func scanVariant(row rowScanner, v *Variant) error {
+	return row.Scan(&v.ID, &v.BookID, &v.SKU, &v.Format, &v.ISBN, &v.PriceMinor, &v.Currency, &v.Status,
+		&v.Available, &v.CreatedAt, &v.UpdatedAt)
+}
+
+// validateVariant normalises v in place (upper-case SKU and currency,
+// lower-case format, ISBN-13 without separators) and reports rule
+// violations.
+func validateVariant(v *Variant) ValidationErrors {
+	var errs ValidationErrors
+	v.SKU = strings.ToUpper(strings.TrimSpace(v.SKU))
+	v.Format = strings.ToLower(strings.TrimSpace(v.Format))
+	v.Currency = strings.ToUpper(strings.TrimSpace(v.Currency))
+
+	if v.SKU == "" {
+		errs.add("sku", "required", "sku is required")
+	} else if !skuPattern.MatchString(v.SKU) {
+		errs.add("sku", "invalid", "sku must be 1-64 letters, digits, dots, dashes or underscores")
+	}
+	if !bookFormats[v.Format] {
+		errs.add("format", "invalid", "format must be one of hardcover, paperback, ebook, audiobook")
+	}
+	if v.ISBN != "" {
+		isbn, err := normalizeISBN(v.ISBN)
+		if err != nil {
+			errs.add("isbn", "invalid", "%s", err.Error())
+		} else {
+			v.ISBN = isbn
+		}
+	}
+	if v.PriceMinor != nil {
+		if *v.PriceMinor < 0 {
+			errs.add("price_minor", "negative", "price_minor must not be negative")
+		}
+		if v.Currency == "" {
+			errs.add("currency", "required", "currency is required when price_minor is set")
+		}
+	}
+	if v.Currency != "" && !isCurrencyCode(v.Currency) {
+		errs.add("currency", "invalid", "currency must be a three-letter ISO 4217 code")
+	}
+	if !variantStatuses[v.Status] {
+		errs.add("status", "invalid", "status must be one of available, preorder, discontinued")
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// bookVariants lists the variants of a book, oldest first.
+func bookVariants(conn *sql.DB, bookID string) ([]Variant, error) {
+	rows, err := conn.Query(variantSelect+" WHERE v.book_id = $1 ORDER BY v.created_at, v.id", bookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	variants := []Variant{}
+	for rows.Next() {
+		var v Variant
+		if err := scanVariant(rows, &v); err != nil {
+			return nil, err
+		}
+		variants = append(variants, v)
+	}
+	return variants, rows.Err()
+}
+
+// bookVariant returns one variant of a live book, or sql.ErrNoRows.
+func bookVariant(conn *sql.DB, bookID, variantID string) (Variant, error) {
+	var v Variant
+	err := scanVariant(conn.QueryRow(variantSelect+" WHERE v.book_id = $1 AND v.id = $2", bookID, variantID), &v)
+	return v, err
+}
+
+func respondVariantError(c *gin.Context, err error, action string) {
+	var errs ValidationErrors
+	var pqErr *pq.Error
+	switch {
+	case errors.Is(err, errBookNotFound):
+		c.JSON(404, gin.H{"error": "Book not found"})
+	case err == sql.ErrNoRows:
+		c.JSON(404, gin.H{"error": "Variant not found"})
+	case errors.As(err, &errs):
+		respondValidationErrors(c, errs)
+	case errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "book_variants_isbn_key":
+		c.JSON(409, gin.H{"error": "Another variant already uses this ISBN"})
+	case errors.As(err, &pqErr) && pqErr.Code == "23505":
+		c.JSON(409, gin.H{"error": "Another variant already uses this SKU"})
+	case errors.As(err, &pqErr) && pqErr.Code == "23503":
+		c.JSON(409, gin.H{"error": "Variant has stock history; set its status to discontinued instead"})
+	default:
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to " + action + " variant"})
+	}
+}
+
+func listVariants(c *gin.Context) {
+	id := c.Param("id")
+	exists, err := bookExists(id)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to fetch variants"})
+		return
+	}
+	if !exists {
+		c.JSON(404, gin.H{"error": "Book not found"})
+		return
+	}
+
+	variants, err := bookVariants(db, id)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to fetch variants"})
+		return
+	}
+	c.JSON(200, variants)
+}
+
+func getVariant(c *gin.Context) {
+	v, err := bookVariant(db, c.Param("id"), c.Param("variant_id"))
+	if err != nil {
+		respondVariantError(c, err, "fetch")
+		return
+	}
+	c.JSON(200, v)
+}
+
+// createVariant adds a variant to a book; status defaults to available.
+// The first variant takes over the stock, reservations and adjustment
+// history the book had of its own, since from then on the book is only
+// sold through its variants.
+func createVariant(c *gin.Context) {
+	bookID := c.Param("id")
+	var v Variant
+	if err := c.ShouldBindJSON(&v); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	v.ID, v.BookID = newID(), bookID
+	if v.Status == "" {
+		v.Status = "available"
+	}
+	if errs := validateVariant(&v); errs != nil {
+		respondValidationErrors(c, errs)
+		return
+	}
+
+	err := inTx(func(tx *sql.Tx) error {
+		// Locking the book serialises this with guardBookStock.
+		var hasVariants bool
+		err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM book_variants v WHERE v.book_id = b.id)
+			FROM books b WHERE b.id = $1 AND b.deleted_at IS NULL FOR UPDATE`, bookID).Scan(&hasVariants)
+		if err == sql.ErrNoRows {
+			return errBookNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`INSERT INTO book_variants (id, book_id, sku, format, isbn, price_minor, currency, status)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			v.ID, v.BookID, v.SKU, v.Format, v.ISBN, v.PriceMinor, v.Currency, v.Status)
+		if err != nil {
+			return err
+		}
+		if !hasVariants {
+			for _, table := range []string{"inventory", "stock_reservations", "stock_adjustments"} {
+				_, err := tx.Exec("UPDATE "+table+" SET variant_id = $2 WHERE book_id = $1 AND variant_id IS NULL", bookID, v.ID)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if err := enqueueBookEvent(tx, bookUpdatedEvent, bookID); err != nil {
+			return err
+		}
+		return scanVariant(tx.QueryRow(variantSelect+" WHERE v.id = $1", v.ID), &v)
+	})
+	if err != nil {
+		respondVariantError(c, err, "create")
+		return
+	}
+	c.Header("Location", "/books/"+bookID+"/variants/"+v.ID)
+	c.JSON(201, v)
+}
+
+// updateVariant edits a variant. Set status to discontinued to stop
+// selling it.
+func updateVariant(c *gin.Context) {
+	var u VariantUpdate
+	if err := c.ShouldBindJSON(&u); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	var v Variant
+	err := inTx(func(tx *sql.Tx) error {
+		err := scanVariant(tx.QueryRow(variantSelect+" WHERE v.book_id = $1 AND v.id = $2 FOR UPDATE OF v",
+			c.Param("id"), c.Param("variant_id")), &v)
+		if err != nil {
+			return err
+		}
+		u.apply(&v)
+		if errs := validateVariant(&v); errs != nil {
+			return errs
+		}
+		err = tx.QueryRow(`UPDATE book_variants SET sku = $2, format = $3, isbn = $4, price_minor = $5, currency = $6,
+				status = $7, updated_at = now()
+			WHERE id = $1 RETURNING updated_at`,
+			v.ID, v.SKU, v.Format, v.ISBN, v.PriceMinor, v.Currency, v.Status).Scan(&v.UpdatedAt)
+		if err != nil {
+			return err
+		}
+		return enqueueBookEvent(tx, bookUpdatedEvent, v.BookID)
+	})
+	if err != nil {
+		respondVariantError(c, err, "update")
+		return
+	}
+	c.JSON(200, v)
+}
+
+// deleteVariant removes a variant that was never stocked. Variants with
+// stock history are discontinued instead so that past orders still
+// resolve.
+func deleteVariant(c *gin.Context) {
+	bookID := c.Param("id")
+	err := inTx(func(tx *sql.Tx) error {
+		res, err := tx.Exec(`DELETE FROM book_variants v USING books b
+			WHERE v.book_id = $1 AND v.id = $2 AND b.id = v.book_id AND b.deleted_at IS NULL`, bookID, c.Param("variant_id"))
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return sql.ErrNoRows
+		}
+		return enqueueBookEvent(tx, bookUpdatedEvent, bookID)
+	})
+	if err != nil {
+		respondVariantError(c, err, "delete")
+		return
+	}
+	c.JSON(200, gin.H{"message": "Variant deleted successfully"})
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+const (
+	maxWishlistNameLength = 100
+	maxWishlistsPerUser   = 50
+	maxWishlistItems      = 500
+)
+
+var (
+	errTooManyWishlists     = errors.New("too many wishlists")
+	errTooManyWishlistItems = errors.New("too many wishlist items")
+)
+
+// Wishlist is a named list of books a customer saved for later. Items is
+// only populated when a single list is read.
+type Wishlist struct {
+	ID         string         `json:"id"`
+	Name       string         `json:"name"`
+	ShareToken string         `json:"share_token,omitempty"`
+	ItemCount  int            `json:"item_count"`
+	Items      []WishlistItem `json:"items,omitempty"`
+	CreatedAt  time.Time      `json:"created_at"`
+	UpdatedAt  time.Time      `json:"updated_at"`
+}
+
+// WishlistItem is a saved book. Books that have since been deleted stay on
+// the list with Available false and the title and author they had when
+// they were saved.
+type WishlistItem struct {
+	BookID     string    `json:"book_id"`
+	Title      string    `json:"title"`
+	Author     string    `json:"author"`
+	PriceMinor *int64    `json:"price_minor,omitempty"`
+	Currency   string    `json:"currency,omitempty"`
+	Available  bool      `json:"available"`
+	AddedAt    time.Time `json:"added_at"`
+}
+
+const wishlistColumns = `w.id, w.name, COALESCE(w.share_token, ''), w.created_at, w.updated_at,
+	(SELECT COUNT(*) FROM wishlist_items wi WHERE wi.wishlist_id = w.id)`
+
+func scanWishlist(row rowScanner, w *Wishlist) error {
+	return row.Scan(&w.ID, &w.Name, &w.ShareToken, &w.CreatedAt, &w.UpdatedAt, &w.ItemCount)
+}
+
+// validateWishlistName trims name and reports rule violations.
+func validateWishlistName(name *string) ValidationErrors {
+	var errs ValidationErrors
+	*name = strings.TrimSpace(*name)
+	if *name == "" {
+		errs.add("name", "required", "name is required")
+	} else if utf8.RuneCountInString(*name) > maxWishlistNameLength {
+		errs.add("name", "too_long", "name must be at most %d characters", maxWishlistNameLength)
+	}
+	return errs
+}
+
+// newShareToken returns 256 random bits, URL-safe encoded.
+func newShareToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// wishlistItems returns the books saved on a list, most recently added
+// first, with the current title, author and price of books still in the
+// catalog.
+func wishlistItems(wishlistID string) ([]WishlistItem, error) {
+	rows, err := db.Query(`SELECT wi.book_id, COALESCE(b.title, wi.title), COALESCE(b.author, wi.author),
+			b.price_minor, COALESCE(b.currency, ''), b.id IS NOT NULL, wi.added_at
+		FROM wishlist_items wi
+		LEFT JOIN books b ON b.id = wi.book_id AND b.deleted_at IS NULL
+		WHERE wi.wishlist_id = $1
+		ORDER BY wi.added_at DESC, wi.book_id`, wishlistID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []WishlistItem{}
+	for rows.Next() {
+		var item WishlistItem
+		if err := rows.Scan(&item.BookID, &item.Title, &item.Author, &item.PriceMinor, &item.Currency,
+			&item.Available, &item.AddedAt); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// respondWishlist writes w together with its items.
+func respondWishlist(c *gin.Context, w Wishlist) {
+	items, err := wishlistItems(w.ID)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to fetch wishlist"})
+		return
+	}
+	w.Items = items
+	c.JSON(200, w)
+}
+
+func respondWishlistError(c *gin.Context, err error, action string) {
+	var errs ValidationErrors
+	var pqErr *pq.Error
+	switch {
+	case err == sql.ErrNoRows:
+		c.JSON(404, gin.H{"error": "Wishlist not found"})
+	case errors.Is(err, errBookNotFound):
+		c.JSON(404, gin.H{"error": "Book not found"})
+	case errors.As(err, &errs):
+		respondValidationErrors(c, errs)
+	case errors.Is(err, errTooManyWishlists):
+		c.JSON(409, gin.H{"error": "You can have at most 50 wishlists"})
+	case errors.Is(err, errTooManyWishlistItems):
+		c.JSON(409, gin.H{"error": "A wishlist can hold at most 500 books"})
+	case errors.As(err, &pqErr) && pqErr.Code == "23505":
+		c.JSON(409, gin.H{"error": "You already have a wishlist with this name"})
+	default:
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to " + action + " wishlist"})
+	}
+}
+
+// lockWishlist locks one of the caller's lists for the rest of tx,
+// returning sql.ErrNoRows for lists that are missing or someone else's.
+func lockWishlist(tx *sql.Tx, c *gin.Context) error {
+	var id string
+	return tx.QueryRow("SELECT id FROM wishlists WHERE id = $1 AND username = $2 FOR UPDATE",
+		c.Param("list_id"), c.GetString("username")).Scan(&id)
+}
+
+// listWishlists returns the caller's lists, oldest first, without items.
+func listWishlists(c *gin.Context) {
+	rows, err := db.Query("SELECT "+wishlistColumns+" FROM wishlists w WHERE w.username = $1 ORDER BY w.created_at, w.id",
+		c.GetString("username"))
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to fetch wishlists"})
+		return
+	}
+	defer rows.Close()
+
+	wishlists := []Wishlist{}
+	for rows.Next() {
+		var w Wishlist
+		if err := scanWishlist(rows, &w); err != nil {
+			log.Printf("Row scan error: %v", err)
+			continue
+		}
+		wishlists = append(wishlists, w)
+	}
+	c.JSON(200, wishlists)
+}
+
+func createWishlist(c *gin.Context) {
+	var in struct {
+		Name string `json:"name"`
+	}
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if errs := validateWishlistName(&in.Name); errs != nil {
+		respondValidationErrors(c, errs)
+		return
+	}
+
+	username := c.GetString("username")
+	w := Wishlist{ID: newID(), Name: in.Name}
+	err := inTx(func(tx *sql.Tx) error {
+		// Serialise list creation per user so that the limit holds.
+		if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('wishlists:' || $1))", username); err != nil {
+			return err
+		}
+		var count int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM wishlists WHERE username = $1", username).Scan(&count); err != nil {
+			return err
+		}
+		if count >= maxWishlistsPerUser {
+			return errTooManyWishlists
+		}
+		return tx.QueryRow("INSERT INTO wishlists (id, username, name) VALUES ($1, $2, $3) RETURNING created_at, updated_at",
+			w.ID, username, w.Name).Scan(&w.CreatedAt, &w.UpdatedAt)
+	})
+	if err != nil {
+		respondWishlistError(c, err, "create")
+		return
+	}
+	c.Header("Location", "/wishlist/"+w.ID)
+	c.JSON(201, w)
+}
+
+func getWishlist(c *gin.Context) {
+	var w Wishlist
+	err := scanWishlist(db.QueryRow("SELECT "+wishlistColumns+" FROM wishlists w WHERE w.id = $1 AND w.username = $2",
+		c.Param("list_id"), c.GetString("username")), &w)
+	if err != nil {
+		respondWishlistError(c, err, "fetch")
+		return
+	}
+	respondWishlist(c, w)
+}
+
+func renameWishlist(c *gin.Context) {
+	var in struct {
+		Name string `json:"name"`
+	}
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if errs := validateWishlistName(&in.Name); errs != nil {
+		respondValidationErrors(c, errs)
+		return
+	}
+
+	var w Wishlist
+	err := scanWishlist(db.QueryRow(`UPDATE wishlists w SET name = $3, updated_at = now()
+		WHERE w.id = $1 AND w.username = $2 RETURNING `+wishlistColumns,
+		c.Param("list_id"), c.GetString("username"), in.Name), &w)
+	if err != nil {
+		respondWishlistError(c, err, "update")
+		return
+	}
+	c.JSON(200, w)
+}
+
+func deleteWishlist(c *gin.Context) {
+	res, err := db.Exec("DELETE FROM wishlists WHERE id = $1 AND username = $2", c.Param("list_id"), c.GetString("username"))
+	if err != nil {
+		respondWishlistError(c, err, "delete")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(404, gin.H{"error": "Wishlist not found"})
+		return
+	}
+	c.JSON(200, gin.H{"message": "Wishlist deleted successfully"})
+}
+
+// addWishlistItem saves a book to one of the caller's lists. Saving a
+// book that is already on the list succeeds without changing it.
+func addWishlistItem(c *gin.Context) {
+	var in struct {
+		BookID string `json:"book_id"`
+	}
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	in.BookID = strings.TrimSpace(in.BookID)
+	if in.BookID == "" {
+		var errs ValidationErrors
+		errs.add("book_id", "required", "book_id is required")
+		respondValidationErrors(c, errs)
+		return
+	}
+
+	var added bool
+	err := inTx(func(tx *sql.Tx) error {
+		if err := lockWishlist(tx, c); err != nil {
+			return err
+		}
+		var title, author string
+		err := tx.QueryRow("SELECT title, author FROM books WHERE id = $1 AND deleted_at IS NULL", in.BookID).Scan(&title, &author)
+		if err == sql.ErrNoRows {
+			return errBookNotFound
+		}
+		if err != nil {
+			return err
+		}
+		var count int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM wishlist_items WHERE wishlist_id = $1", c.Param("list_id")).Scan(&count); err != nil {
+			return err
+		}
+		if count >= maxWishlistItems {
+			return errTooManyWishlistItems
+		}
+
+		res, err := tx.Exec(`INSERT INTO wishlist_items (wishlist_id, book_id, title, author) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (wishlist_id, book_id) DO NOTHING`, c.Param("list_id"), in.BookID, title, author)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return nil
+		}
+		added = true
+		_, err = tx.Exec("UPDATE wishlists SET updated_at = now() WHERE id = $1", c.Param("list_id"))
+		return err
+	})
+	if err != nil {
+		respondWishlistError(c, err, "update")
+		return
+	}
+
+	status := 200
+	if added {
+		status = 201
+	}
+	c.JSON(status, gin.H{"wishlist_id": c.Param("list_id"), "book_id": in.BookID, "added": added})
+}
+
+// removeWishlistItem takes a book off one of the caller's lists, whether
+// or not the book still exists.
+func removeWishlistItem(c *gin.Context) {
+	err := inTx(func(tx *sql.Tx) error {
+		if err := lockWishlist(tx, c); err != nil {
+			return err
+		}
+		res, err := tx.Exec("DELETE FROM wishlist_items WHERE wishlist_id = $1 AND book_id = $2", c.Param("list_id"), c.Param("book_id"))
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return errBookNotFound
+		}
+		_, err = tx.Exec("UPDATE wishlists SET updated_at = now() WHERE id = $1", c.Param("list_id"))
+		return err
+	})
+	if errors.Is(err, errBookNotFound) {
+		c.JSON(404, gin.H{"error": "Book is not on this wishlist"})
+		return
+	}
+	if err != nil {
+		respondWishlistError(c, err, "update")
+		return
+	}
+	c.JSON(200, gin.H{"message": "Book removed from wishlist"})
+}
+
+// shareWishlist gives one of the caller's lists a new share token,
+// replacing any previous one so that old links stop working.
+func shareWishlist(c *gin.Context) {
+	token, err := newShareToken()
+	if err != nil {
+		log.Printf("Failed to generate share token: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to share wishlist"})
+		return
+	}
+	var w Wishlist
+	err = scanWishlist(db.QueryRow(`UPDATE wishlists w SET share_token = $3, updated_at = now()
+		WHERE w.id = $1 AND w.username = $2 RETURNING `+wishlistColumns,
+		c.Param("list_id"), c.GetString("username"), token), &w)
+	if err != nil {
+		respondWishlistError(c, err, "share")
+		return
+	}
+	c.JSON(200, gin.H{"wishlist": w, "share_token": token, "share_url": "/shared/wishlists/" + token})
+}
+
+// unshareWishlist revokes a list's share link.
+func unshareWishlist(c *gin.Context) {
+	var w Wishlist
+	err := scanWishlist(db.QueryRow(`UPDATE wishlists w SET share_token = NULL, updated_at = now()
+		WHERE w.id = $1 AND w.username = $2 RETURNING `+wishlistColumns,
+		c.Param("list_id"), c.GetString("username")), &w)
+	if err != nil {
+		respondWishlistError(c, err, "unshare")
+		return
+	}
+	c.JSON(200, w)
+}
+
+// getSharedWishlist is the public, read-only view of a shared list. It
+// does not reveal the owner or the token.
+func getSharedWishlist(c *gin.Context) {
+	var w Wishlist
+	err := scanWishlist(db.QueryRow("SELECT "+wishlistColumns+" FROM wishlists w WHERE w.share_token = $1",
+		c.Param("token")), &w)
+	if err != nil {
+		respondWishlistError(c, err, "fetch")
+		return
+	}
+	w.ShareToken = ""
+	respondWishlist(c, w)
+}
@@ -1,7 +1,7 @@
 import React, { useState, useEffect } from 'react';
 import { Book } from '../types';
 import { apiService } from '../services/api';
-import { Plus, Trash2, ShoppingCart } from 'lucide-react';
+import { Plus, Trash2, ShoppingCart, ImagePlus } from 'lucide-react';
 import toast from 'react-hot-toast';
 
 const BookList: React.FC = () => {
@@ -9,6 +9,10 @@ const BookList: React.FC = () => {
   const [isLoading, setIsLoading] = useState(true);
   const [showAddForm, setShowAddForm] = useState(false);
   const [newBook, setNewBook] = useState({ title: '', author: '' });
+  // Books whose cover failed to load, and the upload time of fresh covers
+  // so the browser refetches them.
+  const [missingCovers, setMissingCovers] = useState<Set<string>>(new Set());
+  const [coverVersions, setCoverVersions] = useState<Record<string, string>>({});
 
   useEffect(() => {
     loadBooks();
@@ -16,8 +20,8 @@ const BookList: React.FC = () => {
 
   const loadBooks = async () => {
     try {
-      const booksData = await apiService.getBooks();
-      setBooks(booksData);
+      const page = await apiService.getBooks({ limit: 200 });
+      setBooks(page.items);
     } catch (error: any) {
       toast.error('Failed to load books');
     } finally {
@@ -28,12 +32,8 @@ const BookList: React.FC = () => {
   const handleAddBook = async (e: React.FormEvent) => {
     e.preventDefault();
     try {
-      // Generate a unique ID for the book
-      const bookWithId = {
-        ...newBook,
-        id: Date.now().toString()
-      };
-      const book = await apiService.createBook(bookWithId);
+      // The book service assigns the ID
+      const book = await apiService.createBook(newBook);
       setBooks([...books, book]);
       setNewBook({ title: '', author: '' });
       setShowAddForm(false);
@@ -53,6 +53,19 @@ const BookList: React.FC = () => {
     }
   };
 
+  const handleUploadCover = async (id: string, file: File) => {
+    try {
+      const cover = await apiService.uploadCover(id, file);
+      setCoverVersions({ ...coverVersions, [id]: cover.updated_at });
+      const missing = new Set(missingCovers);
+      missing.delete(id);
+      setMissingCovers(missing);
+      toast.success('Cover uploaded!');
+    } catch (error: any) {
+      toast.error(error.response?.data?.error || 'Failed to upload cover');
+    }
+  };
+
   const handleOrderBook = async (book: Book) => {
     try {
       await apiService.placeOrder({ book_id: book.id });
@@ -129,6 +142,14 @@ const BookList: React.FC = () => {
       <div className="grid grid-cols-1 md:grid-cols-2 lg:grid-cols-3 gap-6">
         {books.map((book) => (
           <div key={book.id} className="bg-white rounded-lg shadow p-6">
+            {!missingCovers.has(book.id) && (
+              <img
+                src={apiService.coverUrl(book.id, 'medium', coverVersions[book.id])}
+                alt={`Cover of ${book.title}`}
+                className="w-full h-48 object-contain mb-4"
+                onError={() => setMissingCovers(new Set(missingCovers).add(book.id))}
+              />
+            )}
             <div className="flex justify-between items-start mb-4">
               <div>
                 <h3 className="text-lg font-semibold text-gray-900">{book.title}</h3>
@@ -150,6 +171,24 @@ const BookList: React.FC = () => {
                 <ShoppingCart className="h-4 w-4 mr-2" />
                 Order
               </button>
+              <label
+                className="inline-flex items-center justify-center px-3 py-2 border border-gray-300 text-sm font-medium rounded-md text-gray-700 bg-white hover:bg-gray-50 cursor-pointer"
+                title="Upload cover"
+              >
+                <ImagePlus className="h-4 w-4" />
+                <input
+                  type="file"
+                  accept="image/jpeg,image/png,image/gif,image/webp"
+                  className="hidden"
+                  onChange={(e) => {
+                    const file = e.target.files?.[0];
+                    if (file) {
+                      handleUploadCover(book.id, file);
+                    }
+                    e.target.value = '';
+                  }}
+                />
+              </label>
             </div>
           </div>
         ))}
@@ -1,5 +1,5 @@
 import axios, { AxiosInstance } from 'axios';
-import { Book, Order, LoginCredentials, LoginResponse, OrderResponse } from '../types';
+import { Book, BookListParams, BookPage, Cover, CoverSize, Order, LoginCredentials, LoginResponse, OrderResponse } from '../types';
 
 export interface User {
   username: string;
@@ -26,7 +26,7 @@ export interface OrderHistory {
 
 export interface BookStats {
   total_books: number;
-  top_authors: Array<{ author: string; count: number }>;
+  top_authors: Array<{ author_id: string; author: string; count: number }>;
   last_updated: string;
 }
 
@@ -86,8 +86,8 @@ class ApiService {
   }
 
   // Book Service
-  async getBooks(): Promise<Book[]> {
-    const response = await this.api.get('/books');
+  async getBooks(params: BookListParams = {}): Promise<BookPage> {
+    const response = await this.api.get('/books', { params: { ...params, envelope: 1 } });
     return response.data;
   }
 
@@ -96,7 +96,7 @@ class ApiService {
     return response.data;
   }
 
-  async createBook(book: Book): Promise<Book> {
+  async createBook(book: Omit<Book, 'id'> & { id?: string }): Promise<Book> {
     const response = await this.api.post('/books', book);
     return response.data;
   }
@@ -105,6 +105,24 @@ class ApiService {
     await this.api.delete(`/books/${id}`);
   }
 
+  // Cover images are public, so the URL can be used directly in <img> tags.
+  coverUrl(id: string, size: CoverSize = 'medium', version?: string): string {
+    const query = new URLSearchParams({ size });
+    if (version) {
+      query.set('v', version);
+    }
+    return `${this.api.defaults.baseURL}/books/${encodeURIComponent(id)}/cover?${query}`;
+  }
+
+  async uploadCover(id: string, file: File): Promise<Cover> {
+    const form = new FormData();
+    form.append('cover', file);
+    const response = await this.api.post(`/books/${id}/cover`, form, {
+      headers: { 'Content-Type': 'multipart/form-data' },
+    });
+    return response.data;
+  }
+
   async getBookStats(): Promise<BookStats> {
     const response = await this.api.get('/books/stats');
     return response.data;
@@ -2,10 +2,120 @@ export interface Book {
   id: string;
   title: string;
   author: string;
+  isbn?: string;
+  price_minor?: number;
+  currency?: string;
+  description?: string;
+  publisher?: string;
+  publication_date?: string;
+  language?: string;
+  page_count?: number;
+  format?: string;
+  version?: number;
+  rating_average?: number;
+  rating_count?: number;
+  prices?: BookPrice[];
+  display_price?: DisplayPrice;
+  variants?: Variant[];
+  series?: SeriesRef[];
+  created_at?: string;
+  updated_at?: string;
+}
+
+export interface BookPrice {
+  currency: string;
+  price_minor: number;
+}
+
+export interface Variant {
+  id: string;
+  book_id: string;
+  sku: string;
+  format: string;
+  isbn?: string;
+  price_minor?: number;
+  currency?: string;
+  status: 'available' | 'preorder' | 'discontinued';
+  available: number;
+  created_at: string;
+  updated_at: string;
+}
+
+export interface SeriesRef {
+  id: string;
+  name: string;
+  position: number;
+  total: number;
+}
+
+export interface Series {
+  id: string;
+  name: string;
+  description?: string;
+  total_books?: number;
+  book_count: number;
+  books?: { position: number; book: Book }[];
+  created_at: string;
+  updated_at: string;
+}
+
+export interface WishlistItem {
+  book_id: string;
+  title: string;
+  author: string;
+  price_minor?: number;
+  currency?: string;
+  available: boolean;
+  added_at: string;
+}
+
+export interface Wishlist {
+  id: string;
+  name: string;
+  share_token?: string;
+  item_count: number;
+  items?: WishlistItem[];
+  created_at: string;
+  updated_at: string;
+}
+
+export interface DisplayPrice {
+  currency: string;
+  price_minor: number;
+  source: 'list' | 'converted';
+  exchange_rate?: string;
+  rate_effective_from?: string;
+}
+
+export type CoverSize = 'small' | 'medium' | 'large' | 'original';
+
+export interface Cover {
+  book_id: string;
+  content_type: string;
+  width: number;
+  height: number;
+  size_bytes: number;
+  updated_at: string;
+}
+
+export interface BookListParams {
+  limit?: number;
+  cursor?: string;
+  sort?: 'title' | 'author' | 'created_at' | 'price' | 'rating' | '-title' | '-author' | '-created_at' | '-price' | '-rating';
+  author?: string;
+  title_prefix?: string;
+  include_total?: boolean;
+}
+
+export interface BookPage {
+  items: Book[];
+  next_cursor?: string;
+  total?: number;
 }
 
 export interface Order {
   book_id: string;
+  variant_id?: string;
 }
 
 export interface OrderResponse {
@@ -21,6 +131,17 @@ export interface LoginResponse {
   token: string;
 }
 
+export interface FieldError {
+  field: string;
+  code: string;
+  message: string;
+}
+
+export interface ValidationErrorResponse {
+  error: string;
+  fields: FieldError[];
+}
+
 export interface ApiResponse<T> {
   data?: T;
   error?: string;
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
@@ -15,31 +17,97 @@ import (
 
 var jwtKey = []byte(os.Getenv("JWT_SECRET"))
 
+// Order asks for one copy of a book. Books sold in variants need
+// VariantID unless they only have one.
 type Order struct {
-	BookID string `json:"book_id"`
+	BookID    string `json:"book_id"`
+	VariantID string `json:"variant_id"`
+	PromoCode string `json:"promo_code"`
 }
 
 type OrderHistory struct {
-	ID         string    `json:"id"`
-	BookID     string    `json:"book_id"`
-	BookTitle  string    `json:"book_title"`
-	BookAuthor string    `json:"book_author"`
-	OrderDate  time.Time `json:"order_date"`
-	Status     string    `json:"status"`
-	Username   string    `json:"username"`
+	ID            string    `json:"id"`
+	BookID        string    `json:"book_id"`
+	BookTitle     string    `json:"book_title"`
+	BookAuthor    string    `json:"book_author"`
+	VariantID     string    `json:"variant_id,omitempty"`
+	SKU           string    `json:"sku,omitempty"`
+	Format        string    `json:"format,omitempty"`
+	OrderDate     time.Time `json:"order_date"`
+	Status        string    `json:"status"`
+	Username      string    `json:"username"`
+	PriceMinor    *int64    `json:"price_minor,omitempty"`
+	DiscountMinor int64     `json:"discount_minor,omitempty"`
+	Currency      string    `json:"currency,omitempty"`
+	PromoCode     string    `json:"promo_code,omitempty"`
 }
 
 type Book struct {
+	ID       string    `json:"id"`
+	Title    string    `json:"title"`
+	Author   string    `json:"author"`
+	Variants []Variant `json:"variants"`
+}
+
+// Variant is the subset of a book-service variant that an order records.
+type Variant struct {
 	ID     string `json:"id"`
-	Title  string `json:"title"`
-	Author string `json:"author"`
+	SKU    string `json:"sku"`
+	Format string `json:"format"`
+	Status string `json:"status"`
+}
+
+// chooseVariant picks the variant an order is for: the one asked for, or
+// the only one a book has. It returns nil for books not sold in variants.
+func chooseVariant(book Book, variantID string) (*Variant, error) {
+	if len(book.Variants) == 0 {
+		if variantID != "" {
+			return nil, fmt.Errorf("book %s has no variant %s", book.ID, variantID)
+		}
+		return nil, nil
+	}
+	if variantID == "" {
+		if len(book.Variants) > 1 {
+			return nil, fmt.Errorf("book %s is sold in %d variants; choose one with variant_id", book.ID, len(book.Variants))
+		}
+		return &book.Variants[0], nil
+	}
+	for i := range book.Variants {
+		if book.Variants[i].ID == variantID {
+			return &book.Variants[i], nil
+		}
+	}
+	return nil, fmt.Errorf("book %s has no variant %s", book.ID, variantID)
+}
+
+// PriceQuote is the subset of book-service's price quote that an order
+// records. Error and CodeStatus are set when pricing fails.
+type PriceQuote struct {
+	PriceMinor    int64  `json:"price_minor"`
+	DiscountMinor int64  `json:"discount_minor"`
+	Currency      string `json:"currency"`
+	Error         string `json:"error"`
+	CodeStatus    string `json:"code_status"`
+}
+
+// Reservation is the subset of book-service's stock reservation that the
+// order flow needs.
+type Reservation struct {
+	ID     int64  `json:"id"`
+	Status string `json:"status"`
 }
 
 type Claims struct {
 	Username string `json:"username"`
+	Role     string `json:"role,omitempty"`
 	jwt.RegisteredClaims
 }
 
+// serviceRole is the role of the tokens the order service signs for the
+// book-service routes that customers may not call, such as redeeming
+// promotions. book-service grants it pricing:redeem.
+const serviceRole = "order-service"
+
 // In-memory order storage (in production, this would be in a database)
 var orderHistory []OrderHistory
 
@@ -76,6 +144,97 @@ func verifyJWT() gin.HandlerFunc {
 	}
 }
 
+// bookServiceRequest calls book-service on behalf of the current user by
+// forwarding their Authorization header.
+func bookServiceRequest(c *gin.Context, method, path string, payload interface{}) (*http.Response, error) {
+	return sendBookServiceRequest(c.GetHeader("Authorization"), method, path, payload)
+}
+
+// serviceRequest calls book-service as the order service acting for the
+// caller, with a short-lived token in serviceRole naming the caller.
+func serviceRequest(c *gin.Context, method, path string, payload interface{}) (*http.Response, error) {
+	now := time.Now()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{
+		Username: c.GetString("username"),
+		Role:     serviceRole,
+		RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+		},
+	}).SignedString(jwtKey)
+	if err != nil {
+		return nil, err
+	}
+	return sendBookServiceRequest("Bearer "+token, method, path, payload)
+}
+
+// sendBookServiceRequest sends payload, if any, as JSON with the given
+// Authorization header.
+func sendBookServiceRequest(authorization, method, path string, payload interface{}) (*http.Response, error) {
+	var body io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, os.Getenv("BOOK_SERVICE_URL")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", authorization)
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// resolveReservation commits or releases a stock reservation.
+func resolveReservation(c *gin.Context, reservationID int64, action string) error {
+	resp, err := bookServiceRequest(c, http.MethodPost, fmt.Sprintf("/reservations/%d/%s", reservationID, action), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("book service returned status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// priceOrder asks book-service for the effective price of the book, or
+// of its variant, and records the promotions it applied against the
+// order. It returns book-service's status: 422 means the promo code
+// cannot be used or the book has no price.
+func priceOrder(c *gin.Context, bookID, variantID, orderID, promoCode string) (quote PriceQuote, status int, err error) {
+	resp, err := serviceRequest(c, http.MethodPost, "/books/"+bookID+"/price/redeem",
+		map[string]interface{}{"order_id": orderID, "variant_id": variantID, "code": promoCode})
+	if err != nil {
+		return quote, 0, err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&quote); err != nil {
+		return quote, resp.StatusCode, err
+	}
+	return quote, resp.StatusCode, nil
+}
+
+// releaseRedemptions undoes the promotion redemptions priceOrder recorded
+// for an order that could not be placed.
+func releaseRedemptions(c *gin.Context, bookID, orderID string) error {
+	resp, err := serviceRequest(c, http.MethodDelete, "/books/"+bookID+"/price/redemptions/"+orderID, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("book service returned status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
 func getOrderHistory(c *gin.Context) {
 	username := c.GetString("username")
 
@@ -102,9 +261,8 @@ func placeOrder(c *gin.Context) {
 		return
 	}
 
-	bookServiceURL := fmt.Sprintf("%s/books/%s", os.Getenv("BOOK_SERVICE_URL"), o.BookID)
-	log.Printf("Attempting to fetch book from: %s", bookServiceURL)
-	resp, err := http.Get(bookServiceURL)
+	log.Printf("Attempting to fetch book %s from book service", o.BookID)
+	resp, err := bookServiceRequest(c, http.MethodGet, "/books/"+o.BookID, nil)
 	if err != nil {
 		log.Printf("Error fetching book: %v", err)
 		c.JSON(500, gin.H{"error": "Failed to fetch book"})
@@ -121,8 +279,48 @@ func placeOrder(c *gin.Context) {
 	var book Book
 	json.NewDecoder(resp.Body).Decode(&book)
 
+	variant, err := chooseVariant(book, o.VariantID)
+	if err != nil {
+		c.JSON(422, gin.H{"error": err.Error(), "variants": book.Variants})
+		return
+	}
+	if variant != nil && variant.Status == "discontinued" {
+		c.JSON(409, gin.H{"error": "This edition is no longer sold", "variant_id": variant.ID})
+		return
+	}
+
+	orderID := fmt.Sprintf("ord_%d", time.Now().UnixNano())
+
+	// Hold a copy so concurrent orders cannot oversell the book
+	stockPath := "/books/" + book.ID
+	if variant != nil {
+		stockPath += "/variants/" + variant.ID
+	}
+	reserveResp, err := bookServiceRequest(c, http.MethodPost, stockPath+"/stock/reservations",
+		map[string]interface{}{"quantity": 1, "reference": orderID})
+	if err != nil {
+		log.Printf("Error reserving stock: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to reserve stock"})
+		return
+	}
+	defer reserveResp.Body.Close()
+	if reserveResp.StatusCode == http.StatusConflict {
+		c.JSON(409, gin.H{"error": "Book is out of stock"})
+		return
+	}
+	if reserveResp.StatusCode == http.StatusTooManyRequests {
+		c.JSON(429, gin.H{"error": "You have too many pending stock reservations; try again shortly"})
+		return
+	}
+	if reserveResp.StatusCode != http.StatusCreated {
+		log.Printf("Book service returned status code %d for reservation", reserveResp.StatusCode)
+		c.JSON(500, gin.H{"error": "Failed to reserve stock"})
+		return
+	}
+	var reservation Reservation
+	json.NewDecoder(reserveResp.Body).Decode(&reservation)
+
 	// Create order history entry
-	orderID := fmt.Sprintf("ord_%d", time.Now().Unix())
 	newOrder := OrderHistory{
 		ID:         orderID,
 		BookID:     book.ID,
@@ -132,6 +330,46 @@ func placeOrder(c *gin.Context) {
 		Status:     "completed",
 		Username:   username,
 	}
+	if variant != nil {
+		newOrder.VariantID, newOrder.SKU, newOrder.Format = variant.ID, variant.SKU, variant.Format
+	}
+
+	// Price the order with the same promotions the book page showed
+	quote, status, err := priceOrder(c, book.ID, newOrder.VariantID, orderID, o.PromoCode)
+	switch {
+	case err == nil && status == http.StatusOK:
+		newOrder.PriceMinor = &quote.PriceMinor
+		newOrder.DiscountMinor = quote.DiscountMinor
+		newOrder.Currency = quote.Currency
+		newOrder.PromoCode = o.PromoCode
+	case err == nil && status == http.StatusUnprocessableEntity && quote.CodeStatus == "" && o.PromoCode == "":
+		// The book has no price; the order goes through unpriced
+	default:
+		if err := resolveReservation(c, reservation.ID, "release"); err != nil {
+			log.Printf("Failed to release reservation %d: %v", reservation.ID, err)
+		}
+		if err == nil && status == http.StatusUnprocessableEntity {
+			c.JSON(422, gin.H{"error": quote.Error, "code_status": quote.CodeStatus})
+			return
+		}
+		log.Printf("Failed to price order %s (status %d): %v", orderID, status, err)
+		c.JSON(500, gin.H{"error": "Failed to price order"})
+		return
+	}
+
+	// An uncommitted reservation is released by book-service when it
+	// expires. The promotions redeemed for the order are released now so
+	// that they do not count an order that was never placed.
+	if err := resolveReservation(c, reservation.ID, "commit"); err != nil {
+		log.Printf("Failed to commit reservation %d: %v", reservation.ID, err)
+		if newOrder.PriceMinor != nil {
+			if err := releaseRedemptions(c, book.ID, orderID); err != nil {
+				log.Printf("Failed to release promotion redemptions of order %s: %v", orderID, err)
+			}
+		}
+		c.JSON(500, gin.H{"error": "Failed to commit stock reservation"})
+		return
+	}
 	orderHistory = append(orderHistory, newOrder)
 
 	// Publish message to RabbitMQ
@@ -151,6 +389,24 @@ func placeOrder(c *gin.Context) {
 	}
 	defer ch.Close()
 
+	// Order events go to a fanout exchange so that every interested service
+	// gets its own copy. The order_events queue read by notification-service
+	// stays bound to it.
+	err = ch.ExchangeDeclare(
+		"order_events", // name
+		"fanout",       // type
+		true,           // durable
+		false,          // auto-deleted
+		false,          // internal
+		false,          // no-wait
+		nil,            // arguments
+	)
+	if err != nil {
+		log.Printf("Failed to declare an exchange: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to declare message exchange"})
+		return
+	}
+
 	q, err := ch.QueueDeclare(
 		"order_events", // name
 		true,           // durable
@@ -164,23 +420,30 @@ func placeOrder(c *gin.Context) {
 		c.JSON(500, gin.H{"error": "Failed to declare message queue"})
 		return
 	}
+	if err := ch.QueueBind(q.Name, "", "order_events", false, nil); err != nil {
+		log.Printf("Failed to bind a queue: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to bind message queue"})
+		return
+	}
 
 	orderEvent := map[string]interface{}{
-		"order_id":  orderID,
-		"book_id":   book.ID,
-		"title":     book.Title,
-		"author":    book.Author,
-		"username":  username,
-		"timestamp": time.Now(),
-		"message":   fmt.Sprintf("Order %s placed for book: %s by %s", orderID, book.Title, book.Author),
+		"order_id":   orderID,
+		"book_id":    book.ID,
+		"variant_id": newOrder.VariantID,
+		"sku":        newOrder.SKU,
+		"title":      book.Title,
+		"author":     book.Author,
+		"username":   username,
+		"timestamp":  time.Now(),
+		"message":    fmt.Sprintf("Order %s placed for book: %s by %s", orderID, book.Title, book.Author),
 	}
 	body, _ := json.Marshal(orderEvent)
 
 	err = ch.Publish(
-		"",     // exchange
-		q.Name, // routing key
-		false,  // mandatory
-		false,  // immediate
+		"order_events", // exchange
+		"",             // routing key
+		false,          // mandatory
+		false,          // immediate
 		amqp.Publishing{
 			ContentType: "application/json",
 			Body:        body,
@@ -29,6 +29,13 @@ func NewUserRepo() *UserRepo {
 				Role:      "user",
 				CreatedAt: "2024-01-01T00:00:00Z",
 			},
+			"editor": {
+				Username:  "editor",
+				Email:     "editor@bookstore.com",
+				FullName:  "Catalog Editor",
+				Role:      "catalog-editor",
+				CreatedAt: "2024-01-01T00:00:00Z",
+			},
 		},
 	}
 }
@@ -65,7 +72,7 @@ func (r *UserRepo) Update(username string, update models.UserProfileUpdate) (*mo
 
 // ValidateCredentials checks username and password (demo only)
 func (r *UserRepo) ValidateCredentials(username, password string) (*models.User, error) {
-	if (username == "admin" || username == "user") && password == "password" {
+	if (username == "admin" || username == "user" || username == "editor") && password == "password" {
 		return r.GetByUsername(username)
 	}
 	return nil, errors.New("invalid credentials")